@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"time"
+)
+
+// How often the admin server retries binding AdminListenAddr, e.g. while the service it replaces on
+// a config reload still holds it.
+const adminListenRetryInterval = time.Second
+
+// adminServer serves the plugin's own liveness and readiness on AdminListenAddr, independent of
+// Envoy.
+type adminServer struct {
+	server *http.Server
+	// Redacted summary of the config, included in every response.
+	config map[string]interface{}
+}
+
+func newAdminServer(config *Config) *adminServer {
+	return &adminServer{
+		server: &http.Server{Addr: config.AdminListenAddr},
+		config: map[string]interface{}{
+			"authUrl":         redactedUrl(config.AuthUrl),
+			"fallbackAuthUrl": redactedUrl(config.FallbackAuthUrl),
+			"protocol":        config.Protocol,
+			"failureMode":     config.FailureMode,
+			"requestTimeout":  config.RequestTimeout,
+			"cacheTTL":        config.CacheTTL,
+		},
+	}
+}
+
+// serveAdmin binds AdminListenAddr, retrying until it's free or the service is stopped, and
+// serves /healthz and /ready until Stop shuts the server down.
+func (c *RemoteAuthService) serveAdmin(log *zap.SugaredLogger) {
+	warned := false
+	for {
+		listener, err := net.Listen("tcp", c.admin.server.Addr)
+		if err == nil {
+			if err := c.admin.server.Serve(listener); err != http.ErrServerClosed {
+				log.Warnw("Admin server failed", zap.String("addr", c.admin.server.Addr), zap.Error(err))
+			}
+			return
+		}
+		if !warned {
+			log.Warnw("Unable to listen on AdminListenAddr, retrying", zap.String("addr", c.admin.server.Addr), zap.Error(err))
+			warned = true
+		}
+		select {
+		case <-time.After(adminListenRetryInterval):
+		case <-c.shutdown.stopped:
+			return
+		}
+	}
+}
+
+// adminHandler serves /healthz, which succeeds while the service isn't stopping, and /ready,
+// which also requires the last health check of the auth backend to have succeeded when
+// HealthCheckInterval is configured. Both respond with the status, the redacted config summary,
+// the last known health of the auth backend and, with EnableMetrics, the DedupeMetrics.
+func (c *RemoteAuthService) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		c.writeAdminStatus(w, !c.shutdown.isStopping())
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		ready := !c.shutdown.isStopping()
+		if status, enabled := c.Health(); enabled {
+			ready = ready && status.Healthy
+		}
+		c.writeAdminStatus(w, ready)
+	})
+	return mux
+}
+
+func (c *RemoteAuthService) writeAdminStatus(w http.ResponseWriter, ok bool) {
+	body := map[string]interface{}{"status": "ok", "config": c.admin.config}
+	if status, enabled := c.Health(); enabled {
+		backend := map[string]interface{}{"healthy": status.Healthy, "error": status.Error}
+		if !status.CheckedAt.IsZero() {
+			backend["checkedAt"] = status.CheckedAt.UTC().Format(time.RFC3339)
+		}
+		body["backend"] = backend
+	}
+	if metrics, enabled := c.DedupeMetrics(); enabled {
+		body["dedupe"] = metrics
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		body["status"] = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// stopAdmin shuts the admin server down, waiting for in-flight probes until ctx is done.
+func (c *RemoteAuthService) stopAdmin(ctx context.Context) error {
+	if c.admin == nil {
+		return nil
+	}
+	return c.admin.server.Shutdown(ctx)
+}
@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClientAssertionTTL = 5 * time.Minute
+
+	// Query parameters of assertions that aren't sent in a header, as in the form of RFC 7523.
+	ClientAssertionParam     = "client_assertion"
+	ClientAssertionTypeParam = "client_assertion_type"
+	ClientAssertionType      = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+)
+
+// clientAssertion mints the JWT client assertions attached to outgoing auth requests. An assertion
+// is reused until a fifth of its lifetime is left, so requests aren't signed one by one.
+type clientAssertion struct {
+	signer jwtSigner
+	claims map[string]string
+	ttl    time.Duration
+	header string
+
+	mu      sync.Mutex
+	token   string
+	renewAt time.Time
+}
+
+// jwtSigner signs JWTs with the algorithm it names.
+type jwtSigner struct {
+	alg  string
+	sign func(signingInput []byte) ([]byte, error)
+}
+
+func newClientAssertion(config *Config, ttl time.Duration) (*clientAssertion, error) {
+	if config.ClientAssertionKey == "" {
+		return nil, nil
+	}
+	signer, err := newJwtSigner(config.ClientAssertionKey)
+	if err != nil {
+		return nil, err
+	}
+	return &clientAssertion{signer: signer, claims: config.ClientAssertionClaims, ttl: ttl, header: config.ClientAssertionHeader}, nil
+}
+
+// newJwtSigner signs with a PEM encoded RSA (RS256) or ECDSA (ES256, ES384 or ES512 by curve)
+// private key, in PKCS#1, SEC 1 or PKCS#8 form. A key that isn't PEM encoded is used as an HS256
+// secret.
+func newJwtSigner(key string) (jwtSigner, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		secret := []byte(key)
+		return jwtSigner{alg: "HS256", sign: func(signingInput []byte) ([]byte, error) {
+			mac := hmac.New(crypto.SHA256.New, secret)
+			mac.Write(signingInput)
+			return mac.Sum(nil), nil
+		}}, nil
+	}
+
+	var privateKey interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		privateKey, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		privateKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return jwtSigner{}, err
+	}
+	switch privateKey := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return jwtSigner{alg: "RS256", sign: func(signingInput []byte) ([]byte, error) {
+			digest := crypto.SHA256.New()
+			digest.Write(signingInput)
+			return rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest.Sum(nil))
+		}}, nil
+	case *ecdsa.PrivateKey:
+		alg, hash := "ES256", crypto.SHA256
+		switch privateKey.Curve {
+		case elliptic.P384():
+			alg, hash = "ES384", crypto.SHA384
+		case elliptic.P521():
+			alg, hash = "ES512", crypto.SHA512
+		}
+		size := (privateKey.Curve.Params().BitSize + 7) / 8
+		return jwtSigner{alg: alg, sign: func(signingInput []byte) ([]byte, error) {
+			digest := hash.New()
+			digest.Write(signingInput)
+			r, s, err := ecdsa.Sign(rand.Reader, privateKey, digest.Sum(nil))
+			if err != nil {
+				return nil, err
+			}
+			// JWS signatures are the fixed size big-endian r and s, concatenated.
+			signature := make([]byte, 2*size)
+			rBytes, sBytes := r.Bytes(), s.Bytes()
+			copy(signature[size-len(rBytes):size], rBytes)
+			copy(signature[2*size-len(sBytes):], sBytes)
+			return signature, nil
+		}}, nil
+	}
+	return jwtSigner{}, errors.New(fmt.Sprintf("unsupported private key type %T", privateKey))
+}
+
+// attach sets the current assertion on the request, in the configured header or else as the
+// client_assertion query parameter.
+func (a *clientAssertion) attach(request *http.Request) error {
+	if a == nil {
+		return nil
+	}
+	token, err := a.current(time.Now())
+	if err != nil {
+		return err
+	}
+	if a.header != "" {
+		request.Header.Set(a.header, token)
+		return nil
+	}
+	query := request.URL.Query()
+	query.Set(ClientAssertionTypeParam, ClientAssertionType)
+	query.Set(ClientAssertionParam, token)
+	request.URL.RawQuery = query.Encode()
+	return nil
+}
+
+// inQuery reports whether assertions are sent as a query parameter, to be redacted from errors.
+func (a *clientAssertion) inQuery() bool {
+	return a != nil && a.header == ""
+}
+
+// current returns the assertion valid at now, minting a new one when it's close to expiry.
+func (a *clientAssertion) current(now time.Time) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && now.Before(a.renewAt) {
+		return a.token, nil
+	}
+	token, err := a.mint(now)
+	if err != nil {
+		return "", err
+	}
+	a.token, a.renewAt = token, now.Add(a.ttl-a.ttl/5)
+	return token, nil
+}
+
+// mint signs an assertion with the configured claims, which can't override the iat, exp and jti
+// claims set for each assertion.
+func (a *clientAssertion) mint(now time.Time) (string, error) {
+	claims := map[string]interface{}{}
+	for claim, value := range a.claims {
+		claims[claim] = value
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(a.ttl).Unix()
+	claims["jti"] = newUuid()
+
+	header, err := json.Marshal(map[string]string{"alg": a.signer.alg, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := a.signer.sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
@@ -0,0 +1,114 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientAssertionSignatures(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ecDer, _ := x509.MarshalECPrivateKey(ecKey)
+	pkcs8Der, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+	tests := []struct {
+		name        string
+		key         string
+		verifierKey string
+	}{
+		{"hmac", "secret", "secret"},
+		{"rsa", string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})), pemPublicKey(t, &rsaKey.PublicKey)},
+		{"pkcs8 rsa", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Der})), pemPublicKey(t, &rsaKey.PublicKey)},
+		{"ecdsa", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDer})), pemPublicKey(t, &ecKey.PublicKey)},
+	}
+	for _, test := range tests {
+		assertion, err := newClientAssertion(&Config{
+			ClientAssertionKey:    test.key,
+			ClientAssertionClaims: map[string]string{"iss": "shoreline", "aud": "https://auth/introspect", "exp": "never"},
+		}, time.Minute)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.name, err)
+		}
+		now := time.Now()
+		token, err := assertion.current(now)
+		if err != nil {
+			t.Fatalf("%v: unable to mint an assertion: %v", test.name, err)
+		}
+		verifier, _ := newJwtVerifier(test.verifierKey)
+		claims, err := decodeJwtClaims(token, verifier)
+		if err != nil {
+			t.Fatalf("%v: expected the assertion to verify, got %v", test.name, err)
+		}
+		if claims["iss"] != "shoreline" || claims["aud"] != "https://auth/introspect" || claims["jti"] == "" {
+			t.Errorf("%v: expected the configured claims and a jti, got %v", test.name, claims)
+		}
+		if exp, _ := claims["exp"].(float64); int64(exp) != now.Add(time.Minute).Unix() {
+			t.Errorf("%v: expected the assertion to expire after a minute, got %v", test.name, claims["exp"])
+		}
+	}
+}
+
+func TestClientAssertionIsReusedUntilCloseToExpiry(t *testing.T) {
+	assertion, _ := newClientAssertion(&Config{ClientAssertionKey: "secret"}, 5*time.Minute)
+	now := time.Now()
+	first, _ := assertion.current(now)
+	if reused, _ := assertion.current(now.Add(3 * time.Minute)); reused != first {
+		t.Error("expected the assertion to be reused while it's fresh")
+	}
+	if renewed, _ := assertion.current(now.Add(4*time.Minute + time.Second)); renewed == first {
+		t.Error("expected the assertion to be renewed close to its expiry")
+	}
+}
+
+func TestAuthorizeSendsClientAssertion(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, ClientAssertionKey: "secret", ClientAssertionHeader: "X-Client-Assertion"})
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	verifier, _ := newJwtVerifier("secret")
+	if _, err := decodeJwtClaims(received.Header.Get("X-Client-Assertion"), verifier); err != nil {
+		t.Errorf("expected a signed assertion header, got %v", err)
+	}
+
+	service = newAuthService(t, &Config{AuthUrl: server.URL, ClientAssertionKey: "secret"})
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	query := received.URL.Query()
+	if query.Get(ClientAssertionTypeParam) != ClientAssertionType {
+		t.Errorf("expected the assertion type parameter, got %v", query)
+	}
+	if _, err := decodeJwtClaims(query.Get(ClientAssertionParam), verifier); err != nil {
+		t.Errorf("expected a signed assertion parameter, got %v", err)
+	}
+}
+
+func TestClientAssertionIsRedactedFromErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, ClientAssertionKey: "secret"})
+	_, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err == nil {
+		t.Fatal("expected an error calling a closed server")
+	}
+	if !strings.Contains(err.Error(), ClientAssertionParam+"=xxxxx") || strings.Contains(err.Error(), url.QueryEscape(service.clientAssertion.token)) {
+		t.Errorf("expected the assertion to be redacted, got %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	BodyHashAlgorithmSha256 = "sha256"
+	BodyHashAlgorithmSha512 = "sha512"
+)
+
+// bodyHasher sets a hex encoded digest of the original request body on outgoing auth requests, so
+// the auth backend can verify the body without it being resent. With contentTypes, only bodies of
+// those lowercased media types are hashed.
+type bodyHasher struct {
+	newHash      func() hash.Hash
+	header       string
+	contentTypes []string
+}
+
+func newBodyHasher(config *Config) *bodyHasher {
+	if config.BodyHashHeader == "" {
+		return nil
+	}
+	newHash, _ := bodyHashFunc(config.BodyHashAlgorithm)
+	contentTypes := make([]string, 0, len(config.BodyHashContentTypes))
+	for _, contentType := range config.BodyHashContentTypes {
+		contentTypes = append(contentTypes, strings.ToLower(contentType))
+	}
+	return &bodyHasher{newHash: newHash, header: config.BodyHashHeader, contentTypes: contentTypes}
+}
+
+// validateBodyHashContentType checks a BodyHashContentTypes entry is a media type or "type/*".
+func validateBodyHashContentType(contentType string) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return err
+	}
+	if len(params) > 0 || !strings.Contains(mediaType, "/") {
+		return errors.New("must be a media type without parameters, e.g. application/json")
+	}
+	return nil
+}
+
+// bodyHashFunc returns the hash for the algorithm, BodyHashAlgorithmSha256 when empty.
+func bodyHashFunc(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case "", BodyHashAlgorithmSha256:
+		return sha256.New, nil
+	case BodyHashAlgorithmSha512:
+		return sha512.New, nil
+	}
+	return nil, errors.New("must be one of " + BodyHashAlgorithmSha256 + ", " + BodyHashAlgorithmSha512)
+}
+
+// hashes reports whether the body of a request with the contentType header is hashed.
+func (b *bodyHasher) hashes(contentType string) bool {
+	if len(b.contentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range b.contentTypes {
+		if allowed == mediaType || (strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *bodyHasher) hash(request *http.Request, body string, contentType string) {
+	if b == nil || !b.hashes(contentType) {
+		return
+	}
+	digest := b.newHash()
+	digest.Write([]byte(body))
+	request.Header.Set(b.header, hex.EncodeToString(digest.Sum(nil)))
+}
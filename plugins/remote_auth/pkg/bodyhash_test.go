@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeSendsBodyHash(t *testing.T) {
+	sha256Sum := sha256.Sum256([]byte("{\"amount\": 10}"))
+	sha512Sum := sha512.Sum512([]byte("{\"amount\": 10}"))
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{"", hex.EncodeToString(sha256Sum[:])},
+		{BodyHashAlgorithmSha512, hex.EncodeToString(sha512Sum[:])},
+	}
+	for _, test := range tests {
+		var received http.Header
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header
+		}))
+
+		service := newAuthService(t, &Config{
+			AuthUrl:           server.URL,
+			BodyHashHeader:    "x-body-hash",
+			BodyHashAlgorithm: test.algorithm,
+			SigningSecret:     "secret",
+			SignedHeaders:     []string{"x-body-hash"},
+		})
+		request := newAuthorizationRequest(nil)
+		request.CheckRequest.Attributes.Request.Http.Body = "{\"amount\": 10}"
+		if _, err := service.Authorize(context.Background(), request); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		server.Close()
+
+		if hash := received.Get("x-body-hash"); hash != test.expected {
+			t.Errorf("expected %v body hash %v, got %v", test.algorithm, test.expected, hash)
+		}
+		if expected := service.signer.signature(received); received.Get(DefaultSignatureHeader) != expected {
+			t.Error("expected the body hash to be signed")
+		}
+	}
+}
+
+func TestAuthorizeHashesOnlyAllowedContentTypes(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:              server.URL,
+		BodyHashHeader:       "x-body-hash",
+		BodyHashContentTypes: []string{"application/json", "Text/*"},
+	})
+	tests := []struct {
+		contentType string
+		hashed      bool
+	}{
+		{"application/json", true},
+		{"Application/JSON; charset=utf-8", true},
+		{"text/csv", true},
+		{"multipart/form-data; boundary=xyz", false},
+		{"application/octet-stream", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		headers := map[string]string{}
+		if test.contentType != "" {
+			headers["content-type"] = test.contentType
+		}
+		request := newAuthorizationRequest(headers)
+		request.CheckRequest.Attributes.Request.Http.Body = "{\"amount\": 10}"
+		if _, err := service.Authorize(context.Background(), request); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if hashed := received.Get("x-body-hash") != ""; hashed != test.hashed {
+			t.Errorf("%q: expected hashed %v, got %v", test.contentType, test.hashed, hashed)
+		}
+	}
+}
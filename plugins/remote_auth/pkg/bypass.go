@@ -0,0 +1,23 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"strings"
+)
+
+// bypassed reports whether the request carries BypassHeader with BypassValue. The digests of the
+// values are compared, in constant time, so neither the value nor its length leaks through timing.
+func (c *RemoteAuthService) bypassed(authzRequest *api.AuthorizationRequest) bool {
+	if c.BypassHeader == "" {
+		return false
+	}
+	headers := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	value, ok := headers[strings.ToLower(c.BypassHeader)]
+	if !ok {
+		return false
+	}
+	actual, expected := sha256.Sum256([]byte(value)), sha256.Sum256([]byte(c.BypassValue))
+	return subtle.ConstantTimeCompare(actual[:], expected[:]) == 1
+}
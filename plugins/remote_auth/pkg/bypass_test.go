@@ -0,0 +1,37 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestAuthorizeWithBypassHeader(t *testing.T) {
+	calls := 0
+	service := newAuthService(t, &Config{AuthUrl: "http://auth", BypassHeader: "X-Internal-Bypass", BypassValue: "s3cr3t"})
+	service.httpClient = doerFunc(func(request *http.Request) (*http.Response, error) {
+		calls++
+		return stubResponse(http.StatusUnauthorized, "")(request)
+	})
+
+	tests := []struct {
+		headers map[string]string
+		allowed bool
+		calls   int
+	}{
+		{map[string]string{"x-internal-bypass": "s3cr3t"}, true, 0},
+		{map[string]string{"x-internal-bypass": "s3cr3"}, false, 1},
+		{map[string]string{"x-internal-bypass": ""}, false, 1},
+		{nil, false, 1},
+	}
+	for _, test := range tests {
+		calls = 0
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(test.headers))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if isAllowedResponse(response) != test.allowed || calls != test.calls {
+			t.Errorf("%v: expected allowed %v after %v auth calls, got %v after %v", test.headers, test.allowed, test.calls, isAllowedResponse(response), calls)
+		}
+	}
+}
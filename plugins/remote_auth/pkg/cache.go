@@ -0,0 +1,220 @@
+package pkg
+
+import (
+	"container/list"
+	"context"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheMaxEntries = 10000
+	// Bounds a background cache refresh when no RequestTimeout is configured.
+	DefaultCacheRefreshTimeout = 10 * time.Second
+	// How long past their expiry cached decisions may be served by ServeStaleOnError.
+	DefaultMaxStaleAge = 5 * time.Minute
+)
+
+// responseCache holds decisions keyed by request fingerprint, evicting the least recently used
+// entry once maxEntries is reached.
+type responseCache struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	// How long denied decisions are cached, zero when they aren't.
+	negativeTtl time.Duration
+	maxEntries  int
+	// Expired entries are kept this long for getStale, zero when stale decisions aren't served.
+	maxStaleAge time.Duration
+	// Taken off the TTL of decisions cached until a reported expiry, see ClockSkewGrace.
+	clockSkewGrace time.Duration
+	entries        map[string]*list.Element
+	// Most recently used entries are at the front.
+	order *list.List
+}
+
+type cacheEntry struct {
+	key        string
+	response   *api.AuthorizationResponse
+	expires    time.Time
+	refreshing bool
+}
+
+func newResponseCache(ttl time.Duration, maxEntries int) *responseCache {
+	return &responseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		order:      list.New(),
+	}
+}
+
+// get returns the cached response and its expiry, removing the entry when it has expired and is
+// too old to be served stale.
+func (r *responseCache) get(key string) (*api.AuthorizationResponse, time.Time, bool) {
+	return r.lookup(key, 0)
+}
+
+// getStale returns the cached response even when it has expired, as long as that was less than
+// maxStaleAge ago.
+func (r *responseCache) getStale(key string) (*api.AuthorizationResponse, time.Time, bool) {
+	return r.lookup(key, r.maxStaleAge)
+}
+
+func (r *responseCache) lookup(key string, staleAge time.Duration) (*api.AuthorizationResponse, time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	element, ok := r.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires.Add(r.maxStaleAge)) {
+		r.removeElement(element)
+		return nil, time.Time{}, false
+	}
+	if !now.Before(entry.expires.Add(staleAge)) {
+		return nil, time.Time{}, false
+	}
+	r.order.MoveToFront(element)
+	return entry.response, entry.expires, true
+}
+
+func (r *responseCache) put(key string, response *api.AuthorizationResponse, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if element, ok := r.entries[key]; ok {
+		r.removeElement(element)
+	}
+	for r.order.Len() >= r.maxEntries {
+		r.removeElement(r.order.Back())
+	}
+	entry := &cacheEntry{key: key, response: response, expires: time.Now().Add(ttl)}
+	r.entries[key] = r.order.PushFront(entry)
+}
+
+func (r *responseCache) remove(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if element, ok := r.entries[key]; ok {
+		r.removeElement(element)
+	}
+}
+
+// startRefresh marks the entry as being refreshed, reporting false when it's gone or a refresh is
+// already running, so each entry has at most one refresh in flight.
+func (r *responseCache) startRefresh(key string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	element, ok := r.entries[key]
+	if !ok {
+		return false
+	}
+	entry := element.Value.(*cacheEntry)
+	if entry.refreshing {
+		return false
+	}
+	entry.refreshing = true
+	return true
+}
+
+func (r *responseCache) finishRefresh(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if element, ok := r.entries[key]; ok {
+		element.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+func (r *responseCache) removeElement(element *list.Element) {
+	r.order.Remove(element)
+	delete(r.entries, element.Value.(*cacheEntry).key)
+}
+
+// cached serves decisions from the cache, deciding and caching on a miss. Allowed entries within
+// CacheRefreshAhead of expiring are still served, and refreshed in the background. Denied
+// decisions are only cached with NegativeCacheTTL, and never when a backend answered with a
+// server error.
+func (c *RemoteAuthService) cached(ctx context.Context, requestCtx context.Context, log *zap.SugaredLogger, authzRequest *api.AuthorizationRequest, span *span) (*api.AuthorizationResponse, error) {
+	key, err := c.fingerprint(authzRequest, c.cacheKeyHeaders)
+	if err != nil {
+		return nil, err
+	}
+	if response, expires, ok := c.cache.get(key); ok {
+		log.Debugw("Serving cached decision")
+		c.metrics.record(OutcomeCacheHit)
+		span.setAttribute("auth.cached", true)
+		if c.cacheRefreshAhead > 0 && isAllowedResponse(response) && time.Until(expires) <= c.cacheRefreshAhead && c.cache.startRefresh(key) {
+			go c.refreshCached(log, key, authzRequest)
+		}
+		return copyResponse(response), nil
+	}
+
+	c.metrics.record(OutcomeCacheMiss)
+	ctx, requestCtx, expiry := withDecisionExpiry(ctx, requestCtx)
+	response, err := c.uncached(ctx, requestCtx, log, authzRequest, span)
+	if err == nil && isAllowedResponse(response) {
+		c.cacheDecision(log, key, copyResponse(response), expiry)
+	} else if err == nil && c.cache.negativeTtl > 0 && !expiry.hadServerError() {
+		c.cache.put(key, copyResponse(response), c.cache.negativeTtl)
+	}
+	if err != nil && c.ServeStaleOnError && isUpstreamError(err) {
+		if stale, expires, ok := c.cache.getStale(key); ok {
+			log.Warnw("Auth backend unreachable, serving stale cached decision",
+				zap.Error(err), zap.Duration("stale_for", time.Since(expires)))
+			c.metrics.record(OutcomeCacheStale)
+			span.setAttribute("auth.cached", true)
+			span.setAttribute("auth.stale", true)
+			return copyResponse(stale), nil
+		}
+	}
+	return response, err
+}
+
+// cacheDecision caches an allowed decision for CacheTTL, or until ClockSkewGrace before the expiry
+// reported in the ExpiryAttribute of the auth response. Decisions that have already expired aren't
+// cached.
+func (c *RemoteAuthService) cacheDecision(log *zap.SugaredLogger, key string, response *api.AuthorizationResponse, expiry *decisionExpiry) {
+	ttl := expiry.ttl(c.cache.ttl, c.cache.clockSkewGrace)
+	if ttl <= 0 {
+		log.Debugw("Decision has already expired, not caching it")
+		c.cache.remove(key)
+		return
+	}
+	c.cache.put(key, response, ttl)
+}
+
+// refreshCached replaces a cached decision with a fresh one. It runs detached from the request
+// that triggered it, bounded by RequestTimeout, or DefaultCacheRefreshTimeout when there's none,
+// and the service lifetime. The entry is dropped when the backend no longer allows the request,
+// and kept until it expires when the backend can't be reached.
+func (c *RemoteAuthService) refreshCached(log *zap.SugaredLogger, key string, authzRequest *api.AuthorizationRequest) {
+	defer c.cache.finishRefresh(key)
+	done, err := c.shutdown.track()
+	if err != nil {
+		return
+	}
+	defer done()
+
+	refreshCtx, cancel := c.requestContext(context.Background())
+	defer cancel()
+	if c.requestTimeout == 0 {
+		refreshCtx, cancel = context.WithTimeout(refreshCtx, DefaultCacheRefreshTimeout)
+		defer cancel()
+	}
+
+	ctx, refreshCtx, expiry := withDecisionExpiry(context.Background(), refreshCtx)
+	response, err := c.decideRequest(ctx, refreshCtx, log, authzRequest, nil)
+	switch {
+	case err != nil:
+		log.Warnw("Unable to refresh cached decision", zap.Error(err))
+	case isAllowedResponse(response):
+		log.Debugw("Refreshed cached decision")
+		c.cacheDecision(log, key, response, expiry)
+	default:
+		log.Infow("Refreshed decision no longer allows the request, dropping cached decision")
+		c.cache.remove(key)
+	}
+}
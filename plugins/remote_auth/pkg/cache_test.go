@@ -0,0 +1,337 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeCachesAllowedDecisions(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("x-tidepool-session-token") == "denied" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "{\"userid\": \"%s\"}", r.Header.Get("x-tidepool-session-token"))
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"x-tidepool-session-token"},
+		ResponseHeaders:       map[string]string{"userid": "x-auth-subject-id"},
+		CacheTTL:              "1m",
+	})
+	for _, token := range []string{"a", "a", "b", "denied", "denied", "a"} {
+		request := newAuthorizationRequest(map[string]string{"x-tidepool-session-token": token})
+		response, err := service.Authorize(context.Background(), request)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if value, _ := responseHeaderValue(response, "x-auth-subject-id"); token != "denied" && value != token {
+			t.Errorf("expected subject id %v, got %q", token, value)
+		}
+	}
+
+	if calls := atomic.LoadInt32(&calls); calls != 4 {
+		t.Errorf("expected one upstream call per allowed request and one per denied request, got %v", calls)
+	}
+}
+
+func TestAuthorizeCachesByCacheKeyHeaders(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"authorization", "user-agent"},
+		CacheTTL:              "1m",
+		CacheKeyHeaders:       []string{"Authorization"},
+	})
+	requests := []map[string]string{
+		{"authorization": "Bearer a", "user-agent": "curl"},
+		{"authorization": "Bearer a", "user-agent": "browser"},
+		{"authorization": "Bearer b", "user-agent": "curl"},
+	}
+	for _, headers := range requests {
+		if _, err := service.Authorize(context.Background(), newAuthorizationRequest(headers)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("expected one upstream call per authorization header, got %v", calls)
+	}
+}
+
+func TestAuthorizeCachesAcrossTraceContexts(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"authorization"},
+		PropagateTraceContext: true,
+		CacheTTL:              "1m",
+	})
+	traceParents := []string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}
+	for _, traceParent := range traceParents {
+		request := newAuthorizationRequest(map[string]string{
+			"authorization":   "Bearer a",
+			TraceParentHeader: traceParent,
+			TraceStateHeader:  "vendor=" + traceParent[3:7],
+		})
+		if _, err := service.Authorize(context.Background(), request); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("expected requests differing only by trace context to share a cache entry, got %v upstream calls", calls)
+	}
+}
+
+func TestAuthorizeRefreshesCachedDecisionsAhead(t *testing.T) {
+	var calls int32
+	refreshed := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt32(&calls, 1)
+		fmt.Fprintf(w, "{\"version\": \"%d\"}", call)
+		if call > 1 {
+			refreshed <- struct{}{}
+		}
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:           server.URL,
+		ResponseHeaders:   map[string]string{"version": "x-auth-version"},
+		CacheTTL:          "1s",
+		CacheRefreshAhead: "900ms",
+	})
+	authorize := func() string {
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		value, _ := responseHeaderValue(response, "x-auth-version")
+		return value
+	}
+
+	if version := authorize(); version != "1" {
+		t.Errorf("expected the upstream decision, got version %q", version)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if version := authorize(); version != "1" {
+		t.Errorf("expected the cached decision while refreshing, got version %q", version)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("expected the cached decision to be refreshed in the background")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if version := authorize(); version != "2" {
+		t.Errorf("expected the refreshed decision, got version %q", version)
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newResponseCache(time.Minute, 2)
+	cache.put("a", api.AuthorizedResponse(), time.Minute)
+	cache.put("b", api.AuthorizedResponse(), time.Minute)
+	cache.get("a")
+	cache.put("c", api.AuthorizedResponse(), time.Minute)
+
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, ok := cache.get(key); ok != expected {
+			t.Errorf("expected %v to be cached: %v", key, expected)
+		}
+	}
+}
+
+func TestAuthorizeCachesUntilExpiryAttribute(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch r.Header.Get("x-tidepool-session-token") {
+		case "expiring":
+			fmt.Fprintf(w, "{\"exp\": %v}", float64(time.Now().Add(300*time.Millisecond).UnixNano())/float64(time.Second))
+		case "expired":
+			fmt.Fprintf(w, "{\"exp\": %d}", time.Now().Add(-time.Minute).Unix())
+		default:
+			fmt.Fprint(w, "{\"exp\": \"soon\"}")
+		}
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"x-tidepool-session-token"},
+		CacheTTL:              "1m",
+		ExpiryAttribute:       "exp",
+	})
+	authorize := func(token string) {
+		request := newAuthorizationRequest(map[string]string{"x-tidepool-session-token": token})
+		if _, err := service.Authorize(context.Background(), request); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	expectCalls := func(expected int32) {
+		t.Helper()
+		if calls := atomic.LoadInt32(&calls); calls != expected {
+			t.Errorf("expected %v upstream calls, got %v", expected, calls)
+		}
+	}
+
+	authorize("expiring")
+	authorize("expiring")
+	expectCalls(1)
+	time.Sleep(400 * time.Millisecond)
+	authorize("expiring")
+	expectCalls(2)
+
+	authorize("expired")
+	authorize("expired")
+	expectCalls(4)
+
+	authorize("invalid")
+	authorize("invalid")
+	expectCalls(5)
+}
+
+func TestAuthorizeCachesDeniedDecisionsForNegativeCacheTTL(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		switch r.Header.Get("x-tidepool-session-token") {
+		case "denied":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "broken":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, "{\"userid\": \"123\"}")
+		}
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"x-tidepool-session-token"},
+		ResponseHeaders:       map[string]string{"userid": "x-auth-subject-id"},
+		CacheTTL:              "1m",
+		NegativeCacheTTL:      "50ms",
+	})
+	authorize := func(token string, allowed bool) {
+		t.Helper()
+		request := newAuthorizationRequest(map[string]string{"x-tidepool-session-token": token})
+		response, err := service.Authorize(context.Background(), request)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if isAllowedResponse(response) != allowed {
+			t.Errorf("expected %v to be allowed %v", token, allowed)
+		}
+	}
+	expectCalls := func(expected int32) {
+		t.Helper()
+		if actual := atomic.LoadInt32(&calls); actual != expected {
+			t.Errorf("expected %v upstream calls, got %v", expected, actual)
+		}
+	}
+
+	authorize("allowed", true)
+	authorize("allowed", true)
+	authorize("denied", false)
+	authorize("denied", false)
+	expectCalls(2)
+
+	authorize("broken", false)
+	authorize("broken", false)
+	expectCalls(4)
+
+	time.Sleep(60 * time.Millisecond)
+	authorize("denied", false)
+	authorize("allowed", true)
+	expectCalls(5)
+}
+
+func TestAuthorizeNeverCachesUnreachableBackend(t *testing.T) {
+	service := newAuthService(t, &Config{
+		AuthUrl:          "http://auth.example.com",
+		CacheTTL:         "1m",
+		NegativeCacheTTL: "1m",
+	})
+	var calls int32
+	service.httpClient = doerFunc(func(request *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("connection refused")
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err == nil {
+			t.Fatal("expected the unreachable backend to fail the request")
+		}
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("expected every request to call the backend, got %v calls", calls)
+	}
+}
+
+func TestAuthorizeServesStaleDecisionsWhenBackendUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{\"userid\": \"123\"}")
+	}))
+
+	service := newAuthService(t, &Config{
+		AuthUrl:           server.URL,
+		ResponseHeaders:   map[string]string{"userid": "x-auth-subject-id"},
+		CacheTTL:          "10ms",
+		ServeStaleOnError: true,
+		MaxStaleAge:       "200ms",
+	})
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	server.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("expected the stale decision to be served, got %v", err)
+	}
+	if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != "123" {
+		t.Errorf("expected the stale subject id, got %q", value)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err == nil {
+		t.Error("expected decisions older than MaxStaleAge not to be served")
+	}
+}
+
+func TestResponseCacheOnlyServesFreshEntries(t *testing.T) {
+	cache := newResponseCache(time.Minute, 2)
+	cache.maxStaleAge = time.Minute
+	cache.put("a", api.AuthorizedResponse(), -time.Second)
+	if _, _, ok := cache.get("a"); ok {
+		t.Error("expected the expired entry not to be served fresh")
+	}
+	if _, _, ok := cache.getStale("a"); !ok {
+		t.Error("expected the expired entry to be kept for serving stale")
+	}
+}
@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"context"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"math/rand"
+)
+
+// decideWithCanary sends CanaryWeight percent of the requests to CanaryAuthUrl instead of
+// AuthUrl. In compare mode those requests go to AuthUrl, whose decision is enforced, and are also
+// sent to CanaryAuthUrl in the background, logging when the canary decides differently.
+func (c *RemoteAuthService) decideWithCanary(ctx context.Context, requestCtx context.Context, log *zap.SugaredLogger, authzRequest *api.AuthorizationRequest, span *span) (*api.AuthorizationResponse, error) {
+	if rand.Float64()*100 >= c.CanaryWeight {
+		return c.decideUrl(ctx, requestCtx, log, c.AuthUrl, c.FallbackAuthUrl, authzRequest, span)
+	}
+	if !c.CanaryCompare {
+		span.setAttribute("auth.canary", true)
+		return c.decideUrl(ctx, requestCtx, log.With("canary", true), c.CanaryAuthUrl, c.FallbackAuthUrl, authzRequest, span)
+	}
+
+	canary := make(chan *api.AuthorizationResponse, 1)
+	go c.decideCanary(log, authzRequest, canary)
+	response, err := c.decideUrl(ctx, requestCtx, log, c.AuthUrl, c.FallbackAuthUrl, authzRequest, span)
+	if err == nil {
+		go compareCanary(log, response, canary)
+	}
+	return response, err
+}
+
+// decideCanary calls CanaryAuthUrl in a detachedContext, like deduplicated calls, so it doesn't
+// delay or get cancelled with the enforced decision. It sends nil when the call fails.
+func (c *RemoteAuthService) decideCanary(log *zap.SugaredLogger, authzRequest *api.AuthorizationRequest, canary chan<- *api.AuthorizationResponse) {
+	done, err := c.shutdown.track()
+	if err != nil {
+		canary <- nil
+		return
+	}
+	defer done()
+
+	canaryCtx, cancel := c.detachedContext()
+	defer cancel()
+	response, err := c.decideUrl(context.Background(), canaryCtx, log.With("canary", true), c.CanaryAuthUrl, "", authzRequest, nil)
+	if err != nil {
+		canary <- nil
+		return
+	}
+	canary <- response
+}
+
+func compareCanary(log *zap.SugaredLogger, response *api.AuthorizationResponse, canary <-chan *api.AuthorizationResponse) {
+	canaryResponse := <-canary
+	if canaryResponse == nil {
+		log.Warnw("Canary auth backend failed, unable to compare decisions")
+		return
+	}
+	allowed, canaryAllowed := isAllowedResponse(response), isAllowedResponse(canaryResponse)
+	if allowed != canaryAllowed {
+		log.Warnw("Canary auth backend decision diverges from the enforced decision",
+			zap.Bool("allowed", allowed), zap.Bool("canary_allowed", canaryAllowed))
+		return
+	}
+	log.Debugw("Canary auth backend decision matches the enforced decision", zap.Bool("allowed", allowed))
+}
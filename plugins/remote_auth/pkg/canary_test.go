@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCountingServer(status int, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		w.WriteHeader(status)
+	}))
+}
+
+func TestAuthorizeRoutesCanaryWeight(t *testing.T) {
+	tests := []struct {
+		name          string
+		weight        float64
+		primaryCalls  int32
+		canaryCalls   int32
+		expectAllowed bool
+	}{
+		{"all to canary", 100, 0, 3, false},
+		{"none to canary", 0, 3, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var primaryCalls, canaryCalls int32
+			primary := newCountingServer(http.StatusOK, &primaryCalls)
+			defer primary.Close()
+			canary := newCountingServer(http.StatusUnauthorized, &canaryCalls)
+			defer canary.Close()
+
+			service := newAuthService(t, &Config{AuthUrl: primary.URL, CanaryAuthUrl: canary.URL, CanaryWeight: test.weight})
+			for i := 0; i < 3; i++ {
+				response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if isAllowedResponse(response) != test.expectAllowed {
+					t.Errorf("expected allowed to be %v", test.expectAllowed)
+				}
+			}
+			if calls := atomic.LoadInt32(&primaryCalls); calls != test.primaryCalls {
+				t.Errorf("expected %v primary calls, got %v", test.primaryCalls, calls)
+			}
+			if calls := atomic.LoadInt32(&canaryCalls); calls != test.canaryCalls {
+				t.Errorf("expected %v canary calls, got %v", test.canaryCalls, calls)
+			}
+		})
+	}
+}
+
+func TestAuthorizeComparesCanaryDecision(t *testing.T) {
+	called := make(chan struct{}, 1)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		called <- struct{}{}
+	}))
+	defer canary.Close()
+	var primaryCalls int32
+	primary := newCountingServer(http.StatusOK, &primaryCalls)
+	defer primary.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: primary.URL, CanaryAuthUrl: canary.URL, CanaryWeight: 100, CanaryCompare: true})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isAllowedResponse(response) {
+		t.Error("expected the primary decision to be enforced")
+	}
+	if calls := atomic.LoadInt32(&primaryCalls); calls != 1 {
+		t.Errorf("expected a single primary call, got %v", calls)
+	}
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the canary to be called")
+	}
+}
+
+func TestAuthorizeBoundsComparedCanaryCall(t *testing.T) {
+	cancelled := make(chan struct{}, 1)
+	release := make(chan struct{})
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-release:
+		}
+	}))
+	defer canary.Close()
+	defer close(release)
+	primary := newDecisionServer(http.StatusOK, "")
+	defer primary.Close()
+
+	// Without a RequestTimeout, only the detached call timeout stops the canary call.
+	service := newAuthService(t, &Config{AuthUrl: primary.URL, CanaryAuthUrl: canary.URL, CanaryWeight: 100, CanaryCompare: true})
+	service.detachedCallTimeout = 50 * time.Millisecond
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isAllowedResponse(response) {
+		t.Error("expected the primary decision to be enforced")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the blocked canary call to be cancelled")
+	}
+}
@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+)
+
+var ConcurrencyLimitError = errors.New("timed out waiting for an in-flight auth request to complete, MaxConcurrentRequests reached")
+
+// concurrencyLimiter is a semaphore bounding the auth requests in flight. A nil limiter doesn't
+// limit them.
+type concurrencyLimiter chan struct{}
+
+func newConcurrencyLimiter(config *Config) concurrencyLimiter {
+	if config.MaxConcurrentRequests <= 0 {
+		return nil
+	}
+	return make(concurrencyLimiter, config.MaxConcurrentRequests)
+}
+
+// acquire waits for a free slot until ctx is done, logging when the limit is saturated, and
+// returns the func releasing it.
+func (l concurrencyLimiter) acquire(ctx context.Context, log *zap.SugaredLogger) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	select {
+	case l <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	log.Warnw("MaxConcurrentRequests reached, waiting for an in-flight auth request to complete",
+		zap.Int("max_concurrent_requests", cap(l)))
+	select {
+	case l <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ConcurrencyLimitError
+	}
+}
+
+func (l concurrencyLimiter) release() {
+	<-l
+}
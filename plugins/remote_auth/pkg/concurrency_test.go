@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeLimitsConcurrentRequests(t *testing.T) {
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			seen := atomic.LoadInt32(&maxInFlight)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, MaxConcurrentRequests: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil || !isAllowedResponse(response) {
+				t.Errorf("expected the request to eventually be allowed, got %v, %v", response, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxInFlight > 2 {
+		t.Errorf("expected at most 2 requests in flight, got %v", maxInFlight)
+	}
+}
+
+func TestAuthorizeFailsWhenConcurrencyLimitExceedsDeadline(t *testing.T) {
+	for _, failureMode := range []string{FailureModeClosed, FailureModeOpen} {
+		t.Run(failureMode, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			defer server.Close()
+
+			service := newAuthService(t, &Config{
+				AuthUrl:               server.URL,
+				MaxConcurrentRequests: 1,
+				RequestTimeout:        "50ms",
+				FailureMode:           failureMode,
+			})
+			// Occupies the only slot, as a request that never completes would.
+			service.concurrencyLimiter <- struct{}{}
+
+			response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+			if failureMode == FailureModeOpen {
+				if err != nil || !isAllowedResponse(response) {
+					t.Errorf("expected the request to fail open, got %v, %v", response, err)
+				}
+				return
+			}
+			if !errors.Is(err, ConcurrencyLimitError) {
+				t.Errorf("expected ConcurrencyLimitError, got %v, %v", response, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"strings"
+	"unicode/utf16"
+)
+
+// contextHeaderValue returns the ContextAttributes of the request as a JSON object keyed by the
+// configured names, e.g. {"method":"GET","path":"/v1/users"}, or "" when the request has none of
+// them. Attributes the request doesn't have are left out. Keys are sorted and non-ASCII characters
+// are escaped, so the value is stable for the cache key and safe in a header.
+func contextHeaderValue(authzRequest *api.AuthorizationRequest, attributes map[string]string) string {
+	values := map[string]string{}
+	for name, source := range attributes {
+		if value := requestAttribute(authzRequest, source); value != "" {
+			values[name] = value
+		}
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		return ""
+	}
+	return asciiJson(string(b))
+}
+
+// asciiJson escapes the non-ASCII characters of encoded JSON as \u sequences, with surrogate pairs
+// outside the Basic Multilingual Plane.
+func asciiJson(encoded string) string {
+	var builder strings.Builder
+	for _, r := range encoded {
+		switch {
+		case r < 0x80:
+			builder.WriteRune(r)
+		case r > 0xffff:
+			high, low := utf16.EncodeRune(r)
+			fmt.Fprintf(&builder, "\\u%04x\\u%04x", high, low)
+		default:
+			fmt.Fprintf(&builder, "\\u%04x", r)
+		}
+	}
+	return builder.String()
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContextHeaderValue(t *testing.T) {
+	request := newAuthorizationRequest(map[string]string{"user-agent": "Tidepool \"Uploader\" ✓ 🩸"})
+	request.CheckRequest.Attributes.Request.Http.Method = "POST"
+	request.CheckRequest.Attributes.Request.Http.Path = "/v1/users?limit=10"
+	attributes := map[string]string{"user_agent": "header:user-agent", "path": "path", "method": "method", "tenant": "header:x-tenant"}
+
+	value := contextHeaderValue(request, attributes)
+	expected := "{\"method\":\"POST\",\"path\":\"/v1/users\",\"user_agent\":\"Tidepool \\\"Uploader\\\" \\u2713 \\ud83e\\ude78\"}"
+	if value != expected {
+		t.Errorf("expected %s, got %s", expected, value)
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(value), &decoded); err != nil || decoded["user_agent"] != "Tidepool \"Uploader\" ✓ 🩸" {
+		t.Errorf("expected the value to decode to the attributes, got %v, %v", decoded, err)
+	}
+
+	if value := contextHeaderValue(newAuthorizationRequest(nil), map[string]string{"tenant": "header:x-tenant"}); value != "" {
+		t.Errorf("expected no value without any of the attributes, got %s", value)
+	}
+}
+
+func TestAuthorizeSendsContextHeader(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:           server.URL,
+		ContextHeader:     "X-Auth-Context",
+		ContextAttributes: map[string]string{"method": "method", "route": "context:route_name"},
+	})
+	request := newAuthorizationRequest(nil)
+	request.CheckRequest.Attributes.Request.Http.Method = "GET"
+	request.CheckRequest.Attributes.ContextExtensions = map[string]string{"route_name": "users"}
+	if _, err := service.Authorize(context.Background(), request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value := received.Get("X-Auth-Context"); value != "{\"method\":\"GET\",\"route\":\"users\"}" {
+		t.Errorf("unexpected context header %q", value)
+	}
+}
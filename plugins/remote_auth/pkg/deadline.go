@@ -0,0 +1,104 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Bounds a call detached from any request when no RequestTimeout is configured, so a hung backend
+// doesn't hold the call after every caller has stopped waiting on it.
+const DefaultDetachedCallTimeout = 10 * time.Second
+
+var (
+	ClientCancelledError = errors.New("request cancelled by client")
+)
+
+// requestContext derives the context bounding all I/O of a single Authorize call, applying the
+// configured RequestTimeout and cancelled when the service is stopped.
+func (c *RemoteAuthService) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	var requestCtx context.Context
+	var cancel context.CancelFunc
+	if c.requestTimeout > 0 {
+		requestCtx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+	} else {
+		requestCtx, cancel = context.WithCancel(ctx)
+	}
+	go func() {
+		select {
+		case <-c.shutdown.stopped:
+			cancel()
+		case <-requestCtx.Done():
+		}
+	}()
+	return requestCtx, cancel
+}
+
+// detachedContext derives the context of a call made on behalf of requests without being bound to
+// any of them, like deduplicated and canary calls. It's bounded by RequestTimeout, or
+// DefaultDetachedCallTimeout when there's none, and the service lifetime only.
+func (c *RemoteAuthService) detachedContext() (context.Context, context.CancelFunc) {
+	if c.requestTimeout > 0 {
+		return c.requestContext(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.detachedCallTimeout)
+	detachedCtx, cancelRequest := c.requestContext(ctx)
+	return detachedCtx, func() {
+		cancelRequest()
+		cancel()
+	}
+}
+
+// setTimeoutHeader sets TimeoutHeader to the milliseconds left before the deadline of ctx, which
+// includes the RequestTimeout. Nothing is sent when the call is unbounded.
+func (c *RemoteAuthService) setTimeoutHeader(ctx context.Context, request *http.Request) {
+	if c.TimeoutHeader == "" {
+		return
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	remaining := time.Until(deadline).Milliseconds()
+	if remaining < 0 {
+		remaining = 0
+	}
+	request.Header.Set(c.TimeoutHeader, strconv.FormatInt(remaining, 10))
+}
+
+// clientCancelled reports whether the inbound context was cancelled or timed out, meaning Envoy is
+// no longer waiting for the decision, as opposed to the RequestTimeout expiring.
+func clientCancelled(ctx context.Context) bool {
+	return ctx.Err() != nil
+}
+
+func parseRequestTimeout(config *Config) (time.Duration, error) {
+	return parseDuration("RequestTimeout", config.RequestTimeout, 0)
+}
+
+// upstreamError is returned when the auth backend couldn't be reached or didn't respond in time,
+// as opposed to responding with a decision that couldn't be used.
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+func isUpstreamError(err error) bool {
+	var upstream *upstreamError
+	return errors.As(err, &upstream)
+}
+
+// failsOpen reports whether err should allow the request rather than fail it under FailureMode,
+// or because the service is within its WarmupDuration.
+func (c *RemoteAuthService) failsOpen(err error) bool {
+	return (c.FailureMode == FailureModeOpen || c.warmingUp()) && isUpstreamError(err)
+}
@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, RequestTimeout: "50ms"})
+	_, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err == nil || err == ClientCancelledError {
+		t.Errorf("expected an upstream timeout error, got %v", err)
+	}
+}
+
+func TestAuthorizeClientCancelled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, FallbackAuthUrl: server.URL})
+	if _, err := service.Authorize(ctx, newAuthorizationRequest(nil)); err != ClientCancelledError {
+		t.Errorf("expected ClientCancelledError, got %v", err)
+	}
+}
+
+func TestAuthorizeFailureMode(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	undecodable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "not json")
+	}))
+	defer undecodable.Close()
+
+	tests := []struct {
+		failureMode string
+		authUrl     string
+		allowed     bool
+	}{
+		{"", unreachable.URL, false},
+		{FailureModeClosed, unreachable.URL, false},
+		{FailureModeOpen, unreachable.URL, true},
+		{FailureModeOpen, undecodable.URL, false},
+	}
+	for _, test := range tests {
+		service := newAuthService(t, &Config{
+			AuthUrl:         test.authUrl,
+			ResponseHeaders: map[string]string{"userid": "x-auth-subject-id"},
+			FailureMode:     test.failureMode,
+		})
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		if allowed := err == nil && isAllowedResponse(response); allowed != test.allowed {
+			t.Errorf("%q, %v: expected allowed %v, got response %v and error %v", test.failureMode, test.authUrl, test.allowed, response, err)
+		}
+	}
+}
+
+func TestAuthorizeSendsTimeoutHeader(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("X-Request-Timeout-Ms"))
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, TimeoutHeader: "X-Request-Timeout-Ms", RequestTimeout: "2s"})
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := service.Authorize(ctx, newAuthorizationRequest(nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	unbounded := newAuthService(t, &Config{AuthUrl: server.URL, TimeoutHeader: "X-Request-Timeout-Ms"})
+	if _, err := unbounded.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bounds := []struct{ min, max int }{{1000, 2000}, {1, 500}}
+	for i, bound := range bounds {
+		remaining, err := strconv.Atoi(received[i])
+		if err != nil || remaining < bound.min || remaining > bound.max {
+			t.Errorf("expected a remaining time between %v and %v ms, got %q", bound.min, bound.max, received[i])
+		}
+	}
+	if received[2] != "" {
+		t.Errorf("expected no timeout header for an unbounded call, got %v", received[2])
+	}
+}
+
+func TestAuthorizeFailsOpenDuringWarmup(t *testing.T) {
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: unreachable.URL, WarmupDuration: "100ms"})
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err == nil {
+		t.Error("expected the warmup to only start with the service")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := service.Start(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil || !isAllowedResponse(response) {
+		t.Errorf("expected the request to be allowed during warmup, got response %v and error %v", response, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err == nil {
+		t.Error("expected FailureMode to apply after the warmup")
+	}
+}
@@ -0,0 +1,127 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	envoycorev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoyauthv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"sort"
+	"strings"
+	"time"
+)
+
+// deduplicated shares the decision of concurrent requests with the same fingerprint. The shared
+// call runs in a detachedContext rather than the context of the request that started it, so a
+// client cancelling its own request doesn't fail the others waiting on the same call. Each caller
+// still stops waiting when its own context is done. Deduplicated calls aren't recorded in the
+// request span.
+func (c *RemoteAuthService) deduplicated(ctx context.Context, log *zap.SugaredLogger, authzRequest *api.AuthorizationRequest) (*api.AuthorizationResponse, error) {
+	key, err := c.requestFingerprint(authzRequest)
+	if err != nil {
+		return nil, err
+	}
+	results := c.inFlightRequests.DoChan(key, func() (interface{}, error) {
+		sharedCtx, cancel := c.detachedContext()
+		defer cancel()
+		detachedCtx, sharedCtx, expiry := withDecisionExpiry(context.Background(), sharedCtx)
+		response, err := c.decideRequest(detachedCtx, sharedCtx, log, authzRequest, nil)
+		return sharedDecision{response, expiry.get(), expiry.hadServerError()}, err
+	})
+
+	select {
+	case result := <-results:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		decision := result.Val.(sharedDecision)
+		recordDecisionExpiry(ctx, decision.expires)
+		if decision.serverError {
+			recordServerError(ctx)
+		}
+		response := decision.response
+		if result.Shared {
+			log.Debugw("Shared upstream decision with concurrent identical requests")
+			c.metrics.record(OutcomeCoalesced)
+			response = copyResponse(response)
+		} else {
+			c.metrics.record(OutcomeNotCoalesced)
+		}
+		return response, nil
+	case <-ctx.Done():
+		log.Infow("Request cancelled by client while waiting for a shared upstream call")
+		return nil, ClientCancelledError
+	}
+}
+
+type sharedDecision struct {
+	response    *api.AuthorizationResponse
+	expires     time.Time
+	serverError bool
+}
+
+// requestFingerprint identifies the auth request that would be sent for authzRequest: the auth URL
+// with its query parameters and the forwarded headers, except the request id and trace context
+// headers, which differ for every request, and the PathResponseHeaders profile selected for it.
+func (c *RemoteAuthService) requestFingerprint(authzRequest *api.AuthorizationRequest) (string, error) {
+	return c.fingerprint(authzRequest, nil)
+}
+
+// fingerprint is requestFingerprint limited to the forwarded headers in keyHeaders, by lowercase
+// name, unless it's nil. Only the hash is kept, so tokens in the headers aren't held in memory.
+func (c *RemoteAuthService) fingerprint(authzRequest *api.AuthorizationRequest, keyHeaders map[string]bool) (string, error) {
+	authUrl, _, _ := c.authUrl(authzRequest)
+	authUrl, err := c.withQueryParameters(authUrl, authzRequest)
+	if err != nil {
+		return "", err
+	}
+	headers := c.allowedHeaders(authzRequest)
+	delete(headers, c.RequestIdHeader)
+	for header := range c.traceContextHeaders(authzRequest) {
+		delete(headers, header)
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		if keyHeaders == nil || keyHeaders[strings.ToLower(key)] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	hash.Write([]byte(authUrl + "\n"))
+	// The same auth response is turned into different headers for requests on paths with different
+	// profiles, when the auth URL doesn't already tell them apart.
+	if profile := c.profileFor(authzRequest); profile != nil {
+		hash.Write([]byte("profile:" + profile.pattern + "\n"))
+	}
+	for _, key := range keys {
+		hash.Write([]byte(key + ":" + headers[key] + "\n"))
+	}
+	// The body only makes a difference to the auth request when its digest is sent.
+	if c.bodyHasher != nil {
+		hash.Write([]byte(authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp().GetBody()))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyResponse copies a shared response deeply enough for callers to append headers to it.
+func copyResponse(response *api.AuthorizationResponse) *api.AuthorizationResponse {
+	copied := *response
+	if ok := response.CheckResponse.GetOkResponse(); ok != nil {
+		copied.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_OkResponse{
+			OkResponse: &envoyauthv2.OkHttpResponse{
+				Headers:         append([]*envoycorev2.HeaderValueOption(nil), ok.Headers...),
+				DynamicMetadata: ok.DynamicMetadata,
+			},
+		}
+	}
+	if denied := response.CheckResponse.GetDeniedResponse(); denied != nil {
+		copiedDenied := *denied
+		copiedDenied.Headers = append([]*envoycorev2.HeaderValueOption(nil), denied.Headers...)
+		copied.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_DeniedResponse{DeniedResponse: &copiedDenied}
+	}
+	return &copied
+}
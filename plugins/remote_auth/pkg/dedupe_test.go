@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeDeduplicatesConcurrentRequests(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintf(w, "{\"userid\": \"%s\"}", r.Header.Get("x-tidepool-session-token"))
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:                    server.URL,
+		ForwardRequestHeaders:      []string{"x-tidepool-session-token"},
+		RequestIdHeader:            "x-tidepool-trace-request",
+		ResponseHeaders:            map[string]string{"userid": "x-auth-subject-id"},
+		EnableRequestDeduplication: true,
+	})
+	tokens := []string{"a", "a", "a", "a", "b"}
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			request := newAuthorizationRequest(map[string]string{
+				"x-tidepool-session-token": token,
+				"x-tidepool-trace-request": fmt.Sprintf("request-%d", i),
+			})
+			response, err := service.Authorize(context.Background(), request)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != token {
+				t.Errorf("expected subject id %v, got %q", token, value)
+			}
+		}(i, token)
+	}
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("expected one upstream call per distinct request, got %v", calls)
+	}
+}
+
+func TestAuthorizeDeduplicationIgnoresClientCancellation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, EnableRequestDeduplication: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := service.Authorize(ctx, newAuthorizationRequest(nil))
+		cancelled <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-cancelled; err != ClientCancelledError {
+		t.Errorf("expected ClientCancelledError for the cancelled request, got %v", err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("expected the other request to complete, got %v", err)
+	}
+}
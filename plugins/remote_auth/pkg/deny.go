@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	envoycorev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoyauthv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"io/ioutil"
+	"net/http"
+)
+
+const DefaultDenyReasonAttribute = "reason"
+
+type denyReasonBody struct {
+	Reason string `json:"reason"`
+}
+
+func deniedResponse(statusCode envoytype.StatusCode) *api.AuthorizationResponse {
+	response := api.UnauthorizedResponse()
+	response.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_DeniedResponse{
+		DeniedResponse: &envoyauthv2.DeniedHttpResponse{
+			Status: &envoytype.HttpStatus{Code: statusCode},
+		},
+	}
+	return response
+}
+
+// deniedStatusCode returns the status of the denied response for an upstream status code, and
+// whether it was mapped by DenyStatusCodes rather than defaulted to 401.
+func (c *RemoteAuthService) deniedStatusCode(upstreamStatusCode int) (envoytype.StatusCode, bool) {
+	if statusCode, ok := c.DenyStatusCodes[upstreamStatusCode]; ok {
+		return envoytype.StatusCode(statusCode), true
+	}
+	return envoytype.StatusCode_Unauthorized, false
+}
+
+// withDenyReason sets a {"reason": "..."} JSON body on a denied response.
+func withDenyReason(response *api.AuthorizationResponse, statusCode envoytype.StatusCode, reason string) *api.AuthorizationResponse {
+	body, err := json.Marshal(denyReasonBody{Reason: reason})
+	if err != nil {
+		return response
+	}
+	response.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_DeniedResponse{
+		DeniedResponse: &envoyauthv2.DeniedHttpResponse{
+			Status: &envoytype.HttpStatus{Code: statusCode},
+			Headers: []*envoycorev2.HeaderValueOption{
+				{Header: &envoycorev2.HeaderValue{Key: "content-type", Value: "application/json"}},
+			},
+			Body: string(body),
+		},
+	}
+	return response
+}
+
+// upstreamDenial builds the denied response for a non-200 auth response, with its body, deny
+// reason and DenyResponseHeaders when configured. A body that can't be read within
+// MaxResponseBytes or decoded is ignored.
+func (c *RemoteAuthService) upstreamDenial(response *http.Response, statusCode envoytype.StatusCode, mapped bool) *api.AuthorizationResponse {
+	var body []byte
+	if c.EnableDenyReasons || c.ForwardDenyBody || readsBody(c.denyMappings) {
+		if reader, err := responseBody(response, c.maxResponseBytes); err == nil {
+			if body, err = ioutil.ReadAll(reader); err != nil {
+				body = nil
+			}
+		}
+	}
+	contentType := response.Header.Get("Content-Type")
+	var data map[string]interface{}
+	if len(body) > 0 {
+		data, _ = responseDecoderFor(c.ResponseFormat, contentType, nil)(bytes.NewReader(body))
+	}
+
+	var denial *api.AuthorizationResponse
+	switch {
+	case c.ForwardDenyBody && len(body) > 0:
+		denial = withDenyBody(api.UnauthenticatedResponse(), statusCode, contentType, body)
+	case c.EnableDenyReasons:
+		reason := denyReason(data, response.StatusCode, c.DenyReasonAttribute)
+		denial = withDenyReason(api.UnauthenticatedResponse(), statusCode, reason)
+	case mapped:
+		denial = deniedResponse(statusCode)
+	default:
+		denial = api.UnauthenticatedResponse()
+	}
+	if len(c.denyMappings) > 0 {
+		extracted := applyMappings(data, mappedResponseOf(response), c.denyMappings)
+		withDenyHeaders(denial, statusCode, append(extracted.headers, extracted.repeatedHeaders...))
+	}
+	return denial
+}
+
+// bodyDenial builds the denial of a 200 auth response that doesn't allow the request, with the deny
+// reason when EnableDenyReasons is set, and the headers extracted from the response with
+// ExtractHeadersOnDeny.
+func (c *RemoteAuthService) bodyDenial(reason string, extracted *extractedAttributes) *api.AuthorizationResponse {
+	denial := api.UnauthenticatedResponse()
+	if c.EnableDenyReasons {
+		denial = withDenyReason(denial, envoytype.StatusCode_Unauthorized, reason)
+	}
+	if c.ExtractHeadersOnDeny && extracted != nil {
+		withDenyHeaders(denial, envoytype.StatusCode_Unauthorized, append(extracted.headers, extracted.repeatedHeaders...))
+	}
+	return denial
+}
+
+// withDenyBody sets the body of the auth response, with its Content-Type, on a denied response.
+func withDenyBody(response *api.AuthorizationResponse, statusCode envoytype.StatusCode, contentType string, body []byte) *api.AuthorizationResponse {
+	denied := &envoyauthv2.DeniedHttpResponse{
+		Status: &envoytype.HttpStatus{Code: statusCode},
+		Body:   string(body),
+	}
+	if contentType != "" {
+		denied.Headers = []*envoycorev2.HeaderValueOption{
+			{Header: &envoycorev2.HeaderValue{Key: "content-type", Value: contentType}},
+		}
+	}
+	response.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_DeniedResponse{DeniedResponse: denied}
+	return response
+}
+
+// withDenyHeaders adds headers to a denied response, giving it a denied HTTP response with
+// statusCode when it has none.
+func withDenyHeaders(response *api.AuthorizationResponse, statusCode envoytype.StatusCode, headers []*envoycorev2.HeaderValueOption) {
+	if len(headers) == 0 {
+		return
+	}
+	denied := response.CheckResponse.GetDeniedResponse()
+	if denied == nil {
+		denied = &envoyauthv2.DeniedHttpResponse{Status: &envoytype.HttpStatus{Code: statusCode}}
+		response.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_DeniedResponse{DeniedResponse: denied}
+	}
+	denied.Headers = append(denied.Headers, headers...)
+}
+
+// denyReason reads the reason attribute from a failed auth response body, falling back to the
+// status text of the upstream status code when the body has no usable reason.
+func denyReason(data map[string]interface{}, statusCode int, reasonAttribute string) string {
+	if raw, ok := lookupPath(data, reasonAttribute); ok {
+		if reason := stringifyValue(raw); reason != nil && *reason != "" {
+			return *reason
+		}
+	}
+	if text := http.StatusText(statusCode); text != "" {
+		return text
+	}
+	return "Denied"
+}
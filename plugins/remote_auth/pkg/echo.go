@@ -0,0 +1,42 @@
+package pkg
+
+import (
+	"net/http"
+	"sort"
+)
+
+// setEchoNonces sets a random nonce on the EchoedHeaders request headers that aren't otherwise
+// sent, so each auth request carries values the auth backend must echo back.
+func (c *RemoteAuthService) setEchoNonces(request *http.Request) {
+	for _, requestHeader := range c.echoedRequestHeaders {
+		if request.Header.Get(requestHeader) == "" {
+			request.Header.Set(requestHeader, newUuid())
+		}
+	}
+}
+
+// mismatchedEchoes returns the EchoedHeaders request headers whose values the response to the
+// request didn't echo back exactly.
+func (c *RemoteAuthService) mismatchedEchoes(response *http.Response) []string {
+	var mismatched []string
+	for _, requestHeader := range c.echoedRequestHeaders {
+		sent := ""
+		if response.Request != nil {
+			sent = response.Request.Header.Get(requestHeader)
+		}
+		if echoed := response.Header.Get(c.EchoedHeaders[requestHeader]); sent == "" || echoed != sent {
+			mismatched = append(mismatched, requestHeader)
+		}
+	}
+	return mismatched
+}
+
+// sortedKeys returns the keys of headers in order, so they're checked and logged deterministically.
+func sortedKeys(headers map[string]string) []string {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,54 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeChecksEchoedHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		echo    func(w http.ResponseWriter, r *http.Request)
+		allowed bool
+	}{
+		{"echoed", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Auth-Nonce", r.Header.Get("X-Auth-Nonce"))
+			w.Header().Set("X-Echoed-Request-Id", r.Header.Get("X-Request-Id"))
+		}, true},
+		{"missing", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Auth-Nonce", r.Header.Get("X-Auth-Nonce"))
+		}, false},
+		{"replayed", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Auth-Nonce", "2f1d0c0e-previous-nonce")
+			w.Header().Set("X-Echoed-Request-Id", r.Header.Get("X-Request-Id"))
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var nonce string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nonce = r.Header.Get("X-Auth-Nonce")
+				test.echo(w, r)
+			}))
+			defer server.Close()
+
+			service := newAuthService(t, &Config{
+				AuthUrl:         server.URL,
+				RequestIdHeader: "x-request-id",
+				EchoedHeaders:   map[string]string{"x-auth-nonce": "x-auth-nonce", "x-request-id": "x-echoed-request-id"},
+			})
+			response, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{"x-request-id": "request-1"}))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if isAllowedResponse(response) != test.allowed {
+				t.Errorf("expected allowed to be %v", test.allowed)
+			}
+			if len(nonce) != 36 {
+				t.Errorf("expected a generated nonce, got %q", nonce)
+			}
+		})
+	}
+}
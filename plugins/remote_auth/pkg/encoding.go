@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const DefaultMaxResponseBytes = 1 << 20
+
+var (
+	UnsupportedContentEncodingError = func(encoding string) error {
+		return errors.New("unsupported content encoding " + encoding)
+	}
+	ResponseTooLargeError = func(maxBytes int) error {
+		return errors.New(fmt.Sprintf("auth response body exceeds %d bytes", maxBytes))
+	}
+)
+
+// responseBody returns a reader of the decoded auth response body, failing once more than maxBytes
+// have been decoded. The transport only decompresses responses transparently when it asked for
+// compression itself, which isn't the case when the client's Accept-Encoding header is forwarded.
+func responseBody(response *http.Response, maxBytes int) (io.Reader, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return &limitedReader{r: response.Body, max: maxBytes, remaining: int64(maxBytes)}, nil
+	case "gzip", "x-gzip":
+		gzipReader, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return nil, err
+		}
+		return &limitedReader{r: gzipReader, max: maxBytes, remaining: int64(maxBytes)}, nil
+	default:
+		return nil, UnsupportedContentEncodingError(encoding)
+	}
+}
+
+// limitedReader is an io.LimitReader that reports exceeding the limit as an error rather than
+// a truncated body.
+type limitedReader struct {
+	r         io.Reader
+	max       int
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		n, l.remaining = int(l.remaining), 0
+		return n, ResponseTooLargeError(l.max)
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
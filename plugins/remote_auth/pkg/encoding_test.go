@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeDecodesGzipBody(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte("{\"userid\": \"123456\"}"))
+	writer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"accept-encoding"},
+		ResponseHeaders:       map[string]string{"userid": "x-auth-subject-id"},
+	})
+	request := newAuthorizationRequest(map[string]string{"accept-encoding": "gzip"})
+	response, err := service.Authorize(context.Background(), request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != "123456" {
+		t.Errorf("expected subject id from the gzipped body, got %q", value)
+	}
+}
+
+func TestResponseBodyRejectsUnsupportedEncoding(t *testing.T) {
+	response := &http.Response{
+		Header: http.Header{"Content-Encoding": []string{"br"}},
+		Body:   ioutil.NopCloser(strings.NewReader("{}")),
+	}
+	if _, err := responseBody(response, DefaultMaxResponseBytes); err == nil {
+		t.Error("expected an error for an unsupported content encoding")
+	}
+}
+
+func TestAuthorizeRejectsOversizedBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "{\"userid\": \"123456\", \"padding\": \"%s\"}", strings.Repeat("x", 100))
+	}))
+	defer server.Close()
+
+	config := &Config{
+		AuthUrl:          server.URL,
+		ResponseHeaders:  map[string]string{"userid": "x-auth-subject-id"},
+		MaxResponseBytes: 64,
+	}
+	if _, err := newAuthService(t, config).Authorize(context.Background(), newAuthorizationRequest(nil)); err == nil {
+		t.Error("expected an error for a body over MaxResponseBytes")
+	}
+
+	config.MaxResponseBytes = 0
+	response, err := newAuthService(t, config).Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != "123456" {
+		t.Errorf("expected subject id within the default limit, got %q", value)
+	}
+}
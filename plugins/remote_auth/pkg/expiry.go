@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type decisionExpiryKey struct{}
+
+// decisionExpiry collects the expiry that the auth backends reported for a decision, read from
+// the ExpiryAttribute of their responses. Decisions combined from several backends expire with
+// the earliest of them. It also records whether a backend answered with a server error, so the
+// resulting denial isn't cached by NegativeCacheTTL.
+type decisionExpiry struct {
+	mu          sync.Mutex
+	expires     time.Time
+	serverError bool
+}
+
+// withDecisionExpiry returns the contexts carrying a new decisionExpiry for the backends to report
+// to. Both contexts are given the same one since the decision path records it on either.
+func withDecisionExpiry(ctx context.Context, requestCtx context.Context) (context.Context, context.Context, *decisionExpiry) {
+	expiry := &decisionExpiry{}
+	return context.WithValue(ctx, decisionExpiryKey{}, expiry), context.WithValue(requestCtx, decisionExpiryKey{}, expiry), expiry
+}
+
+// recordDecisionExpiry is a no-op when ctx doesn't carry a decisionExpiry or expires is zero.
+func recordDecisionExpiry(ctx context.Context, expires time.Time) {
+	expiry, ok := ctx.Value(decisionExpiryKey{}).(*decisionExpiry)
+	if !ok || expires.IsZero() {
+		return
+	}
+	expiry.mu.Lock()
+	defer expiry.mu.Unlock()
+	if expiry.expires.IsZero() || expires.Before(expiry.expires) {
+		expiry.expires = expires
+	}
+}
+
+// recordServerError is a no-op when ctx doesn't carry a decisionExpiry.
+func recordServerError(ctx context.Context) {
+	expiry, ok := ctx.Value(decisionExpiryKey{}).(*decisionExpiry)
+	if !ok {
+		return
+	}
+	expiry.mu.Lock()
+	defer expiry.mu.Unlock()
+	expiry.serverError = true
+}
+
+func (e *decisionExpiry) hadServerError() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.serverError
+}
+
+func (e *decisionExpiry) get() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.expires
+}
+
+// ttl returns how long the decision may be cached: until grace before the reported expiry, or
+// defaultTtl when no backend reported one. It's zero or negative when the decision has already
+// expired.
+func (e *decisionExpiry) ttl(defaultTtl time.Duration, grace time.Duration) time.Duration {
+	expires := e.get()
+	if expires.IsZero() {
+		return defaultTtl
+	}
+	return time.Until(expires) - grace
+}
+
+// parseExpiry reads the attribute at path as a Unix timestamp in seconds, either a number or a
+// numeric string, returning the zero time when it's missing or invalid.
+func parseExpiry(data map[string]interface{}, path string) time.Time {
+	raw, ok := lookupPath(data, path)
+	if !ok {
+		return time.Time{}
+	}
+	var seconds float64
+	switch v := raw.(type) {
+	case float64:
+		seconds = v
+	case string:
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		seconds = parsed
+	default:
+		return time.Time{}
+	}
+	if seconds <= 0 || seconds >= math.MaxInt64/float64(time.Second) {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	data := map[string]interface{}{
+		"exp":     float64(1700000000),
+		"string":  "1700000000.5",
+		"invalid": "tomorrow",
+		"bool":    true,
+		"zero":    float64(0),
+	}
+	tests := map[string]time.Time{
+		"exp":     time.Unix(1700000000, 0),
+		"string":  time.Unix(1700000000, int64(500*time.Millisecond)),
+		"invalid": {},
+		"bool":    {},
+		"zero":    {},
+		"missing": {},
+	}
+	for path, expected := range tests {
+		if expires := parseExpiry(data, path); !expires.Equal(expected) {
+			t.Errorf("expected %v to expire at %v, got %v", path, expected, expires)
+		}
+	}
+}
+
+func TestRecordDecisionExpiryKeepsEarliest(t *testing.T) {
+	ctx, requestCtx, expiry := withDecisionExpiry(context.Background(), context.Background())
+	if ttl := expiry.ttl(time.Minute, time.Second); ttl != time.Minute {
+		t.Errorf("expected the default ttl without a recorded expiry, got %v", ttl)
+	}
+
+	earliest := time.Now().Add(time.Second)
+	recordDecisionExpiry(ctx, earliest.Add(time.Second))
+	recordDecisionExpiry(requestCtx, earliest)
+	recordDecisionExpiry(ctx, time.Time{})
+	if expires := expiry.get(); !expires.Equal(earliest) {
+		t.Errorf("expected the earliest expiry %v, got %v", earliest, expires)
+	}
+	if ttl := expiry.ttl(time.Minute, 2*time.Second); ttl > -time.Second {
+		t.Errorf("expected the grace to be taken off the ttl, got %v", ttl)
+	}
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"sort"
+	"strings"
+)
+
+// fingerprintHeaderValue returns the hex encoded SHA-256 of what identifies the request for
+// FingerprintHeader: the forwarded headers, listed in FingerprintHeaders or all of them, by name and
+// value, followed by the FingerprintAttributes in config order. The request id and trace context
+// headers differ for every request and are never included. Identical requests get the same value,
+// across plugin instances and restarts.
+func (c *RemoteAuthService) fingerprintHeaderValue(authzRequest *api.AuthorizationRequest) string {
+	headers := c.allowedHeaders(authzRequest)
+	delete(headers, c.RequestIdHeader)
+	for header := range c.traceContextHeaders(authzRequest) {
+		delete(headers, header)
+	}
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		if c.fingerprintHeaders == nil || c.fingerprintHeaders[strings.ToLower(key)] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		hash.Write([]byte("header:" + strings.ToLower(key) + "=" + headers[key] + "\n"))
+	}
+	for _, source := range c.FingerprintAttributes {
+		hash.Write([]byte(source + "=" + requestAttribute(authzRequest, source) + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"context"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFingerprintHeaderValueIsStable(t *testing.T) {
+	config := &Config{
+		AuthUrl:               "http://shoreline:9107/token",
+		ForwardRequestHeaders: []string{"authorization", "user-agent"},
+		RequestIdHeader:       "x-request-id",
+		FingerprintHeader:     "X-Request-Fingerprint",
+		FingerprintAttributes: []string{"method", "path"},
+	}
+	newRequest := func(headers map[string]string, path string) *api.AuthorizationRequest {
+		request := newAuthorizationRequest(headers)
+		request.CheckRequest.Attributes.Request.Http.Method = "GET"
+		request.CheckRequest.Attributes.Request.Http.Path = path
+		return request
+	}
+	first := newAuthService(t, config).fingerprintHeaderValue(newRequest(map[string]string{
+		"authorization": "Bearer abc", "user-agent": "curl", "x-request-id": "1",
+		"traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+	}, "/v1/users"))
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		path     string
+		expected bool
+	}{
+		{"another service and request id", map[string]string{"authorization": "Bearer abc", "user-agent": "curl", "x-request-id": "2"}, "/v1/users", true},
+		{"another header value", map[string]string{"authorization": "Bearer def", "user-agent": "curl"}, "/v1/users", false},
+		{"another attribute", map[string]string{"authorization": "Bearer abc", "user-agent": "curl"}, "/v1/data", false},
+	}
+	for _, test := range tests {
+		value := newAuthService(t, config).fingerprintHeaderValue(newRequest(test.headers, test.path))
+		if (value == first) != test.expected {
+			t.Errorf("%v: expected the same fingerprint %v, got %v and %v", test.name, test.expected, first, value)
+		}
+	}
+
+	limited := *config
+	limited.FingerprintHeaders = []string{"Authorization"}
+	service := newAuthService(t, &limited)
+	if service.fingerprintHeaderValue(newRequest(map[string]string{"authorization": "Bearer abc", "user-agent": "curl"}, "/v1/users")) !=
+		service.fingerprintHeaderValue(newRequest(map[string]string{"authorization": "Bearer abc", "user-agent": "browser"}, "/v1/users")) {
+		t.Error("expected headers left out of FingerprintHeaders not to change the fingerprint")
+	}
+}
+
+func TestAuthorizeSendsFingerprintHeader(t *testing.T) {
+	var fingerprints []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fingerprints = append(fingerprints, r.Header.Get("X-Request-Fingerprint"))
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"authorization"},
+		FingerprintHeader:     "X-Request-Fingerprint",
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{"authorization": "Bearer abc"})); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(fingerprints) != 2 || len(fingerprints[0]) != 64 || fingerprints[0] != fingerprints[1] {
+		t.Errorf("expected the same SHA-256 fingerprint for identical requests, got %v", fingerprints)
+	}
+}
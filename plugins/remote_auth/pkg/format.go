@@ -0,0 +1,115 @@
+package pkg
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+const (
+	ResponseFormatJson = "json"
+	ResponseFormatForm = "form"
+
+	// Attribute of a JSON body that's an array rather than an object, holding the whole array.
+	RootArrayAttribute = "$"
+
+	DefaultAcceptHeader = "application/json"
+)
+
+var UnexpectedContentTypeError = func(contentType string) error {
+	return errors.New("unexpected auth response content type " + contentType)
+}
+
+var MissingResponseRootError = func(root string) error {
+	return errors.New("auth response has no object at ResponseRoot " + root)
+}
+
+// responseDecoder decodes an auth response body into the attributes that mappings read.
+type responseDecoder func(body io.Reader) (map[string]interface{}, error)
+
+// rootedResponse returns the object at root within the decoded auth response body, against which
+// the attributes are looked up, or the whole body when root is empty.
+func rootedResponse(data map[string]interface{}, root string) (map[string]interface{}, error) {
+	if root == "" {
+		return data, nil
+	}
+	raw, _ := lookupPath(data, root)
+	rooted, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, MissingResponseRootError(root)
+	}
+	return rooted, nil
+}
+
+func validateResponseFormat(format string) error {
+	switch format {
+	case "", ResponseFormatJson, ResponseFormatForm:
+		return nil
+	}
+	return errors.New("must be one of json, form")
+}
+
+// responseDecoderFor returns the decoder of the configured format or, when there's none, of the
+// response Content-Type. Bodies without a known Content-Type are decoded as JSON, streaming only
+// the topLevel keys when there are any.
+func responseDecoderFor(format string, contentType string, topLevel []string) responseDecoder {
+	if format == "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType == "application/x-www-form-urlencoded" {
+			format = ResponseFormatForm
+		}
+	}
+	if format == ResponseFormatForm {
+		return decodeFormBody
+	}
+	if len(topLevel) > 0 {
+		return func(body io.Reader) (map[string]interface{}, error) {
+			return decodeTopLevelAttributes(body, topLevel)
+		}
+	}
+	return decodeResponseBody
+}
+
+// checkContentType fails unless the Content-Type of a response is that of the configured format,
+// or when there's none, JSON or form-urlencoded. JSON includes "+json" suffixed media types.
+func checkContentType(format string, contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return UnexpectedContentTypeError(contentType)
+	}
+	isJson := mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	isForm := mediaType == "application/x-www-form-urlencoded"
+	switch {
+	case format == ResponseFormatJson && isJson, format == ResponseFormatForm && isForm, format == "" && (isJson || isForm):
+		return nil
+	}
+	return UnexpectedContentTypeError(contentType)
+}
+
+// decodeFormBody decodes a form-urlencoded body. Parameters with a single value are strings and
+// repeated parameters are arrays, so they're mapped like the equivalent JSON.
+func decodeFormBody(body io.Reader) (map[string]interface{}, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(string(b))
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]interface{}{}
+	for key, vs := range values {
+		if len(vs) == 1 {
+			data[key] = vs[0]
+			continue
+		}
+		elements := make([]interface{}, len(vs))
+		for i, v := range vs {
+			elements[i] = v
+		}
+		data[key] = elements
+	}
+	return data, nil
+}
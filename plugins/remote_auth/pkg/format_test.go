@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeFormBody(t *testing.T) {
+	data, err := decodeFormBody(strings.NewReader("userid=1234&roles=admin&roles=user&name=Jane+Doe"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	extracted := applyMappings(data, nil, mappingsFromResponseHeaders(map[string]string{
+		"userid": "x-auth-subject-id",
+		"roles":  "x-auth-roles",
+		"name":   "x-auth-name",
+	}))
+	expectations := map[string]string{"x-auth-subject-id": "1234", "x-auth-roles": "admin,user", "x-auth-name": "Jane Doe"}
+	if len(extracted.headers) != len(expectations) {
+		t.Fatalf("expected %v headers, got %v", len(expectations), len(extracted.headers))
+	}
+	for _, header := range extracted.headers {
+		if expected := expectations[header.Header.Key]; header.Header.Value != expected {
+			t.Errorf("expected header %v to be %v, got %v", header.Header.Key, expected, header.Header.Value)
+		}
+	}
+
+	if _, err := decodeFormBody(strings.NewReader("userid=%zz")); err == nil {
+		t.Error("expected an error for a malformed form body")
+	}
+}
+
+func TestAuthorizeDecodesResponseByFormat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType := r.Header.Get("x-content-type"); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		fmt.Fprint(w, r.Header.Get("x-body"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		format      string
+		contentType string
+		body        string
+	}{
+		{"", "", "{\"userid\": \"1234\"}"},
+		{"", "application/json", "{\"userid\": \"1234\"}"},
+		{"", "application/x-www-form-urlencoded; charset=utf-8", "userid=1234"},
+		{ResponseFormatForm, "text/plain", "userid=1234"},
+		{ResponseFormatJson, "application/x-www-form-urlencoded", "{\"userid\": \"1234\"}"},
+	}
+	for _, test := range tests {
+		service := newAuthService(t, &Config{
+			AuthUrl:               server.URL,
+			ForwardRequestHeaders: []string{"x-body", "x-content-type"},
+			ResponseHeaders:       map[string]string{"userid": "x-auth-subject-id"},
+			ResponseFormat:        test.format,
+		})
+		request := newAuthorizationRequest(map[string]string{"x-body": test.body, "x-content-type": test.contentType})
+		response, err := service.Authorize(context.Background(), request)
+		if err != nil {
+			t.Errorf("%q, %q: unexpected error: %v", test.format, test.contentType, err)
+			continue
+		}
+		if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != "1234" {
+			t.Errorf("%q, %q: expected subject id 1234, got %q", test.format, test.contentType, value)
+		}
+	}
+}
+
+func TestCheckContentType(t *testing.T) {
+	tests := []struct {
+		format      string
+		contentType string
+		valid       bool
+	}{
+		{"", "application/json; charset=utf-8", true},
+		{"", "application/problem+json", true},
+		{"", "application/x-www-form-urlencoded", true},
+		{"", "text/html", false},
+		{"", "", false},
+		{ResponseFormatJson, "application/x-www-form-urlencoded", false},
+		{ResponseFormatForm, "application/x-www-form-urlencoded", true},
+	}
+	for _, test := range tests {
+		if err := checkContentType(test.format, test.contentType); (err == nil) != test.valid {
+			t.Errorf("expected %q to be valid for format %q: %v, got %v", test.contentType, test.format, test.valid, err)
+		}
+	}
+}
+
+func TestAuthorizeWithStrictContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html>{\"userid\": \"1234\"}</html>")
+	}))
+	defer server.Close()
+
+	config := &Config{AuthUrl: server.URL, ResponseHeaders: map[string]string{"userid": "x-auth-subject-id"}, StrictContentType: true}
+	if _, err := newAuthService(t, config).Authorize(context.Background(), newAuthorizationRequest(nil)); err == nil || !strings.Contains(err.Error(), "text/html") {
+		t.Errorf("expected an unexpected content type error, got %v", err)
+	}
+
+	config.OnDecodeFailure = DecodeFailureAllow
+	response, err := newAuthService(t, config).Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isAllowedResponse(response) || len(response.CheckResponse.GetOkResponse().GetHeaders()) != 0 {
+		t.Errorf("expected the request to be allowed without response headers, got %v", response)
+	}
+}
+
+func TestAuthorizeReadsAttributesUnderResponseRoot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("x-body"))
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"x-body"},
+		AllowAttribute:        "allow",
+		ResponseHeaders:       map[string]string{"claims.userid": "x-auth-subject-id"},
+		ResponseRoot:          "data",
+	})
+	body := "{\"data\": {\"allow\": true, \"claims\": {\"userid\": \"1234\"}}}"
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{"x-body": body}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _ := responseHeaderValue(response, "x-auth-subject-id"); !isAllowedResponse(response) || value != "1234" {
+		t.Errorf("expected the request to be allowed with subject id 1234, got %v", response)
+	}
+
+	for _, body := range []string{"{\"allow\": true}", "{\"data\": \"1234\"}"} {
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{"x-body": body}))
+		if err == nil && isAllowedResponse(response) {
+			t.Errorf("%v: expected the request not to be allowed without the response root", body)
+		}
+	}
+}
+
+func TestAuthorizeReadsRootArrayBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("x-body"))
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"x-body"},
+		ResponseHeaders:       map[string]string{RootArrayAttribute: "x-auth-scopes", "userid": "x-auth-subject-id"},
+	})
+	tests := []struct {
+		body      string
+		scopes    string
+		subjectId string
+	}{
+		{"[\"read\", \"write\"]", "read,write", ""},
+		{"{\"userid\": \"1234\"}", "", "1234"},
+	}
+	for _, test := range tests {
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{"x-body": test.body}))
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.body, err)
+		}
+		if scopes, _ := responseHeaderValue(response, "x-auth-scopes"); scopes != test.scopes {
+			t.Errorf("%v: expected scopes %q, got %q", test.body, test.scopes, scopes)
+		}
+		if subjectId, _ := responseHeaderValue(response, "x-auth-subject-id"); subjectId != test.subjectId {
+			t.Errorf("%v: expected subject id %q, got %q", test.body, test.subjectId, subjectId)
+		}
+	}
+
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{"x-body": "\"read\""})); err == nil {
+		t.Error("expected a scalar body to fail decoding")
+	}
+}
@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Suffix of ForwardRequestHeaders entries forwarding every header with the preceding prefix.
+const ForwardHeaderWildcard = "*"
+
+// Generous enough for large tokens and cookies, while bounding what a client can make us send.
+const DefaultMaxForwardedHeaderBytes = 16 << 10
+
+// Envoy's own default limit on the number of request headers.
+const DefaultMaxForwardedHeaders = 100
+
+// forwardsRequestContext reports whether anything of the incoming request, or configured to
+// identify it, is sent to the auth backend besides the request id and trace context.
+func forwardsRequestContext(config *Config) bool {
+	return len(config.ForwardRequestHeaders) > 0 || len(config.ForwardConditions) > 0 || len(config.ForwardCookies) > 0 ||
+		len(config.RequestAttributeHeaders) > 0 || config.ContextHeader != "" || config.ClientAddressHeader != "" ||
+		config.AuthorityHeader != "" || config.VirtualHostHeader != "" || len(config.RequestJwtClaimHeaders) > 0 ||
+		len(config.QueryParameters) > 0 || len(config.StaticQueryParams) > 0
+}
+
+// ForwardCondition restricts forwarding a request header to AuthUrl to requests that carry
+// IfHeader, or, when IfValue is set, where IfHeader has exactly that value.
+type ForwardCondition struct {
+	Header   string
+	IfHeader string
+	IfValue  string
+}
+
+// HeaderRewrite reshapes a forwarded request header before it's sent to AuthUrl. StripPrefix is
+// removed first, ignoring case, e.g. "Bearer " to send the bare token. Then every match of Pattern
+// is replaced with Replacement, which may refer to submatches as in regexp.Expand, e.g. "$1".
+// Values the rewrite doesn't match are forwarded unchanged.
+type HeaderRewrite struct {
+	StripPrefix string
+	Pattern     string
+	Replacement string
+}
+
+type headerRewriter struct {
+	stripPrefix string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func validateHeaderRewrite(header string, rewrite HeaderRewrite) error {
+	if !isValidHeaderName(header) {
+		return errors.New("invalid header name " + header)
+	}
+	if rewrite.StripPrefix == "" && rewrite.Pattern == "" {
+		return errors.New("either StripPrefix or Pattern is required")
+	}
+	if rewrite.Pattern == "" && rewrite.Replacement != "" {
+		return errors.New("Replacement requires a Pattern")
+	}
+	if _, err := regexp.Compile(rewrite.Pattern); err != nil {
+		return err
+	}
+	return nil
+}
+
+// newHeaderRewriters compiles the rewrites, keyed by lowercased header name. The patterns were
+// checked by validateConfig.
+func newHeaderRewriters(rewrites map[string]HeaderRewrite) map[string]*headerRewriter {
+	if len(rewrites) == 0 {
+		return nil
+	}
+	rewriters := map[string]*headerRewriter{}
+	for header, rewrite := range rewrites {
+		rewriter := &headerRewriter{stripPrefix: rewrite.StripPrefix, replacement: rewrite.Replacement}
+		if rewrite.Pattern != "" {
+			rewriter.pattern = regexp.MustCompile(rewrite.Pattern)
+		}
+		rewriters[strings.ToLower(header)] = rewriter
+	}
+	return rewriters
+}
+
+func (r *headerRewriter) rewrite(value string) string {
+	if r.stripPrefix != "" && len(value) >= len(r.stripPrefix) && strings.EqualFold(value[:len(r.stripPrefix)], r.stripPrefix) {
+		value = value[len(r.stripPrefix):]
+	}
+	if r.pattern != nil {
+		value = r.pattern.ReplaceAllString(value, r.replacement)
+	}
+	return value
+}
+
+func validateForwardCondition(condition ForwardCondition) error {
+	if !isValidHeaderName(condition.Header) {
+		return errors.New("invalid header name " + condition.Header)
+	}
+	if !isValidHeaderName(condition.IfHeader) {
+		return errors.New("invalid condition header name " + condition.IfHeader)
+	}
+	return nil
+}
+
+// forwardConditionsByHeader groups conditions by the header they gate. A header with several
+// conditions is forwarded when any of them matches.
+func forwardConditionsByHeader(conditions []ForwardCondition) map[string][]ForwardCondition {
+	byHeader := map[string][]ForwardCondition{}
+	for _, condition := range conditions {
+		byHeader[condition.Header] = append(byHeader[condition.Header], condition)
+	}
+	return byHeader
+}
+
+// shouldForward reports whether header may be forwarded given the incoming request headers.
+// Headers without conditions are always forwarded.
+func (c *RemoteAuthService) shouldForward(header string, headers map[string]string) bool {
+	conditions, ok := c.forwardConditions[header]
+	if !ok {
+		return true
+	}
+	for _, condition := range conditions {
+		value, present := headers[condition.IfHeader]
+		if present && (condition.IfValue == "" || value == condition.IfValue) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasForwardedPrefix reports whether header matches a prefix entry of ForwardRequestHeaders,
+// ignoring case. Pseudo-headers never match, as they need a name in ForwardPseudoHeaders.
+func (c *RemoteAuthService) hasForwardedPrefix(header string) bool {
+	if strings.HasPrefix(header, ":") {
+		return false
+	}
+	header = strings.ToLower(header)
+	for _, prefix := range c.forwardHeaderPrefixes {
+		if strings.HasPrefix(header, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterCookies returns the Cookie header with only the named cookies, in their original order,
+// or "" when none of them is present.
+func filterCookies(cookieHeader string, names map[string]bool) string {
+	if cookieHeader == "" {
+		return ""
+	}
+	request := http.Request{Header: http.Header{"Cookie": {cookieHeader}}}
+	var kept []string
+	for _, cookie := range request.Cookies() {
+		if names[cookie.Name] {
+			kept = append(kept, cookie.String())
+		}
+	}
+	return strings.Join(kept, "; ")
+}
@@ -0,0 +1,242 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAllowedHeadersWithForwardConditions(t *testing.T) {
+	service := newAuthService(t, &Config{
+		AuthUrl:               "http://shoreline:9107/token",
+		ForwardRequestHeaders: []string{"x-tidepool-session-token"},
+		ForwardConditions: []ForwardCondition{
+			{Header: "authorization", IfHeader: "x-route-auth"},
+			{Header: "x-tidepool-session-token", IfHeader: "x-route", IfValue: "data"},
+			{Header: "x-tidepool-session-token", IfHeader: "x-route", IfValue: "profile"},
+		},
+	})
+	tests := []struct {
+		headers  map[string]string
+		expected []string
+	}{
+		{map[string]string{"authorization": "Bearer a", "x-tidepool-session-token": "b"}, nil},
+		{map[string]string{"authorization": "Bearer a", "x-route-auth": ""}, []string{"authorization"}},
+		{map[string]string{"x-tidepool-session-token": "b", "x-route": "profile"}, []string{"x-tidepool-session-token"}},
+		{map[string]string{"x-tidepool-session-token": "b", "x-route": "admin"}, nil},
+	}
+	for _, test := range tests {
+		allowed := service.allowedHeaders(newAuthorizationRequest(test.headers))
+		if len(allowed) != len(test.expected) {
+			t.Errorf("expected %v to be forwarded for %v, got %v", test.expected, test.headers, allowed)
+			continue
+		}
+		for _, header := range test.expected {
+			if _, ok := allowed[header]; !ok {
+				t.Errorf("expected %v to be forwarded for %v, got %v", header, test.headers, allowed)
+			}
+		}
+	}
+}
+
+func TestAllowedHeadersWithPrefixes(t *testing.T) {
+	service := newAuthService(t, &Config{
+		AuthUrl:               "http://shoreline:9107/token",
+		ForwardRequestHeaders: []string{"X-Tidepool-*", "authorization", ":authority"},
+		ForwardPseudoHeaders:  map[string]string{":authority": "x-original-host"},
+		ForwardConditions:     []ForwardCondition{{Header: "x-tidepool-restricted", IfHeader: "x-route-auth"}},
+	})
+	allowed := service.allowedHeaders(newAuthorizationRequest(map[string]string{
+		"x-tidepool-session-token": "a",
+		"x-tidepool-trace-session": "b",
+		"x-tidepool-restricted":    "c",
+		"x-other":                  "d",
+		"authorization":            "Bearer e",
+		":authority":               "api.example.com",
+	}))
+	expected := map[string]string{
+		"x-tidepool-session-token": "a",
+		"x-tidepool-trace-session": "b",
+		"authorization":            "Bearer e",
+		"x-original-host":          "api.example.com",
+	}
+	if len(allowed) != len(expected) {
+		t.Errorf("expected %v to be forwarded, got %v", expected, allowed)
+	}
+	for header, value := range expected {
+		if allowed[header] != value {
+			t.Errorf("expected %v to be forwarded as %v, got %v", header, value, allowed[header])
+		}
+	}
+}
+
+func TestFilterCookies(t *testing.T) {
+	names := map[string]bool{"session": true, "csrf": true}
+	tests := map[string]string{
+		"":                                  "",
+		"theme=dark":                        "",
+		"theme=dark; session=abc; csrf=xyz": "session=abc; csrf=xyz",
+		"csrf=xyz;session=abc":              "csrf=xyz; session=abc",
+	}
+	for header, expected := range tests {
+		if filtered := filterCookies(header, names); filtered != expected {
+			t.Errorf("expected %q to be filtered to %q, got %q", header, expected, filtered)
+		}
+	}
+}
+
+func TestAuthorizeForwardsSelectedCookies(t *testing.T) {
+	var forwarded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get("Cookie"))
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"cookie"},
+		ForwardCookies:        []string{"session"},
+	})
+	for _, headers := range []map[string]string{{"cookie": "theme=dark; session=abc"}, {"cookie": "theme=dark"}, {}} {
+		if _, err := service.Authorize(context.Background(), newAuthorizationRequest(headers)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	for i, expected := range []string{"session=abc", "", ""} {
+		if forwarded[i] != expected {
+			t.Errorf("expected cookie header %q, got %q", expected, forwarded[i])
+		}
+	}
+}
+
+func TestAuthorizeDropsOversizedForwardedHeaders(t *testing.T) {
+	var forwarded http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:                 server.URL,
+		ForwardRequestHeaders:   []string{"authorization", "x-tidepool-session-token"},
+		MaxForwardedHeaderBytes: 8,
+	})
+	request := newAuthorizationRequest(map[string]string{
+		"authorization":            "Bearer " + strings.Repeat("a", 16),
+		"x-tidepool-session-token": "token",
+	})
+	if _, err := service.Authorize(context.Background(), request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value := forwarded.Get("Authorization"); value != "" {
+		t.Errorf("expected the oversized header to be dropped, got %v", value)
+	}
+	if value := forwarded.Get("X-Tidepool-Session-Token"); value != "token" {
+		t.Errorf("expected the header within the limit to be forwarded, got %v", value)
+	}
+}
+
+func TestAuthorizeCapsForwardedHeaders(t *testing.T) {
+	var forwarded http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"x-tidepool-*"},
+		MaxForwardedHeaders:   3,
+	})
+	request := newAuthorizationRequest(map[string]string{
+		"x-tidepool-e": "5",
+		"x-tidepool-d": "4",
+		"x-tidepool-c": "3",
+		"x-tidepool-b": "2",
+		"x-tidepool-a": "1",
+	})
+	if _, err := service.Authorize(context.Background(), request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for header, expected := range map[string]string{"X-Tidepool-A": "1", "X-Tidepool-B": "2", "X-Tidepool-C": "3", "X-Tidepool-D": "", "X-Tidepool-E": ""} {
+		if value := forwarded.Get(header); value != expected {
+			t.Errorf("expected header %v to be %q, got %q", header, expected, value)
+		}
+	}
+}
+
+func TestAuthorizeRewritesForwardedHeaders(t *testing.T) {
+	var forwarded http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"authorization", "x-client-version", "x-tidepool-session-token"},
+		ForwardHeaderRewrites: map[string]HeaderRewrite{
+			"Authorization":    {StripPrefix: "Bearer "},
+			"x-client-version": {Pattern: "^tidepool-uploader/([0-9.]+).*$", Replacement: "$1"},
+		},
+	})
+	tests := []struct {
+		headers  map[string]string
+		expected map[string]string
+	}{
+		{
+			map[string]string{"authorization": "bearer abc.def", "x-client-version": "tidepool-uploader/2.31.0 (darwin)", "x-tidepool-session-token": "Bearer token"},
+			map[string]string{"Authorization": "abc.def", "X-Client-Version": "2.31.0", "X-Tidepool-Session-Token": "Bearer token"},
+		},
+		{
+			map[string]string{"authorization": "Basic dXNlcg==", "x-client-version": "curl/7.64"},
+			map[string]string{"Authorization": "Basic dXNlcg==", "X-Client-Version": "curl/7.64"},
+		},
+	}
+	for _, test := range tests {
+		if _, err := service.Authorize(context.Background(), newAuthorizationRequest(test.headers)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		for header, expected := range test.expected {
+			if value := forwarded.Get(header); value != expected {
+				t.Errorf("expected %v to be forwarded as %q, got %q", header, expected, value)
+			}
+		}
+	}
+}
+
+func TestAuthorizeForwardsRenamedHeaders(t *testing.T) {
+	var forwarded http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"authorization", "x-tidepool-*"},
+		ForwardHeaderNames:    map[string]string{"Authorization": "X-Legacy-Token", "x-tidepool-session-token": "x-session"},
+		ForwardHeaderRewrites: map[string]HeaderRewrite{"x-legacy-token": {StripPrefix: "Bearer "}},
+	})
+	request := newAuthorizationRequest(map[string]string{
+		"authorization":            "Bearer abc.def",
+		"x-tidepool-session-token": "token",
+		"x-tidepool-trace":         "trace",
+	})
+	if _, err := service.Authorize(context.Background(), request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"X-Legacy-Token": "abc.def", "X-Session": "token", "X-Tidepool-Trace": "trace"}
+	for header, value := range expected {
+		if forwarded.Get(header) != value {
+			t.Errorf("expected %v to be forwarded as %q, got %q", header, value, forwarded.Get(header))
+		}
+	}
+	for _, header := range []string{"Authorization", "X-Tidepool-Session-Token"} {
+		if _, ok := forwarded[header]; ok {
+			t.Errorf("expected %v to be forwarded under its new name only", header)
+		}
+	}
+}
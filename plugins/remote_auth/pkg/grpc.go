@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	envoyauthv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"net/url"
+)
+
+// GrpcAuthService calls an envoy.service.auth.v2.Authorization backend instead of an HTTP endpoint.
+// It shares header forwarding and request id handling with the embedded RemoteAuthService; the
+// allowed headers are sent both as request metadata and as the headers of the forwarded
+// CheckRequest, and the backend's OK response headers are returned on the authorized response,
+// as is its denied HTTP response on denials.
+type GrpcAuthService struct {
+	*RemoteAuthService
+	conn   *grpc.ClientConn
+	client envoyauthv2.AuthorizationClient
+}
+
+func newGrpcAuthService(config *Config, service *RemoteAuthService) (*GrpcAuthService, error) {
+	u, err := url.Parse(config.AuthUrl)
+	if err != nil {
+		return nil, InvalidConfigError("AuthUrl", err)
+	}
+	tlsConfig, err := grpcTLSConfig(u, config)
+	if err != nil {
+		return nil, err
+	}
+	security := grpc.WithInsecure()
+	if tlsConfig != nil {
+		security = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	}
+	conn, err := grpc.Dial(u.Host, security)
+	if err != nil {
+		return nil, err
+	}
+	return &GrpcAuthService{
+		RemoteAuthService: service,
+		conn:              conn,
+		client:            envoyauthv2.NewAuthorizationClient(conn),
+	}, nil
+}
+
+// grpcTLSConfig returns the TLS config of a grpcs:// AuthUrl, like that of HTTPS backends, or nil
+// for a plaintext grpc:// one.
+func grpcTLSConfig(authUrl *url.URL, config *Config) (*tls.Config, error) {
+	if authUrl.Scheme != "grpcs" {
+		return nil, nil
+	}
+	return newTLSConfig(config)
+}
+
+// Start stops the service once ctx is done, like RemoteAuthService.Start, and starts the
+// WarmupDuration, health checks and admin server when configured.
+func (c *GrpcAuthService) Start(ctx context.Context) error {
+	c.startWarmup()
+	go c.stopWhenDone(ctx, c.Stop)
+	if c.health != nil {
+		go c.checkHealthPeriodically(c.requestLogger(ctx))
+	}
+	if c.admin != nil {
+		go c.serveAdmin(c.requestLogger(ctx))
+	}
+	return nil
+}
+
+// Stop drains in-flight calls and shuts the admin server down like RemoteAuthService.Stop, then
+// closes the connection to the backend.
+func (c *GrpcAuthService) Stop(ctx context.Context) error {
+	err := c.RemoteAuthService.Stop(ctx)
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (c *GrpcAuthService) Authorize(ctx context.Context, authzRequest *api.AuthorizationRequest) (*api.AuthorizationResponse, error) {
+	log := c.requestLogger(ctx)
+	c.ensureRequestId(authzRequest)
+	if requestId := c.extractRequestId(authzRequest); requestId != nil {
+		log = log.With("request_id", requestId)
+	}
+	response, err := c.authorize(ctx, log, authzRequest)
+	if c.ShadowMode {
+		return c.withRequestIdHeader(authzRequest, c.shadowResponse(log, response, err)), nil
+	}
+	if err == nil {
+		c.notifyDenied(log, authzRequest, response)
+	}
+	return c.withRequestIdHeader(authzRequest, c.withLoginRedirect(authzRequest, response)), err
+}
+
+func (c *GrpcAuthService) authorize(ctx context.Context, log *zap.SugaredLogger, authzRequest *api.AuthorizationRequest) (*api.AuthorizationResponse, error) {
+	done, err := c.shutdown.track()
+	if err != nil {
+		log.Warnw("Auth service is stopped, rejecting request")
+		return nil, err
+	}
+	defer done()
+
+	if c.bypassed(authzRequest) {
+		log.Infow("Request carries the bypass header, allowing it without calling the auth backend", zap.String("header", c.BypassHeader))
+		return api.AuthorizedResponse(), nil
+	}
+	if header := c.missingRequestHeader(authzRequest); header != "" {
+		log.Infow("Request lacks a required header, denying it without calling the auth backend", zap.String("header", header))
+		return withDenyReason(api.UnauthenticatedResponse(), envoytype.StatusCode_Unauthorized, c.missingHeaderReason), nil
+	}
+	if c.staleRequest(log, authzRequest) {
+		return c.staleRequestDenial(), nil
+	}
+	if c.invalidRequestJwt(log, authzRequest) {
+		return c.bodyDenial("Invalid token", nil), nil
+	}
+
+	requestCtx, cancel := c.requestContext(ctx)
+	defer cancel()
+
+	if !c.waitForRateLimit(requestCtx, log) {
+		if clientCancelled(ctx) {
+			return nil, ClientCancelledError
+		}
+		return deniedResponse(envoytype.StatusCode_TooManyRequests), nil
+	}
+
+	headers := c.allowedHeaders(authzRequest)
+	requestCtx = metadata.NewOutgoingContext(requestCtx, metadata.New(headers))
+	checkResponse, err := c.client.Check(requestCtx, forwardedCheckRequest(authzRequest.CheckRequest, headers))
+	if err != nil {
+		if clientCancelled(ctx) {
+			log.Infow("Request cancelled by client during upstream call")
+			return nil, ClientCancelledError
+		}
+		log.Errorw("Unexpected error from upstream", zap.Error(err))
+		if c.failsOpen(&upstreamError{err}) {
+			log.Warnw(c.failOpenReason())
+			return api.AuthorizedResponse(), nil
+		}
+		return nil, err
+	}
+
+	if checkResponse.GetStatus().GetCode() != int32(code.Code_OK) {
+		log.Infow("Unsuccessful response from upstream, denying access", zap.Int32("status_code", checkResponse.GetStatus().GetCode()))
+		if denied := checkResponse.GetDeniedResponse(); denied != nil {
+			response := api.UnauthenticatedResponse()
+			response.CheckResponse.Status = checkResponse.GetStatus()
+			response.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_DeniedResponse{DeniedResponse: denied}
+			return response, nil
+		}
+		return api.UnauthenticatedResponse(), nil
+	}
+
+	responseHeaders := checkResponse.GetOkResponse().GetHeaders()
+	c.successLog(log)(
+		"Successful response from upstream, allowing request",
+		zap.Array("response_headers", ResponseHeaders(responseHeaders)),
+	)
+
+	authzResponse := api.AuthorizedResponse()
+	authzResponse.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_OkResponse{
+		OkResponse: &envoyauthv2.OkHttpResponse{
+			Headers: responseHeaders,
+		},
+	}
+	return authzResponse, nil
+}
+
+// forwardedCheckRequest copies the incoming check request, keeping only the allowed headers.
+func forwardedCheckRequest(checkRequest *envoyauthv2.CheckRequest, headers map[string]string) *envoyauthv2.CheckRequest {
+	attributes := checkRequest.GetAttributes()
+	httpRequest := attributes.GetRequest().GetHttp()
+	return &envoyauthv2.CheckRequest{
+		Attributes: &envoyauthv2.AttributeContext{
+			Source:            attributes.GetSource(),
+			Destination:       attributes.GetDestination(),
+			ContextExtensions: attributes.GetContextExtensions(),
+			MetadataContext:   attributes.GetMetadataContext(),
+			Request: &envoyauthv2.AttributeContext_Request{
+				Time: attributes.GetRequest().GetTime(),
+				Http: &envoyauthv2.AttributeContext_HttpRequest{
+					Id:       httpRequest.GetId(),
+					Method:   httpRequest.GetMethod(),
+					Headers:  headers,
+					Path:     httpRequest.GetPath(),
+					Host:     httpRequest.GetHost(),
+					Scheme:   httpRequest.GetScheme(),
+					Query:    httpRequest.GetQuery(),
+					Fragment: httpRequest.GetFragment(),
+					Size:     httpRequest.GetSize(),
+					Protocol: httpRequest.GetProtocol(),
+				},
+			},
+		},
+	}
+}
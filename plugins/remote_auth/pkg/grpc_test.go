@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	envoycorev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoyauthv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type fakeAuthorizationClient struct {
+	request  *envoyauthv2.CheckRequest
+	metadata metadata.MD
+	response *envoyauthv2.CheckResponse
+}
+
+func (f *fakeAuthorizationClient) Check(ctx context.Context, in *envoyauthv2.CheckRequest, opts ...grpc.CallOption) (*envoyauthv2.CheckResponse, error) {
+	f.request = in
+	f.metadata, _ = metadata.FromOutgoingContext(ctx)
+	return f.response, nil
+}
+
+func newFakeGrpcAuthService(t *testing.T, response *envoyauthv2.CheckResponse) (*GrpcAuthService, *fakeAuthorizationClient) {
+	service, err := new(RemoteAuthPlugin).GetAuthService(context.Background(), &Config{
+		Protocol:              ProtocolGrpc,
+		AuthUrl:               "grpc://auth:9000",
+		ForwardRequestHeaders: []string{"x-tidepool-session-token"},
+	})
+	if err != nil {
+		t.Fatalf("unable to create auth service: %v", err)
+	}
+	grpcService := service.(*GrpcAuthService)
+	client := &fakeAuthorizationClient{response: response}
+	grpcService.client = client
+	return grpcService, client
+}
+
+func TestGrpcAuthorizeForwardsAllowedHeaders(t *testing.T) {
+	service, client := newFakeGrpcAuthService(t, &envoyauthv2.CheckResponse{
+		Status: &status.Status{Code: int32(code.Code_OK)},
+		HttpResponse: &envoyauthv2.CheckResponse_OkResponse{
+			OkResponse: &envoyauthv2.OkHttpResponse{
+				Headers: []*envoycorev2.HeaderValueOption{
+					{Header: &envoycorev2.HeaderValue{Key: "x-tidepool-subject-id", Value: "123456"}},
+				},
+			},
+		},
+	})
+
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{
+		"x-tidepool-session-token": "token",
+		"cookie":                   "secret",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	forwarded := client.request.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	if len(forwarded) != 1 || forwarded["x-tidepool-session-token"] != "token" {
+		t.Errorf("expected only the session token to be forwarded, got %v", forwarded)
+	}
+	if values := client.metadata["x-tidepool-session-token"]; len(values) != 1 || values[0] != "token" {
+		t.Errorf("expected the session token in metadata, got %v", client.metadata)
+	}
+	if value, _ := responseHeaderValue(response, "x-tidepool-subject-id"); value != "123456" {
+		t.Errorf("expected subject id header, got %q", value)
+	}
+}
+
+func TestGrpcAuthorizeDeniesNonOkStatus(t *testing.T) {
+	service, _ := newFakeGrpcAuthService(t, &envoyauthv2.CheckResponse{
+		Status: &status.Status{Code: int32(code.Code_PERMISSION_DENIED)},
+	})
+
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.CheckResponse.GetStatus().GetCode() != int32(code.Code_UNAUTHENTICATED) {
+		t.Errorf("expected an unauthenticated response, got %v", response.CheckResponse.GetStatus())
+	}
+}
+
+func TestGrpcHealthChecksRunFromStart(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	service, err := new(RemoteAuthPlugin).GetAuthService(context.Background(), &Config{
+		Protocol:            ProtocolGrpc,
+		AuthUrl:             "grpc://auth:9000",
+		HealthCheckUrl:      server.URL,
+		HealthCheckInterval: "10ms",
+	})
+	if err != nil {
+		t.Fatalf("unable to create auth service: %v", err)
+	}
+	if err := service.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error starting the service: %v", err)
+	}
+	defer service.(*GrpcAuthService).Stop(context.Background())
+	waitForHealth(t, service.(*GrpcAuthService).RemoteAuthService, false)
+}
+
+func TestGrpcAuthorizeReturnsDeniedResponse(t *testing.T) {
+	service, _ := newFakeGrpcAuthService(t, &envoyauthv2.CheckResponse{
+		Status: &status.Status{Code: int32(code.Code_PERMISSION_DENIED)},
+		HttpResponse: &envoyauthv2.CheckResponse_DeniedResponse{
+			DeniedResponse: &envoyauthv2.DeniedHttpResponse{
+				Status: &envoytype.HttpStatus{Code: envoytype.StatusCode_Forbidden},
+				Headers: []*envoycorev2.HeaderValueOption{
+					{Header: &envoycorev2.HeaderValue{Key: "content-type", Value: "application/json"}},
+				},
+				Body: "{\"reason\": \"no consent\"}",
+			},
+		},
+	})
+
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.CheckResponse.GetStatus().GetCode() != int32(code.Code_PERMISSION_DENIED) {
+		t.Errorf("expected the backend's status, got %v", response.CheckResponse.GetStatus())
+	}
+	denied := response.CheckResponse.GetDeniedResponse()
+	if denied.GetStatus().GetCode() != envoytype.StatusCode_Forbidden || denied.GetBody() != "{\"reason\": \"no consent\"}" {
+		t.Errorf("expected the backend's denied response, got %v", denied)
+	}
+	if headers := denied.GetHeaders(); len(headers) != 1 || headers[0].GetHeader().GetValue() != "application/json" {
+		t.Errorf("expected the backend's denied headers, got %v", headers)
+	}
+}
+
+func TestGrpcTLSConfig(t *testing.T) {
+	tests := []struct {
+		authUrl string
+		tls     bool
+	}{
+		{"grpc://auth:9000", false},
+		{"grpcs://auth:9000", true},
+	}
+	for _, test := range tests {
+		config := &Config{
+			Protocol:      ProtocolGrpc,
+			AuthUrl:       test.authUrl,
+			TLSServerName: "auth.tidepool.org",
+			MinTLSVersion: "1.3",
+		}
+		if _, err := new(RemoteAuthPlugin).GetAuthService(context.Background(), config); err != nil {
+			t.Fatalf("%v: unable to create auth service: %v", test.authUrl, err)
+		}
+		u, _ := url.Parse(test.authUrl)
+		tlsConfig, err := grpcTLSConfig(u, config)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", test.authUrl, err)
+		}
+		if (tlsConfig != nil) != test.tls {
+			t.Fatalf("%v: expected TLS %v, got %+v", test.authUrl, test.tls, tlsConfig)
+		}
+		if tlsConfig != nil && (tlsConfig.ServerName != "auth.tidepool.org" || tlsConfig.MinVersion != tls.VersionTLS13) {
+			t.Errorf("%v: unexpected TLS config %+v", test.authUrl, tlsConfig)
+		}
+	}
+}
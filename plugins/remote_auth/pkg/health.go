@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Bounds a health check when no RequestTimeout is configured.
+const DefaultHealthCheckTimeout = 5 * time.Second
+
+// HealthStatus is the last known health of the auth backend, according to the health checks.
+type HealthStatus struct {
+	Healthy bool
+	// When the last check completed, zero before the first one.
+	CheckedAt time.Time
+	// Why the last check failed, empty when healthy.
+	Error string
+}
+
+type healthChecker struct {
+	url      string
+	interval time.Duration
+	mu       sync.Mutex
+	status   HealthStatus
+}
+
+func newHealthChecker(url string, interval time.Duration) *healthChecker {
+	return &healthChecker{url: url, interval: interval}
+}
+
+func (h *healthChecker) get() HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.status
+}
+
+// set records the status, reporting whether the health changed since the previous check.
+func (h *healthChecker) set(status HealthStatus) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	changed := h.status.CheckedAt.IsZero() || h.status.Healthy != status.Healthy
+	h.status = status
+	return changed
+}
+
+// Health returns the last known health of the auth backend, and false when HealthCheckInterval
+// isn't configured.
+func (c *RemoteAuthService) Health() (HealthStatus, bool) {
+	if c.health == nil {
+		return HealthStatus{}, false
+	}
+	return c.health.get(), true
+}
+
+// checkHealthPeriodically checks the health of the auth backend right away and then every
+// HealthCheckInterval, until the service is stopped.
+func (c *RemoteAuthService) checkHealthPeriodically(log *zap.SugaredLogger) {
+	ticker := time.NewTicker(c.health.interval)
+	defer ticker.Stop()
+	for {
+		c.recordHealth(log, c.checkHealth())
+		select {
+		case <-ticker.C:
+		case <-c.shutdown.stopped:
+			return
+		}
+	}
+}
+
+func (c *RemoteAuthService) recordHealth(log *zap.SugaredLogger, err error) {
+	status := HealthStatus{Healthy: err == nil, CheckedAt: time.Now()}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if !c.health.set(status) {
+		return
+	}
+	if err != nil {
+		log.Warnw("Auth backend is unhealthy", zap.String("url", c.health.url), zap.Error(err))
+	} else {
+		log.Infow("Auth backend is healthy", zap.String("url", c.health.url))
+	}
+}
+
+// checkHealth calls the health check URL, which is healthy when it responds with a status below
+// 500. Any response to AuthUrl, even a denial for lack of credentials, shows the backend is up.
+func (c *RemoteAuthService) checkHealth() error {
+	ctx, cancel := c.requestContext(context.Background())
+	defer cancel()
+	if c.requestTimeout == 0 {
+		ctx, cancel = context.WithTimeout(ctx, DefaultHealthCheckTimeout)
+		defer cancel()
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "GET", c.health.url, io.Reader(nil))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", c.UserAgent)
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, int64(c.maxResponseBytes)))
+	if response.StatusCode >= http.StatusInternalServerError {
+		return errors.New("unexpected status code " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
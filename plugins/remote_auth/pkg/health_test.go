@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitForHealth(t *testing.T, service *RemoteAuthService, healthy bool) HealthStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, _ := service.Health(); !status.CheckedAt.IsZero() && status.Healthy == healthy {
+			return status
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("expected the auth backend to become healthy: %v", healthy)
+	return HealthStatus{}
+}
+
+func TestHealthChecksTrackBackendHealth(t *testing.T) {
+	var status int32 = http.StatusServiceUnavailable
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, HealthCheckInterval: "10ms"})
+	if err := service.Start(context.Background()); err != nil {
+		t.Fatalf("unexpected error starting the service: %v", err)
+	}
+	if unhealthy := waitForHealth(t, service, false); unhealthy.Error == "" {
+		t.Error("expected the reason the auth backend is unhealthy")
+	}
+	// Denials for lack of credentials still show the backend is up.
+	atomic.StoreInt32(&status, http.StatusUnauthorized)
+	if healthy := waitForHealth(t, service, true); healthy.Error != "" {
+		t.Errorf("expected no error once healthy, got %v", healthy.Error)
+	}
+
+	if err := service.Stop(context.Background()); err != nil {
+		t.Fatalf("unexpected error stopping the service: %v", err)
+	}
+	stopped := atomic.LoadInt32(&calls)
+	time.Sleep(50 * time.Millisecond)
+	if calls := atomic.LoadInt32(&calls); calls > stopped+1 {
+		t.Errorf("expected health checks to stop with the service, got %v more", calls-stopped)
+	}
+}
+
+func TestHealthChecksAreOffByDefault(t *testing.T) {
+	service := newAuthService(t, &Config{AuthUrl: "http://auth"})
+	if _, enabled := service.Health(); enabled {
+		t.Error("expected health checks to be disabled")
+	}
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var DisallowedAuthHostError = func(host string) error {
+	return errors.New("auth host " + host + " is not in AllowedAuthHosts")
+}
+
+func newAllowedAuthHosts(hosts []string) map[string]bool {
+	if len(hosts) == 0 {
+		return nil
+	}
+	allowed := map[string]bool{}
+	for _, host := range hosts {
+		allowed[strings.ToLower(host)] = true
+	}
+	return allowed
+}
+
+// isAllowedAuthHost reports whether the host of authUrl is in allowedHosts, ignoring case. Entries
+// with a port only match that port. Every host is allowed when allowedHosts is empty.
+func isAllowedAuthHost(allowedHosts map[string]bool, authUrl string) bool {
+	if len(allowedHosts) == 0 {
+		return true
+	}
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		return false
+	}
+	return allowedHosts[strings.ToLower(u.Hostname())] || allowedHosts[strings.ToLower(u.Host)]
+}
+
+func validateAllowedAuthHost(host string) error {
+	if host == "" || strings.ContainsAny(host, "/?#@ \t\r\n") {
+		return errors.New("invalid host " + host)
+	}
+	return nil
+}
+
+// disallowedHostDenial denies a request whose auth URL isn't in AllowedAuthHosts without calling
+// it, since a data-driven URL could otherwise send the request, with its credentials, anywhere.
+func disallowedHostDenial(log *zap.SugaredLogger, authUrl string, span *span) *api.AuthorizationResponse {
+	log.Warnw("Auth URL host is not in AllowedAuthHosts, denying access", zap.String("auth_url", authUrl))
+	span.setAttribute("auth.decision", "deny")
+	span.setError("disallowed auth host")
+	return api.UnauthenticatedResponse()
+}
+
+// checkRedirectHost stops followed redirects to hosts that aren't in allowedHosts.
+func checkRedirectHost(allowedHosts map[string]bool) func(*http.Request, []*http.Request) error {
+	return func(request *http.Request, _ []*http.Request) error {
+		if !isAllowedAuthHost(allowedHosts, request.URL.String()) {
+			return DisallowedAuthHostError(request.URL.Host)
+		}
+		return nil
+	}
+}
+
+// validateAllowedAuthHosts checks the AllowedAuthHosts entries and that every auth URL in the
+// config is allowed, as requests to the others would always be denied.
+func validateAllowedAuthHosts(config *Config) error {
+	if len(config.AllowedAuthHosts) == 0 {
+		return nil
+	}
+	for i, host := range config.AllowedAuthHosts {
+		if err := validateAllowedAuthHost(host); err != nil {
+			return InvalidConfigError(fmt.Sprintf("AllowedAuthHosts[%d]", i), err)
+		}
+	}
+
+	allowedHosts := newAllowedAuthHosts(config.AllowedAuthHosts)
+	authUrls := map[string]string{"AuthUrl": config.AuthUrl}
+	if config.FallbackAuthUrl != "" {
+		authUrls["FallbackAuthUrl"] = config.FallbackAuthUrl
+	}
+	if config.CanaryAuthUrl != "" {
+		authUrls["CanaryAuthUrl"] = config.CanaryAuthUrl
+	}
+	for tenant, authUrl := range config.TenantAuthUrls {
+		authUrls[fmt.Sprintf("TenantAuthUrls[%s]", tenant)] = authUrl
+	}
+	for route, authUrl := range config.RouteAuthUrls {
+		authUrls[fmt.Sprintf("RouteAuthUrls[%s]", route)] = authUrl
+	}
+	for i, authUrl := range config.AdditionalAuthUrls {
+		authUrls[fmt.Sprintf("AdditionalAuthUrls[%d]", i)] = authUrl
+	}
+	for _, field := range sortedKeys(authUrls) {
+		if !isAllowedAuthHost(allowedHosts, authUrls[field]) {
+			u, _ := url.Parse(authUrls[field])
+			return InvalidConfigError(field, DisallowedAuthHostError(u.Host))
+		}
+	}
+	return nil
+}
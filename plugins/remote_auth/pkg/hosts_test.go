@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIsAllowedAuthHost(t *testing.T) {
+	allowedHosts := newAllowedAuthHosts([]string{"Shoreline", "auth:9107"})
+	tests := []struct {
+		authUrl string
+		allowed bool
+	}{
+		{"http://shoreline:9107/token", true},
+		{"https://SHORELINE/token", true},
+		{"http://auth:9107/token", true},
+		{"http://auth:8080/token", false},
+		{"http://auth/token", false},
+		{"http://attacker.example.com/token", false},
+		{"http://shoreline.attacker.example.com/token", false},
+	}
+	for _, test := range tests {
+		if allowed := isAllowedAuthHost(allowedHosts, test.authUrl); allowed != test.allowed {
+			t.Errorf("expected %s allowed to be %v, got %v", test.authUrl, test.allowed, allowed)
+		}
+	}
+	if !isAllowedAuthHost(newAllowedAuthHosts(nil), "http://anywhere/token") {
+		t.Error("expected every host to be allowed without AllowedAuthHosts")
+	}
+}
+
+func TestAuthorizeDeniesDisallowedAuthHost(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, AllowedAuthHosts: []string{"127.0.0.1"}})
+	if response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil || !isAllowedResponse(response) {
+		t.Fatalf("expected the allowed host to be called, got %v, %v", response, err)
+	}
+
+	service.AuthUrl = "http://localhost" + server.URL[len("http://127.0.0.1"):]
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isAllowedResponse(response) {
+		t.Error("expected the disallowed host to be denied")
+	}
+	if calls != 1 {
+		t.Errorf("expected the disallowed host not to be called, got %d calls", calls)
+	}
+}
+
+func TestRedirectsToDisallowedHostsAreNotFollowed(t *testing.T) {
+	var redirected bool
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost"+target.URL[len("http://127.0.0.1"):], http.StatusFound)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, FollowRedirects: true, AllowedAuthHosts: []string{"127.0.0.1"}})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err == nil && isAllowedResponse(response) {
+		t.Error("expected the redirect to be denied")
+	}
+	if redirected {
+		t.Error("expected the redirect to a disallowed host not to be followed")
+	}
+}
@@ -0,0 +1,383 @@
+package pkg
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prefix of attribute paths evaluated as JSONPath expressions instead of dotted paths.
+const JsonPathPrefix = "$"
+
+// The supported JSONPath subset is the root "$", child names as ".name" or "['name']", array
+// indexes as "[0]" or "[-1]" counting from the end, wildcards as ".*" or "[*]", recursive descent
+// as "..name" or "..*", and filters on array elements as "[?(@.field)]", which checks the field
+// is present, or "[?(@.field <op> <literal>)]" with ==, !=, <, <=, > or >= and a quoted string,
+// number, true, false or null literal. Filter fields may be nested, e.g. "@.user.active". An
+// expression with only names and indexes yields a single value. One with wildcards, recursive
+// descent or filters yields the array of matches, and is absent when nothing matches.
+type jsonPath struct {
+	steps []jsonPathStep
+	// Whether the expression can match at most one value.
+	definite bool
+}
+
+type jsonPathStepKind int
+
+const (
+	jsonPathChild jsonPathStepKind = iota
+	jsonPathIndex
+	jsonPathWildcard
+	jsonPathFilter
+)
+
+type jsonPathStep struct {
+	kind      jsonPathStepKind
+	recursive bool
+	name      string
+	index     int
+	filter    *jsonPathCondition
+}
+
+type jsonPathCondition struct {
+	fields []string
+	// Empty when the condition only checks the field is present.
+	operator string
+	value    interface{}
+}
+
+// Compiled expressions keyed by path. Paths come from the config, so it stays small.
+var jsonPathCache sync.Map
+
+func isJsonPath(path string) bool {
+	return strings.HasPrefix(path, JsonPathPrefix)
+}
+
+// validateAttributePath checks the JSONPath expression when path is one; dotted paths are always valid.
+func validateAttributePath(path string) error {
+	if !isJsonPath(path) {
+		return nil
+	}
+	_, err := parseJsonPath(path)
+	return err
+}
+
+// lookupJsonPath evaluates the expression against data, treating invalid expressions as absent.
+func lookupJsonPath(data map[string]interface{}, expression string) (interface{}, bool) {
+	compiled, ok := jsonPathCache.Load(expression)
+	if !ok {
+		path, err := parseJsonPath(expression)
+		if err != nil {
+			return nil, false
+		}
+		compiled, _ = jsonPathCache.LoadOrStore(expression, path)
+	}
+	return compiled.(*jsonPath).lookup(data)
+}
+
+func parseJsonPath(expression string) (*jsonPath, error) {
+	if !isJsonPath(expression) {
+		return nil, errors.New("JSONPath expression must start with " + JsonPathPrefix)
+	}
+	path := &jsonPath{definite: true}
+	rest := expression[len(JsonPathPrefix):]
+	for rest != "" {
+		var step jsonPathStep
+		var err error
+		switch {
+		case strings.HasPrefix(rest, ".."):
+			step, rest, err = parseJsonPathDotStep(rest[2:])
+			step.recursive = true
+		case strings.HasPrefix(rest, "."):
+			step, rest, err = parseJsonPathDotStep(rest[1:])
+		case strings.HasPrefix(rest, "["):
+			step, rest, err = parseJsonPathBracketStep(rest[1:])
+		default:
+			err = errors.New("unexpected " + rest)
+		}
+		if err != nil {
+			return nil, errors.New("invalid JSONPath expression " + expression + ": " + err.Error())
+		}
+		path.definite = path.definite && !step.recursive && (step.kind == jsonPathChild || step.kind == jsonPathIndex)
+		path.steps = append(path.steps, step)
+	}
+	return path, nil
+}
+
+func parseJsonPathDotStep(rest string) (jsonPathStep, string, error) {
+	if strings.HasPrefix(rest, "*") {
+		return jsonPathStep{kind: jsonPathWildcard}, rest[1:], nil
+	}
+	end := strings.IndexAny(rest, ".[")
+	if end < 0 {
+		end = len(rest)
+	}
+	if end == 0 {
+		return jsonPathStep{}, "", errors.New("name must not be empty")
+	}
+	return jsonPathStep{kind: jsonPathChild, name: rest[:end]}, rest[end:], nil
+}
+
+func parseJsonPathBracketStep(rest string) (jsonPathStep, string, error) {
+	switch {
+	case strings.HasPrefix(rest, "*]"):
+		return jsonPathStep{kind: jsonPathWildcard}, rest[2:], nil
+	case strings.HasPrefix(rest, "'"), strings.HasPrefix(rest, "\""):
+		name, rest, err := parseJsonPathString(rest)
+		if err != nil {
+			return jsonPathStep{}, "", err
+		}
+		if !strings.HasPrefix(rest, "]") {
+			return jsonPathStep{}, "", errors.New("expected ] after name " + name)
+		}
+		return jsonPathStep{kind: jsonPathChild, name: name}, rest[1:], nil
+	case strings.HasPrefix(rest, "?("):
+		end := jsonPathFilterEnd(rest)
+		if end < 0 {
+			return jsonPathStep{}, "", errors.New("unterminated filter")
+		}
+		condition, err := parseJsonPathCondition(strings.TrimSpace(rest[2:end]))
+		if err != nil {
+			return jsonPathStep{}, "", err
+		}
+		return jsonPathStep{kind: jsonPathFilter, filter: condition}, rest[end+2:], nil
+	}
+	end := strings.IndexByte(rest, ']')
+	if end < 0 {
+		return jsonPathStep{}, "", errors.New("unterminated [")
+	}
+	index, err := strconv.Atoi(rest[:end])
+	if err != nil {
+		return jsonPathStep{}, "", errors.New("invalid index " + rest[:end])
+	}
+	return jsonPathStep{kind: jsonPathIndex, index: index}, rest[end+1:], nil
+}
+
+// jsonPathFilterEnd returns the offset of the ")]" closing the filter that rest starts with,
+// skipping quoted strings, or -1 when it isn't closed.
+func jsonPathFilterEnd(rest string) int {
+	var quote byte
+	for i := 2; i < len(rest); i++ {
+		switch {
+		case quote != 0:
+			if rest[i] == quote {
+				quote = 0
+			}
+		case rest[i] == '\'' || rest[i] == '"':
+			quote = rest[i]
+		case strings.HasPrefix(rest[i:], ")]"):
+			return i
+		}
+	}
+	return -1
+}
+
+// parseJsonPathString parses the quoted string that rest starts with, returning what follows it.
+func parseJsonPathString(rest string) (string, string, error) {
+	quote := rest[0]
+	end := strings.IndexByte(rest[1:], quote)
+	if end < 0 {
+		return "", "", errors.New("unterminated string")
+	}
+	return rest[1 : end+1], rest[end+2:], nil
+}
+
+func parseJsonPathCondition(expression string) (*jsonPathCondition, error) {
+	if !strings.HasPrefix(expression, "@.") {
+		return nil, errors.New("filter must start with @.")
+	}
+	expression = expression[2:]
+	end := strings.IndexAny(expression, " =!<>")
+	if end < 0 {
+		end = len(expression)
+	}
+	condition := &jsonPathCondition{fields: strings.Split(expression[:end], ".")}
+	for _, field := range condition.fields {
+		if field == "" {
+			return nil, errors.New("filter field must not be empty")
+		}
+	}
+	rest := strings.TrimSpace(expression[end:])
+	if rest == "" {
+		return condition, nil
+	}
+
+	for _, operator := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(rest, operator) {
+			condition.operator = operator
+			break
+		}
+	}
+	if condition.operator == "" {
+		return nil, errors.New("unknown filter operator in " + rest)
+	}
+	literal := strings.TrimSpace(rest[len(condition.operator):])
+	switch {
+	case strings.HasPrefix(literal, "'"), strings.HasPrefix(literal, "\""):
+		value, trailing, err := parseJsonPathString(literal)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(trailing) != "" {
+			return nil, errors.New("unexpected " + trailing)
+		}
+		condition.value = value
+	case literal == "true", literal == "false":
+		condition.value = literal == "true"
+	case literal == "null":
+		condition.value = nil
+	default:
+		value, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			return nil, errors.New("invalid filter literal " + literal)
+		}
+		condition.value = value
+	}
+	return condition, nil
+}
+
+// lookup evaluates the expression against data, as lookupPath does for dotted paths.
+func (p *jsonPath) lookup(data interface{}) (interface{}, bool) {
+	nodes := []interface{}{data}
+	for _, step := range p.steps {
+		if step.recursive {
+			nodes = jsonPathDescendants(nodes)
+		}
+		var next []interface{}
+		for _, node := range nodes {
+			next = append(next, step.apply(node)...)
+		}
+		nodes = next
+	}
+	if p.definite {
+		if len(nodes) != 1 {
+			return nil, false
+		}
+		return nodes[0], true
+	}
+	return nodes, len(nodes) > 0
+}
+
+func (s jsonPathStep) apply(node interface{}) []interface{} {
+	switch s.kind {
+	case jsonPathChild:
+		if object, ok := node.(map[string]interface{}); ok {
+			if value, ok := object[s.name]; ok {
+				return []interface{}{value}
+			}
+		}
+	case jsonPathIndex:
+		if elements, ok := node.([]interface{}); ok {
+			index := s.index
+			if index < 0 {
+				index += len(elements)
+			}
+			if index >= 0 && index < len(elements) {
+				return []interface{}{elements[index]}
+			}
+		}
+	case jsonPathWildcard:
+		return jsonPathChildren(node)
+	case jsonPathFilter:
+		var matches []interface{}
+		for _, child := range jsonPathChildren(node) {
+			if s.filter.matches(child) {
+				matches = append(matches, child)
+			}
+		}
+		return matches
+	}
+	return nil
+}
+
+// jsonPathChildren returns the elements of an array or the values of an object, ordered by key so
+// results don't depend on map iteration order.
+func jsonPathChildren(node interface{}) []interface{} {
+	switch v := node.(type) {
+	case []interface{}:
+		return v
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		children := make([]interface{}, 0, len(v))
+		for _, key := range keys {
+			children = append(children, v[key])
+		}
+		return children
+	}
+	return nil
+}
+
+// jsonPathDescendants returns the nodes and all of their descendants, each node before its children.
+func jsonPathDescendants(nodes []interface{}) []interface{} {
+	var descendants []interface{}
+	for _, node := range nodes {
+		descendants = append(descendants, node)
+		descendants = append(descendants, jsonPathDescendants(jsonPathChildren(node))...)
+	}
+	return descendants
+}
+
+func (c *jsonPathCondition) matches(node interface{}) bool {
+	value, ok := lookupSegments(node, c.fields)
+	if !ok {
+		return false
+	}
+	if c.operator == "" {
+		return true
+	}
+
+	var comparison int
+	switch expected := c.value.(type) {
+	case float64:
+		actual, ok := value.(float64)
+		if !ok {
+			return c.operator == "!="
+		}
+		comparison = compareFloats(actual, expected)
+	case string:
+		actual, ok := value.(string)
+		if !ok {
+			return c.operator == "!="
+		}
+		comparison = strings.Compare(actual, expected)
+	default:
+		// Booleans and null can only be compared for equality.
+		switch c.operator {
+		case "==":
+			return value == c.value
+		case "!=":
+			return value != c.value
+		}
+		return false
+	}
+
+	switch c.operator {
+	case "==":
+		return comparison == 0
+	case "!=":
+		return comparison != 0
+	case "<":
+		return comparison < 0
+	case "<=":
+		return comparison <= 0
+	case ">":
+		return comparison > 0
+	}
+	return comparison >= 0
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLookupJsonPath(t *testing.T) {
+	var data map[string]interface{}
+	body := `{
+		"user": {"id": "123", "dotted.name": "a"},
+		"roles": [
+			{"name": "admin", "active": true, "level": 3},
+			{"name": "viewer", "active": false, "level": 1},
+			{"name": "editor", "active": true, "level": 2, "scope": {"site": "eu"}}
+		]
+	}`
+	if err := json.Unmarshal([]byte(body), &data); err != nil {
+		t.Fatalf("unable to decode body: %v", err)
+	}
+
+	tests := []struct {
+		expression string
+		expected   interface{}
+	}{
+		{"$.user.id", "123"},
+		{"$['user']['dotted.name']", "a"},
+		{"$.roles[0].name", "admin"},
+		{"$.roles[-1].name", "editor"},
+		{"$.roles[*].name", []interface{}{"admin", "viewer", "editor"}},
+		{"$..site", []interface{}{"eu"}},
+		{"$.roles[?(@.active == true)].name", []interface{}{"admin", "editor"}},
+		{"$.roles[?(@.level >= 2)].name", []interface{}{"admin", "editor"}},
+		{"$.roles[?(@.name != 'admin')].name", []interface{}{"viewer", "editor"}},
+		{"$.roles[?(@.scope.site)].name", []interface{}{"editor"}},
+	}
+	for _, test := range tests {
+		value, ok := lookupPath(data, test.expression)
+		if !ok {
+			t.Errorf("expected %v to be present", test.expression)
+		} else if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("expected %v to be %v, got %v", test.expression, test.expected, value)
+		}
+	}
+	for _, expression := range []string{"$.missing", "$.roles[5]", "$.roles[?(@.level > 5)].name", "$.user[*].missing"} {
+		if value, ok := lookupPath(data, expression); ok {
+			t.Errorf("expected %v to be absent, got %v", expression, value)
+		}
+	}
+}
+
+func TestParseJsonPathErrors(t *testing.T) {
+	for _, expression := range []string{"$.", "$[", "$['name'", "$[abc]", "$[?(@.a == 1]", "$[?(a == 1)]", "$[?(@.a ~ 1)]", "$[?(@.a == nope)]", "$name"} {
+		if _, err := parseJsonPath(expression); err == nil {
+			t.Errorf("expected %q to be invalid", expression)
+		}
+	}
+}
+
+func TestMappingWithJsonPathSource(t *testing.T) {
+	attr := map[string]string{"$.roles[?(@.active == true)].name": "x-auth-roles"}
+	body := `{"roles": [{"name": "admin", "active": true}, {"name": "viewer"}, {"name": "editor", "active": true}]}`
+	extracted, err := extractResponseAttributes(strings.NewReader(body), mappingsFromResponseHeaders(attr))
+	if err != nil {
+		t.Fatalf("unable to extract attributes: %v", err)
+	}
+	if len(extracted.headers) != 1 || extracted.headers[0].Header.Value != "admin,editor" {
+		t.Errorf("expected the active roles, got %v", extracted.headers)
+	}
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var (
+	InvalidJwtError = func(reason string) error {
+		return errors.New(fmt.Sprintf("invalid jwt: %s", reason))
+	}
+)
+
+// jwtVerifier verifies JWT signatures with either an HMAC secret or a PEM encoded RSA or ECDSA
+// public key.
+type jwtVerifier struct {
+	secret    []byte
+	publicKey interface{}
+}
+
+// newJwtVerifier returns nil when key is empty, in which case tokens are decoded without
+// verification. A key that isn't PEM encoded is used as an HMAC secret.
+func newJwtVerifier(key string) (*jwtVerifier, error) {
+	if key == "" {
+		return nil, nil
+	}
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return &jwtVerifier{secret: []byte(key)}, nil
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch publicKey.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return &jwtVerifier{publicKey: publicKey}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported public key type %T", publicKey))
+}
+
+// decodeJwtClaims returns the claims of a compact serialized JWT, verifying its signature when a
+// verifier is given.
+func decodeJwtClaims(token string, verifier *jwtVerifier) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidJwtError("expected 3 segments")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJwtSegment(parts[0], &header); err != nil {
+		return nil, InvalidJwtError("malformed header")
+	}
+	if verifier != nil {
+		signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, InvalidJwtError("malformed signature")
+		}
+		if err := verifier.verify(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+			return nil, err
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJwtSegment(parts[1], &claims); err != nil {
+		return nil, InvalidJwtError("malformed claims")
+	}
+	return claims, nil
+}
+
+func decodeJwtSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (v *jwtVerifier) verify(alg string, signingInput string, signature []byte) error {
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	default:
+		return InvalidJwtError("unsupported algorithm " + alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "HS") && v.secret != nil:
+		mac := hmac.New(hash.New, v.secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return InvalidJwtError("signature mismatch")
+		}
+		return nil
+	case strings.HasPrefix(alg, "RS"):
+		if key, ok := v.publicKey.(*rsa.PublicKey); ok {
+			if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+				return InvalidJwtError("signature mismatch")
+			}
+			return nil
+		}
+	case strings.HasPrefix(alg, "ES"):
+		if key, ok := v.publicKey.(*ecdsa.PublicKey); ok {
+			if len(signature) == 0 || len(signature)%2 != 0 {
+				return InvalidJwtError("malformed signature")
+			}
+			size := len(signature) / 2
+			r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				return InvalidJwtError("signature mismatch")
+			}
+			return nil
+		}
+	}
+	return InvalidJwtError("algorithm " + alg + " does not match the verification key")
+}
@@ -0,0 +1,138 @@
+package pkg
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func signedJwt(t *testing.T, alg string, claims string, sign func(signingInput []byte) []byte) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("{\"alg\":\"%s\",\"typ\":\"JWT\"}", alg)))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(claims))
+	signingInput := header + "." + payload
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signingInput)))
+}
+
+func hs256Jwt(t *testing.T, secret string, claims string) string {
+	return signedJwt(t, "HS256", claims, func(signingInput []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signingInput)
+		return mac.Sum(nil)
+	})
+}
+
+func pemPublicKey(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal public key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestDecodeJwtClaimsWithHmac(t *testing.T) {
+	token := hs256Jwt(t, "secret", "{\"sub\":\"123456\"}")
+	verifier, _ := newJwtVerifier("secret")
+
+	claims, err := decodeJwtClaims(token, verifier)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims["sub"] != "123456" {
+		t.Errorf("expected sub claim 123456, got %v", claims["sub"])
+	}
+
+	wrong, _ := newJwtVerifier("wrong")
+	if _, err := decodeJwtClaims(token, wrong); err == nil {
+		t.Error("expected a signature mismatch with the wrong secret")
+	}
+}
+
+func TestDecodeJwtClaimsWithPublicKeys(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaToken := signedJwt(t, "RS256", "{\"sub\":\"rsa\"}", func(signingInput []byte) []byte {
+		digest := sha256.Sum256(signingInput)
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		return signature
+	})
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecToken := signedJwt(t, "ES256", "{\"sub\":\"ec\"}", func(signingInput []byte) []byte {
+		digest := sha256.Sum256(signingInput)
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		signature := make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+		return signature
+	})
+
+	rsaVerifier, err := newJwtVerifier(pemPublicKey(t, &rsaKey.PublicKey))
+	if err != nil {
+		t.Fatalf("unable to create rsa verifier: %v", err)
+	}
+	ecVerifier, err := newJwtVerifier(pemPublicKey(t, &ecKey.PublicKey))
+	if err != nil {
+		t.Fatalf("unable to create ecdsa verifier: %v", err)
+	}
+
+	if claims, err := decodeJwtClaims(rsaToken, rsaVerifier); err != nil || claims["sub"] != "rsa" {
+		t.Errorf("expected rsa token to verify, got %v, %v", claims, err)
+	}
+	if claims, err := decodeJwtClaims(ecToken, ecVerifier); err != nil || claims["sub"] != "ec" {
+		t.Errorf("expected ecdsa token to verify, got %v, %v", claims, err)
+	}
+	if _, err := decodeJwtClaims(rsaToken, ecVerifier); err == nil {
+		t.Error("expected an rsa token not to verify with an ecdsa key")
+	}
+}
+
+func TestDecodeJwtClaimsWithoutVerification(t *testing.T) {
+	token := hs256Jwt(t, "secret", "{\"sub\":\"123456\"}")
+	if claims, err := decodeJwtClaims(token, nil); err != nil || claims["sub"] != "123456" {
+		t.Errorf("expected claims to decode, got %v, %v", claims, err)
+	}
+	if _, err := decodeJwtClaims("not-a-jwt", nil); err == nil {
+		t.Error("expected an error for a malformed token")
+	}
+}
+
+func TestAuthorizeProjectsJwtClaims(t *testing.T) {
+	token := hs256Jwt(t, "secret", "{\"sub\":\"123456\",\"org\":{\"id\":\"tidepool\"}}")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "{\"token\":\"%s\",\"isserver\":false}", token)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:            server.URL,
+		ResponseHeaders:    map[string]string{"isserver": "x-auth-server-access"},
+		JwtAttribute:       "token",
+		JwtClaimHeaders:    map[string]string{"sub": "x-auth-subject-id", "org.id": "x-auth-org-id"},
+		JwtVerificationKey: "secret",
+	})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectations := map[string]string{
+		"x-auth-server-access": "false",
+		"x-auth-subject-id":    "123456",
+		"x-auth-org-id":        "tidepool",
+	}
+	for header, expected := range expectations {
+		if value, _ := responseHeaderValue(response, header); value != expected {
+			t.Errorf("expected header %v to be %v, got %v", header, expected, value)
+		}
+	}
+}
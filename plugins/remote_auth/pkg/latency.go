@@ -0,0 +1,44 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// latencySampled reports whether the latency of the request is logged with LatencyLogSampleRate.
+// Requests are sampled by the hash of their request id when they have one, so every plugin
+// instance, and retries of the same request, make the same choice.
+func (c *RemoteAuthService) latencySampled(authzRequest *api.AuthorizationRequest) bool {
+	if c.LatencyLogSampleRate <= 0 {
+		return false
+	}
+	if c.LatencyLogSampleRate >= 1 {
+		return true
+	}
+	requestId := c.extractRequestId(authzRequest)
+	if requestId == nil || *requestId == "" {
+		return rand.Float64() < c.LatencyLogSampleRate
+	}
+	sum := sha256.Sum256([]byte(*requestId))
+	return float64(binary.BigEndian.Uint64(sum[:8]))/math.MaxUint64 < c.LatencyLogSampleRate
+}
+
+// logLatency logs how long deciding the request took, with the decision and the denied status
+// code, or the error when it couldn't be decided.
+func logLatency(log *zap.SugaredLogger, latency time.Duration, response *api.AuthorizationResponse, err error) {
+	log = log.With(zap.Int64("latency_ms", latency.Milliseconds()))
+	switch {
+	case err != nil:
+		log.Infow("Sampled auth call latency", zap.String("decision", "error"), zap.Error(err))
+	case isAllowedResponse(response):
+		log.Infow("Sampled auth call latency", zap.String("decision", "allow"))
+	default:
+		log.Infow("Sampled auth call latency", zap.String("decision", "deny"),
+			zap.Int32("denied_status_code", int32(response.CheckResponse.GetDeniedResponse().GetStatus().GetCode())))
+	}
+}
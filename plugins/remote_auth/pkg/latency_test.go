@@ -0,0 +1,32 @@
+package pkg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLatencySamplingByRequestId(t *testing.T) {
+	config := &Config{AuthUrl: "http://auth", RequestIdHeader: "x-request-id", LatencyLogSampleRate: 0.25}
+	service, other := newAuthService(t, config), newAuthService(t, config)
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		request := newAuthorizationRequest(map[string]string{"x-request-id": fmt.Sprintf("request-%d", i)})
+		if service.latencySampled(request) != other.latencySampled(request) {
+			t.Fatalf("expected request %v to be sampled the same by every instance", i)
+		}
+		if service.latencySampled(request) {
+			sampled++
+		}
+	}
+	if sampled < 200 || sampled > 300 {
+		t.Errorf("expected about a quarter of the requests to be sampled, got %v of 1000", sampled)
+	}
+
+	request := newAuthorizationRequest(map[string]string{"x-request-id": "request"})
+	if newAuthService(t, &Config{AuthUrl: "http://auth", RequestIdHeader: "x-request-id"}).latencySampled(request) {
+		t.Error("expected no request to be sampled by default")
+	}
+	if !newAuthService(t, &Config{AuthUrl: "http://auth", LatencyLogSampleRate: 1}).latencySampled(request) {
+		t.Error("expected every request to be sampled at a rate of 1")
+	}
+}
@@ -0,0 +1,62 @@
+package pkg
+
+import (
+	envoycorev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoyauthv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"strings"
+)
+
+const DefaultLoginRedirectParam = "redirect_uri"
+
+// withLoginRedirect turns a 401 denial into a 302 redirect to LoginRedirectUrl, carrying the
+// original URL of the request in the LoginRedirectParam query parameter. Headers of the denial are
+// kept, its body and Content-Type are dropped. Other responses are returned as is.
+func (c *RemoteAuthService) withLoginRedirect(authzRequest *api.AuthorizationRequest, response *api.AuthorizationResponse) *api.AuthorizationResponse {
+	if c.loginRedirectUrl == nil || response == nil || !isUnauthenticatedResponse(response) {
+		return response
+	}
+	location := *c.loginRedirectUrl
+	if original := originalUrl(authzRequest); original != "" {
+		query := location.Query()
+		query.Set(c.loginRedirectParam, original)
+		location.RawQuery = query.Encode()
+	}
+
+	redirect := &envoyauthv2.DeniedHttpResponse{Status: &envoytype.HttpStatus{Code: envoytype.StatusCode_Found}}
+	for _, header := range response.CheckResponse.GetDeniedResponse().GetHeaders() {
+		if !strings.EqualFold(header.GetHeader().GetKey(), "content-type") {
+			redirect.Headers = append(redirect.Headers, header)
+		}
+	}
+	redirect.Headers = append(redirect.Headers, &envoycorev2.HeaderValueOption{
+		Header: &envoycorev2.HeaderValue{Key: "location", Value: location.String()},
+	})
+	response.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_DeniedResponse{DeniedResponse: redirect}
+	return response
+}
+
+// isUnauthenticatedResponse reports whether a response denies the request with a 401, rather than
+// e.g. a 403 or 429 a login wouldn't resolve.
+func isUnauthenticatedResponse(response *api.AuthorizationResponse) bool {
+	if response.CheckResponse.GetStatus().GetCode() != int32(code.Code_UNAUTHENTICATED) {
+		return false
+	}
+	status := response.CheckResponse.GetDeniedResponse().GetStatus()
+	return status == nil || status.GetCode() == envoytype.StatusCode_Unauthorized
+}
+
+// originalUrl returns the URL the client requested, or "" when Envoy didn't report its host.
+func originalUrl(authzRequest *api.AuthorizationRequest) string {
+	httpRequest := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp()
+	if httpRequest.GetHost() == "" {
+		return ""
+	}
+	scheme := httpRequest.GetScheme()
+	if scheme == "" {
+		scheme = "https"
+	}
+	return scheme + "://" + httpRequest.GetHost() + httpRequest.GetPath()
+}
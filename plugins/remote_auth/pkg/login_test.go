@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"context"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeRedirectsDenialsToLogin(t *testing.T) {
+	status := http.StatusUnauthorized
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:           server.URL,
+		EnableDenyReasons: true,
+		DenyStatusCodes:   map[int]int{403: 403},
+		LoginRedirectUrl:  "https://app.tidepool.org/login?client=web",
+	})
+	request := newAuthorizationRequest(nil)
+	request.CheckRequest.Attributes.Request.Http.Scheme = "https"
+	request.CheckRequest.Attributes.Request.Http.Host = "api.tidepool.org"
+	request.CheckRequest.Attributes.Request.Http.Path = "/data?type=cbg"
+
+	response, err := service.Authorize(context.Background(), request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	denied := response.CheckResponse.GetDeniedResponse()
+	if denied.GetStatus().GetCode() != envoytype.StatusCode_Found || denied.GetBody() != "" {
+		t.Fatalf("expected a redirect without a body, got %+v", denied)
+	}
+	expected := "https://app.tidepool.org/login?client=web&redirect_uri=https%3A%2F%2Fapi.tidepool.org%2Fdata%3Ftype%3Dcbg"
+	if location, _ := deniedHeaderValue(response, "location"); location != expected {
+		t.Errorf("expected location %v, got %v", expected, location)
+	}
+	if _, ok := deniedHeaderValue(response, "content-type"); ok {
+		t.Error("expected the content type of the deny reason to be dropped")
+	}
+
+	status = http.StatusForbidden
+	response, err = service.Authorize(context.Background(), request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code := response.CheckResponse.GetDeniedResponse().GetStatus().GetCode(); code != envoytype.StatusCode_Forbidden {
+		t.Errorf("expected a 403 not to be redirected, got %v", code)
+	}
+}
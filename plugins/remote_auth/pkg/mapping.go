@@ -0,0 +1,851 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	envoycorev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	TargetTypeHeader   = "header"
+	TargetTypeMetadata = "metadata"
+
+	// Prefix of sources read from an auth response header instead of the body, e.g. "header:X-Subject".
+	SourceHeaderPrefix = "header:"
+	// Prefix of the last ResponseHeaders candidate giving the Default of the mapping, e.g.
+	// "userid|default:anonymous".
+	SourceDefaultPrefix = "default:"
+	// Source reading the status code of the auth response, e.g. to set "X-Auth-Status: 200".
+	SourceStatus = "$status"
+	// Suffix of a path segment collecting the rest of the path across array elements, e.g. "grants[].scope".
+	ArraySegmentSuffix = "[]"
+
+	DefaultDelimiter = ","
+
+	// Encodings of transformed values; base64url omits the padding.
+	EncodingBase64    = "base64"
+	EncodingBase64Url = "base64url"
+	EncodingUrl       = "url"
+
+	// Units of Unix timestamps formatted as RFC3339 dates.
+	EpochSeconds = "seconds"
+	EpochMillis  = "millis"
+
+	// Types response attributes can be expected to have.
+	AttributeTypeString = "string"
+	AttributeTypeInt    = "int"
+	AttributeTypeBool   = "bool"
+
+	DuplicateHeadersFirst = "first"
+	DuplicateHeadersLast  = "last"
+	DuplicateHeadersJoin  = "join"
+)
+
+// Mapping projects a value from the auth response onto the authorized response. Its value is
+// resolved by trying Source and then each of Sources in order, whether they're body attributes or
+// auth response headers, and transforming the first one present. Default is set when none is.
+type Mapping struct {
+	// Path of the attribute in the auth response body. Nested fields are separated by dots, e.g.
+	// "user.id". An attribute whose name itself contains dots is matched before the path is split.
+	// A "[]" suffix collects the rest of the path across an array, e.g. "grants[].scope". Paths
+	// starting with "$" are JSONPath expressions, e.g. "$.roles[?(@.active == true)].name"; see
+	// jsonPath for the supported subset. "header:<name>" reads the auth response header instead.
+	Source string
+	// Further candidate paths, tried in order when Source isn't present in the auth response.
+	Sources   []string
+	Target    Target
+	Transform *Transform
+	// Set verbatim, without the Transform, when no source is present in the auth response. The
+	// target is omitted when nil.
+	Default *string
+	// Denies the request when no source is present in the auth response, for attributes like the
+	// subject id that must never be omitted. Can't be combined with a Default. Null sources count as
+	// absent, even with a NullValue.
+	Required bool
+	// Set verbatim, without the Transform, when a source is present in the auth response but null,
+	// e.g. "" for an empty header. Null sources are treated as absent when nil.
+	NullValue *string
+	// Type the attribute must have, so downstream services can rely on it: "string", "int" (a whole
+	// number or a string of one) or "bool" (a boolean or "true"/"false"). Every element of an array
+	// attribute is checked. A mistyped attribute is skipped, without a Default, and denies the
+	// request when the mapping is Required. Any type is accepted when empty.
+	Type string
+	// Patterns other attributes of the auth response body must all match for the mapping to be
+	// applied, keyed by attribute path like RequiredAttributeMatches, e.g. {"plan": "^premium$"} to
+	// only project claims for premium accounts. When one doesn't, the target is omitted, regardless
+	// of the Default, and a Required mapping doesn't deny the request. Always applied when empty.
+	When map[string]string
+
+	// The compiled When patterns, see withConditions.
+	conditions []attributeMatcher
+	// Set for ResponseMetadata mappings: metadata values keep the type of the attribute, e.g. a
+	// number or a list, unless transformed, defaulted or null.
+	typed bool
+	// Set for ResponseHeaderPrefixes mappings, whose Target.Name is the prefix of the headers the
+	// keys of the object are set as, see addPrefixedHeaders.
+	prefixed bool
+	recurse  bool
+}
+
+type Target struct {
+	// Either "header" (the default) or "metadata" for Envoy dynamic metadata.
+	Type string
+	Name string
+	// Appends the header to the values the request already has, e.g. to add a role to X-Roles.
+	// Headers overwrite existing values otherwise.
+	Append bool
+	// Sets array values as one header per element instead of joining them, e.g. an X-Role header
+	// per role. The Transform is applied to each element. Repeated headers are never merged with
+	// other headers of the same name by DuplicateHeaders. Only supported for header targets.
+	Repeat bool
+}
+
+// Transform is applied to the attribute value before it is set on the target. Negate is applied
+// to the raw value, then the value is stringified, using Epoch or Decimals for numbers, and replaced
+// using Values, then Trim, Lower, Upper, Encoding, Prefix and Suffix are applied.
+type Transform struct {
+	// Negates boolean attributes; other types are left unchanged.
+	Negate bool
+	// Formats numbers with this many decimals instead of the shortest representation, which uses
+	// exponents for large numbers, e.g. 0 formats the timestamp 1.7e+09 as "1700000000".
+	Decimals *int
+	// Reads numbers, or numeric strings, as Unix timestamps in "seconds" or "millis" and formats them
+	// as RFC3339 UTC dates, e.g. 1700000000 as "2023-11-14T22:13:20Z". Negative and non-numeric
+	// values are skipped.
+	Epoch string
+	// Serializes object attributes, which are otherwise skipped, to compact JSON, e.g. to forward a
+	// "profile" object as a single header.
+	Json bool
+	// Joins array values, DefaultDelimiter when empty.
+	Delimiter string
+	// Replaces stringified values, e.g. {"true": "allow", "false": "deny"}. Unmatched values are kept.
+	Values map[string]string
+	Trim   bool
+	Lower  bool
+	Upper  bool
+	// Encodes the value so it survives as a header, e.g. a JSON object: "base64", "base64url" or
+	// "url" for query escaping. Object attributes, which are otherwise skipped, are serialized to
+	// compact JSON before being encoded.
+	Encoding string
+	// Added around the value after casing, so they're kept verbatim, e.g. "user:".
+	Prefix string
+	Suffix string
+}
+
+type extractedAttributes struct {
+	headers []*envoycorev2.HeaderValueOption
+	// Headers of mappings with Target.Repeat, one per array element, kept apart so they aren't
+	// merged as duplicates.
+	repeatedHeaders []*envoycorev2.HeaderValueOption
+	metadata        *structpb.Struct
+	// Set when the AllowAttribute of the response isn't true.
+	denied     bool
+	denyReason string
+	// Names of the headers whose values had control characters stripped.
+	sanitizedHeaders []string
+	// Sources of the required mappings absent from the auth response.
+	missingRequired []string
+	// Sources of the mappings whose attribute isn't of their Type, and the required ones among them.
+	mistyped         []string
+	mistypedRequired []string
+	// The RequiredAttributeMatches rule the auth response failed, nil when they all matched.
+	unmatched *attributeMatcher
+	// When the decision expires according to the ExpiryAttribute, zero when unknown.
+	expires time.Time
+}
+
+// mappingsFromResponseHeaders converts the ResponseHeaders attribute-to-header map to mappings,
+// ordered by header name so the resulting headers don't depend on map iteration order.
+func mappingsFromResponseHeaders(attributesToHeadersMap map[string]string) []Mapping {
+	var mappings []Mapping
+	for attribute, header := range attributesToHeadersMap {
+		candidates := strings.Split(attribute, "|")
+		for i := range candidates {
+			candidates[i] = strings.TrimSpace(candidates[i])
+		}
+		var defaultValue *string
+		if last := candidates[len(candidates)-1]; len(candidates) > 1 && strings.HasPrefix(last, SourceDefaultPrefix) {
+			value := strings.TrimPrefix(last, SourceDefaultPrefix)
+			defaultValue = &value
+			candidates = candidates[:len(candidates)-1]
+		}
+		mappings = append(mappings, Mapping{
+			Source:  candidates[0],
+			Sources: candidates[1:],
+			Target:  Target{Type: TargetTypeHeader, Name: header},
+			Default: defaultValue,
+		})
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].Target.Name == mappings[j].Target.Name {
+			return mappings[i].Source < mappings[j].Source
+		}
+		return mappings[i].Target.Name < mappings[j].Target.Name
+	})
+	return mappings
+}
+
+func validateMapping(mapping Mapping) error {
+	if mapping.Source == "" {
+		return errors.New("source is required")
+	}
+	for _, source := range mapping.sources() {
+		if source == "" {
+			return errors.New("sources must not be empty")
+		}
+		if source == SourceHeaderPrefix {
+			return errors.New("source header name is required")
+		}
+		if strings.HasPrefix(source, SourceDefaultPrefix) {
+			return errors.New("static values must be set as the default")
+		}
+		if source == SourceStatus {
+			continue
+		}
+		if err := validateAttributePath(source); err != nil {
+			return err
+		}
+	}
+	if mapping.Target.Name == "" {
+		return errors.New("target name is required")
+	}
+	if mapping.Required && mapping.Default != nil {
+		return errors.New("a required mapping cannot have a default")
+	}
+	if err := validateAttributeType(mapping.Type); err != nil {
+		return err
+	}
+	for attribute, pattern := range mapping.When {
+		if err := validateAttributeMatch(attribute, pattern); err != nil {
+			return errors.New("condition " + attribute + ": " + err.Error())
+		}
+	}
+	if mapping.Target.Repeat && mapping.Target.Type == TargetTypeMetadata {
+		return errors.New("only header targets can be repeated")
+	}
+	switch mapping.Target.Type {
+	case "", TargetTypeHeader, TargetTypeMetadata:
+	default:
+		return errors.New("unknown target type " + mapping.Target.Type)
+	}
+	return validateTransform(mapping.Transform)
+}
+
+func validateAttributeType(attributeType string) error {
+	switch attributeType {
+	case "", AttributeTypeString, AttributeTypeInt, AttributeTypeBool:
+		return nil
+	}
+	return errors.New("unknown attribute type " + attributeType + ", must be one of " + AttributeTypeString + ", " + AttributeTypeInt + " or " + AttributeTypeBool)
+}
+
+func validateTransform(t *Transform) error {
+	if t == nil {
+		return nil
+	}
+	if t.Lower && t.Upper {
+		return errors.New("transform cannot be both lower and upper")
+	}
+	if t.Decimals != nil && (*t.Decimals < 0 || *t.Decimals > 20) {
+		return errors.New("transform decimals must be between 0 and 20")
+	}
+	switch t.Encoding {
+	case "", EncodingBase64, EncodingBase64Url, EncodingUrl:
+	default:
+		return errors.New("unknown transform encoding " + t.Encoding + ", must be one of " + EncodingBase64 + ", " + EncodingBase64Url + " or " + EncodingUrl)
+	}
+	switch t.Epoch {
+	case "", EpochSeconds, EpochMillis:
+	default:
+		return errors.New("unknown transform epoch " + t.Epoch + ", must be " + EpochSeconds + " or " + EpochMillis)
+	}
+	return nil
+}
+
+// mappedResponse is what mappings read from an auth response besides its body: the headers for
+// SourceHeaderPrefix sources and the status code for SourceStatus.
+type mappedResponse struct {
+	headers    http.Header
+	statusCode int
+}
+
+func mappedResponseOf(response *http.Response) *mappedResponse {
+	return &mappedResponse{headers: response.Header, statusCode: response.StatusCode}
+}
+
+// applyMappings projects mappings from an auth response with the decoded body data and the rest
+// of the response; either may be nil.
+func applyMappings(data map[string]interface{}, response *mappedResponse, mappings []Mapping) *extractedAttributes {
+	extracted := &extractedAttributes{}
+	for _, mapping := range mappings {
+		if !mapping.conditionsMet(data) {
+			continue
+		}
+		if mapping.prefixed {
+			if raw, ok := mapping.lookupRaw(data, response); ok {
+				if object, ok := raw.(map[string]interface{}); ok {
+					extracted.addPrefixedHeaders(mapping, mapping.Target.Name, object)
+				}
+			}
+			continue
+		}
+		if mapping.mistyped(data, response) {
+			source := strings.Join(mapping.sources(), "|")
+			extracted.mistyped = append(extracted.mistyped, source)
+			if mapping.Required {
+				extracted.mistypedRequired = append(extracted.mistypedRequired, source)
+			}
+			continue
+		}
+		var transformed []string
+		values, null := mapping.lookupValues(data, response)
+		typed := mapping.typed && len(values) > 0 && mapping.Transform == nil
+		if len(values) > 0 {
+			// The values are the mapping's own, so they're transformed in place.
+			transformed = values
+			for i, value := range values {
+				transformed[i] = mapping.Transform.apply(value)
+			}
+		} else if null && mapping.NullValue != nil && !mapping.Required {
+			transformed = []string{*mapping.NullValue}
+		} else if mapping.Default != nil {
+			transformed = []string{*mapping.Default}
+		} else {
+			if mapping.Required {
+				extracted.missingRequired = append(extracted.missingRequired, strings.Join(mapping.sources(), "|"))
+			}
+			continue
+		}
+
+		switch mapping.Target.Type {
+		case TargetTypeMetadata:
+			if extracted.metadata == nil {
+				extracted.metadata = &structpb.Struct{Fields: map[string]*structpb.Value{}}
+			}
+			value := &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: transformed[0]}}
+			if raw, ok := mapping.lookupRaw(data, response); typed && ok {
+				value = structValue(raw)
+			}
+			extracted.metadata.Fields[mapping.Target.Name] = value
+		default:
+			extracted.addHeaders(mapping, mapping.Target.Name, transformed)
+		}
+	}
+	return extracted
+}
+
+// addHeaders sets the values of a header mapping as headers named name, stripping control
+// characters from them.
+func (e *extractedAttributes) addHeaders(mapping Mapping, name string, values []string) {
+	sanitized := false
+	for i, value := range values {
+		if value, ok := sanitizeHeaderValue(value); !ok {
+			values[i] = value
+			sanitized = true
+		}
+		header := &envoycorev2.HeaderValueOption{
+			Header: &envoycorev2.HeaderValue{
+				Key:   name,
+				Value: values[i],
+			},
+			// ext_authz overwrites upstream headers when unset; false matches that default and is
+			// only set to make it explicit. Elements after the first are always appended so they
+			// don't overwrite each other.
+			Append: &wrappers.BoolValue{Value: mapping.Target.Append || i > 0},
+		}
+		if mapping.Target.Repeat {
+			e.repeatedHeaders = append(e.repeatedHeaders, header)
+		} else {
+			e.headers = append(e.headers, header)
+		}
+	}
+	if sanitized {
+		e.sanitizedHeaders = append(e.sanitizedHeaders, name)
+	}
+}
+
+func validateDuplicateHeaders(policy string) error {
+	switch policy {
+	case "", DuplicateHeadersFirst, DuplicateHeadersLast, DuplicateHeadersJoin:
+		return nil
+	}
+	return errors.New("must be one of " + DuplicateHeadersFirst + ", " + DuplicateHeadersLast + ", " + DuplicateHeadersJoin)
+}
+
+// mergeDuplicateHeaders leaves at most one header per case-insensitive name, in the position of
+// the first one, keeping the first or last value or joining them all with DefaultDelimiter.
+func mergeDuplicateHeaders(headers []*envoycorev2.HeaderValueOption, policy string) []*envoycorev2.HeaderValueOption {
+	merged := make([]*envoycorev2.HeaderValueOption, 0, len(headers))
+	positions := map[string]int{}
+	for _, header := range headers {
+		// Lowercasing doesn't allocate for the usual lowercase names, unlike canonicalizing them.
+		name := strings.ToLower(header.Header.Key)
+		position, ok := positions[name]
+		if !ok {
+			positions[name] = len(merged)
+			merged = append(merged, header)
+			continue
+		}
+		switch policy {
+		case DuplicateHeadersLast:
+			merged[position] = header
+		case DuplicateHeadersJoin:
+			joined := *merged[position]
+			joined.Header = &envoycorev2.HeaderValue{
+				Key:   joined.Header.Key,
+				Value: joined.Header.Value + DefaultDelimiter + header.Header.Value,
+			}
+			merged[position] = &joined
+		}
+	}
+	return merged
+}
+
+// withinHeaderBudget keeps the headers, in order, that fit in maxHeaders headers and maxBytes bytes of
+// names and values, returning the names of those that don't. A zero limit is unbounded.
+func withinHeaderBudget(headers []*envoycorev2.HeaderValueOption, maxHeaders int, maxBytes int) ([]*envoycorev2.HeaderValueOption, []string) {
+	kept := make([]*envoycorev2.HeaderValueOption, 0, len(headers))
+	var dropped []string
+	size := 0
+	for _, header := range headers {
+		headerSize := len(header.Header.Key) + len(header.Header.Value)
+		if (maxHeaders > 0 && len(kept) >= maxHeaders) || (maxBytes > 0 && size+headerSize > maxBytes) {
+			dropped = append(dropped, header.Header.Key)
+			continue
+		}
+		kept = append(kept, header)
+		size += headerSize
+	}
+	return kept, dropped
+}
+
+// withConditions compiles the When patterns of the mappings, which were checked by validateConfig.
+func withConditions(mappings []Mapping) []Mapping {
+	for i := range mappings {
+		mappings[i].conditions = newAttributeMatchers(mappings[i].When)
+	}
+	return mappings
+}
+
+// conditionsMet reports whether the When patterns all match data, compiling them when they
+// haven't been by withConditions.
+func (m Mapping) conditionsMet(data map[string]interface{}) bool {
+	if len(m.When) == 0 {
+		return true
+	}
+	conditions := m.conditions
+	if conditions == nil {
+		conditions = newAttributeMatchers(m.When)
+	}
+	return unmatchedAttribute(data, conditions) == nil
+}
+
+// withJsonObjects sets Transform.Json on every mapping, copying the transforms so ones shared with
+// the config aren't changed.
+func withJsonObjects(mappings []Mapping) []Mapping {
+	for i := range mappings {
+		transform := Transform{}
+		if mappings[i].Transform != nil {
+			transform = *mappings[i].Transform
+		}
+		transform.Json = true
+		mappings[i].Transform = &transform
+	}
+	return mappings
+}
+
+// readsBody reports whether any of the mappings reads from the auth response body.
+func readsBody(mappings []Mapping) bool {
+	for _, mapping := range mappings {
+		if mapping.readsBody() {
+			return true
+		}
+	}
+	return false
+}
+
+func hasRequiredMapping(mappings []Mapping) bool {
+	for _, mapping := range mappings {
+		if mapping.Required {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Mapping) sources() []string {
+	return append([]string{m.Source}, m.Sources...)
+}
+
+// readsBody reports whether any source of the mapping is a body attribute.
+func (m Mapping) readsBody() bool {
+	if len(m.When) > 0 {
+		return true
+	}
+	for _, source := range m.sources() {
+		if !isResponseSource(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the stringified value of the first candidate source present in the auth response.
+// When there's none, it reports whether any of the candidates was present but null.
+func (m Mapping) lookup(data map[string]interface{}, response *mappedResponse) (*string, bool) {
+	null := false
+	for _, source := range m.sources() {
+		raw, ok := lookupSource(data, response, source)
+		if !ok {
+			continue
+		}
+		if raw == nil {
+			null = true
+			continue
+		}
+		if value := m.Transform.stringify(m.Transform.applyRaw(raw)); value != nil {
+			return value, false
+		}
+	}
+	return nil, null
+}
+
+// lookupRaw returns the value of the first candidate source present and not null in the auth
+// response, as decoded.
+func (m Mapping) lookupRaw(data map[string]interface{}, response *mappedResponse) (interface{}, bool) {
+	for _, source := range m.sources() {
+		if raw, ok := lookupSource(data, response, source); ok && raw != nil {
+			return raw, true
+		}
+	}
+	return nil, false
+}
+
+// structValue converts a decoded JSON value to a protobuf value, keeping its type.
+func structValue(raw interface{}) *structpb.Value {
+	switch raw := raw.(type) {
+	case string:
+		return &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: raw}}
+	case float64:
+		return &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: raw}}
+	case bool:
+		return &structpb.Value{Kind: &structpb.Value_BoolValue{BoolValue: raw}}
+	case []interface{}:
+		list := &structpb.ListValue{Values: make([]*structpb.Value, 0, len(raw))}
+		for _, element := range raw {
+			list.Values = append(list.Values, structValue(element))
+		}
+		return &structpb.Value{Kind: &structpb.Value_ListValue{ListValue: list}}
+	case map[string]interface{}:
+		fields := make(map[string]*structpb.Value, len(raw))
+		for key, value := range raw {
+			fields[key] = structValue(value)
+		}
+		return &structpb.Value{Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{Fields: fields}}}
+	}
+	return &structpb.Value{Kind: &structpb.Value_NullValue{NullValue: structpb.NullValue_NULL_VALUE}}
+}
+
+// lookupValues returns the value of the mapping as lookup does, except that with Target.Repeat an
+// array value is returned as its stringified elements. Null elements are skipped.
+func (m Mapping) lookupValues(data map[string]interface{}, response *mappedResponse) ([]string, bool) {
+	if !m.Target.Repeat {
+		value, null := m.lookup(data, response)
+		if value == nil {
+			return nil, null
+		}
+		return []string{*value}, false
+	}
+
+	null := false
+	for _, source := range m.sources() {
+		raw, ok := lookupSource(data, response, source)
+		if !ok {
+			continue
+		}
+		if raw == nil {
+			null = true
+			continue
+		}
+		elements, isArray := raw.([]interface{})
+		if !isArray {
+			elements = []interface{}{raw}
+		}
+		var values []string
+		for _, element := range elements {
+			if element == nil {
+				continue
+			}
+			if value := m.Transform.stringify(m.Transform.applyRaw(element)); value != nil {
+				values = append(values, *value)
+			}
+		}
+		if len(values) > 0 {
+			return values, false
+		}
+	}
+	return nil, null
+}
+
+// mistyped reports whether the first non-null source present in the auth response, or any of its
+// elements when it's an array, isn't of the mapping's Type.
+func (m Mapping) mistyped(data map[string]interface{}, response *mappedResponse) bool {
+	if m.Type == "" {
+		return false
+	}
+	for _, source := range m.sources() {
+		raw, ok := lookupSource(data, response, source)
+		if !ok || raw == nil {
+			continue
+		}
+		elements, isArray := raw.([]interface{})
+		if !isArray {
+			elements = []interface{}{raw}
+		}
+		for _, element := range elements {
+			if element != nil && !hasAttributeType(element, m.Type) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// hasAttributeType reports whether a decoded attribute value is of attributeType, accepting the
+// string forms of whole numbers and booleans since they stringify to the same header value.
+func hasAttributeType(raw interface{}, attributeType string) bool {
+	v := reflect.ValueOf(raw)
+	switch attributeType {
+	case AttributeTypeString:
+		return v.Kind() == reflect.String
+	case AttributeTypeInt:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint32, reflect.Uint64:
+			return true
+		case reflect.Float32, reflect.Float64:
+			return v.Float() == math.Trunc(v.Float()) && math.Abs(v.Float()) < math.MaxInt64
+		case reflect.String:
+			_, err := strconv.ParseInt(strings.TrimSpace(v.String()), 10, 64)
+			return err == nil
+		}
+	case AttributeTypeBool:
+		switch v.Kind() {
+		case reflect.Bool:
+			return true
+		case reflect.String:
+			return v.String() == "true" || v.String() == "false"
+		}
+	}
+	return false
+}
+
+// isResponseSource reports whether a source is read from the auth response rather than its body.
+func isResponseSource(source string) bool {
+	return source == SourceStatus || strings.HasPrefix(source, SourceHeaderPrefix)
+}
+
+func lookupSource(data map[string]interface{}, response *mappedResponse, source string) (interface{}, bool) {
+	switch {
+	case source == SourceStatus:
+		if response == nil || response.statusCode == 0 {
+			return nil, false
+		}
+		// As a number, like the body attributes decoded from JSON.
+		return float64(response.statusCode), true
+	case strings.HasPrefix(source, SourceHeaderPrefix):
+		if response == nil {
+			return nil, false
+		}
+		return lookupHeader(response.headers, strings.TrimPrefix(source, SourceHeaderPrefix))
+	}
+	return lookupPath(data, source)
+}
+
+func lookupHeader(headers http.Header, name string) (interface{}, bool) {
+	values, ok := headers[http.CanonicalHeaderKey(name)]
+	if !ok || len(values) == 0 {
+		return nil, false
+	}
+	return values[0], true
+}
+
+func lookupPath(data map[string]interface{}, path string) (interface{}, bool) {
+	if raw, ok := data[path]; ok {
+		return raw, true
+	}
+	if isJsonPath(path) {
+		return lookupJsonPath(data, path)
+	}
+
+	return lookupSegments(data, strings.Split(path, "."))
+}
+
+// lookupSegments resolves the remaining path segments against current. A segment suffixed with
+// "[]" must name an array; the rest of the path is resolved against each of its elements and the
+// present values are collected, so "grants[].scope" yields the scope of every grant. Such a path
+// is absent when no element has the value.
+func lookupSegments(current interface{}, segments []string) (interface{}, bool) {
+	for i, segment := range segments {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if !strings.HasSuffix(segment, ArraySegmentSuffix) {
+			if current, ok = object[segment]; !ok {
+				return nil, false
+			}
+			continue
+		}
+
+		elements, ok := object[strings.TrimSuffix(segment, ArraySegmentSuffix)].([]interface{})
+		if !ok {
+			return nil, false
+		}
+		var values []interface{}
+		for _, element := range elements {
+			if value, ok := lookupSegments(element, segments[i+1:]); ok {
+				values = append(values, value)
+			}
+		}
+		return values, len(values) > 0
+	}
+	return current, true
+}
+
+func (t *Transform) applyRaw(raw interface{}) interface{} {
+	if t == nil || !t.Negate {
+		return raw
+	}
+	if b, ok := raw.(bool); ok {
+		return !b
+	}
+	return raw
+}
+
+func (t *Transform) stringify(raw interface{}) *string {
+	if t == nil || (t.Decimals == nil && t.Delimiter == "" && t.Encoding == "" && !t.Json && t.Epoch == "") {
+		return stringifyValue(raw)
+	}
+	if _, ok := raw.([]interface{}); !ok && t.Epoch != "" {
+		return formatEpoch(raw, t.Epoch)
+	}
+	switch v := raw.(type) {
+	case map[string]interface{}:
+		if t.Json || t.Encoding != "" {
+			return stringifyJson(v)
+		}
+	case float64:
+		if t.Decimals != nil {
+			value := strconv.FormatFloat(v, 'f', *t.Decimals, 64)
+			return &value
+		}
+	case []interface{}:
+		delimiter := t.Delimiter
+		if delimiter == "" {
+			delimiter = DefaultDelimiter
+		}
+		var values []string
+		for _, element := range v {
+			if s := t.stringify(element); s != nil {
+				values = append(values, *s)
+			}
+		}
+		value := strings.Join(values, delimiter)
+		return &value
+	}
+	return stringifyValue(raw)
+}
+
+func (t *Transform) apply(value string) string {
+	if t == nil {
+		return value
+	}
+	if replacement, ok := t.Values[value]; ok {
+		value = replacement
+	}
+	if t.Trim {
+		value = strings.TrimSpace(value)
+	}
+	if t.Lower {
+		value = strings.ToLower(value)
+	}
+	if t.Upper {
+		value = strings.ToUpper(value)
+	}
+	switch t.Encoding {
+	case EncodingBase64:
+		value = base64.StdEncoding.EncodeToString([]byte(value))
+	case EncodingBase64Url:
+		value = base64.RawURLEncoding.EncodeToString([]byte(value))
+	case EncodingUrl:
+		value = url.QueryEscape(value)
+	}
+	return t.Prefix + value + t.Suffix
+}
+
+// formatEpoch formats a Unix timestamp in the unit of epoch, a number or numeric string, as an
+// RFC3339 UTC date. It returns nil for other values and timestamps that are negative or too large.
+func formatEpoch(raw interface{}, epoch string) *string {
+	var timestamp float64
+	switch v := raw.(type) {
+	case float64:
+		timestamp = v
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil
+		}
+		timestamp = parsed
+	default:
+		return nil
+	}
+	unit := time.Second
+	if epoch == EpochMillis {
+		unit = time.Millisecond
+	}
+	if math.IsNaN(timestamp) || timestamp < 0 || timestamp >= math.MaxInt64/float64(unit) {
+		return nil
+	}
+	value := time.Unix(0, int64(timestamp*float64(unit))).UTC().Format(time.RFC3339)
+	return &value
+}
+
+// stringifyJson serializes an object attribute to compact JSON, with its keys sorted.
+func stringifyJson(raw interface{}) *string {
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil
+	}
+	value := string(encoded)
+	return &value
+}
+
+// sanitizeHeaderValue strips control characters other than tab, such as CR and LF, which would
+// otherwise let the auth response inject headers. It reports false when anything was stripped.
+func sanitizeHeaderValue(value string) (string, bool) {
+	if strings.IndexFunc(value, isControlCharacter) < 0 {
+		return value, true
+	}
+	return strings.Map(func(r rune) rune {
+		if isControlCharacter(r) {
+			return -1
+		}
+		return r
+	}, value), false
+}
+
+func isControlCharacter(r rune) bool {
+	return (r < 0x20 && r != '\t') || r == 0x7f
+}
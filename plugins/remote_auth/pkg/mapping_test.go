@@ -0,0 +1,547 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMappingWithNestedSourceAndTransform(t *testing.T) {
+	body := "{\"user\": {\"id\": \"  ABC123 \", \"org\": {\"name\": \"Tidepool\"}}, \"plan\": \"premium\"}"
+	mappings := []Mapping{
+		{Source: "user.id", Target: Target{Name: "x-auth-subject-id"}, Transform: &Transform{Trim: true, Lower: true}},
+		{Source: "user.org.name", Target: Target{Type: TargetTypeMetadata, Name: "org"}},
+		{Source: "user.missing", Target: Target{Name: "x-auth-missing"}},
+	}
+
+	extracted, err := extractResponseAttributes(strings.NewReader(body), mappings)
+	if err != nil {
+		t.Fatalf("unable to extract attributes: %v", err)
+	}
+	if len(extracted.headers) != 1 {
+		t.Fatalf("expected 1 header, got %v", len(extracted.headers))
+	}
+	if h := extracted.headers[0].Header; h.Key != "x-auth-subject-id" || h.Value != "abc123" {
+		t.Errorf("unexpected header %v: %v", h.Key, h.Value)
+	}
+	if extracted.metadata == nil || extracted.metadata.Fields["org"].GetStringValue() != "Tidepool" {
+		t.Errorf("expected org metadata to be Tidepool, got %v", extracted.metadata)
+	}
+}
+
+func TestMappingsFromResponseHeadersAreBackwardCompatible(t *testing.T) {
+	body := "{\"userid\": \"123456\", \"isserver\": true, \"user.name\": \"dotted\"}"
+	attr := map[string]string{
+		"userid":    "x-auth-subject-id",
+		"isserver":  "x-auth-server-access",
+		"user.name": "x-auth-user-name",
+	}
+
+	extracted, err := extractResponseAttributes(strings.NewReader(body), mappingsFromResponseHeaders(attr))
+	if err != nil {
+		t.Fatalf("unable to extract attributes: %v", err)
+	}
+	expectations := []struct{ key, value string }{
+		{"x-auth-server-access", "true"},
+		{"x-auth-subject-id", "123456"},
+		{"x-auth-user-name", "dotted"},
+	}
+	if len(extracted.headers) != len(expectations) {
+		t.Fatalf("expected %v headers, got %v", len(expectations), len(extracted.headers))
+	}
+	for i, expected := range expectations {
+		if h := extracted.headers[i].Header; h.Key != expected.key || h.Value != expected.value {
+			t.Errorf("expected header %v to be %v: %v, got %v: %v", i, expected.key, expected.value, h.Key, h.Value)
+		}
+	}
+	if extracted.metadata != nil {
+		t.Errorf("expected no metadata, got %v", extracted.metadata)
+	}
+}
+
+func TestValidateMapping(t *testing.T) {
+	invalid := []Mapping{
+		{Target: Target{Name: "x-header"}},
+		{Source: "userid"},
+		{Source: "userid", Target: Target{Type: "cookie", Name: "x-header"}},
+		{Source: "userid", Target: Target{Name: "x-header"}, Transform: &Transform{Lower: true, Upper: true}},
+	}
+	for _, mapping := range invalid {
+		if err := validateMapping(mapping); err == nil {
+			t.Errorf("expected mapping %+v to be invalid", mapping)
+		}
+	}
+	if err := validateMapping(Mapping{Source: "userid", Target: Target{Name: "x-header"}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMappingTransformNegatesAndMapsValues(t *testing.T) {
+	body := "{\"blocked\": true, \"verified\": false, \"name\": \"tidepool\"}"
+	mappings := []Mapping{
+		{Source: "blocked", Target: Target{Name: "x-auth-allowed"}, Transform: &Transform{Negate: true}},
+		{Source: "verified", Target: Target{Name: "x-auth-verified"}, Transform: &Transform{
+			Values: map[string]string{"true": "allow", "false": "deny"},
+		}},
+		{Source: "blocked", Target: Target{Name: "x-auth-decision"}, Transform: &Transform{
+			Negate: true,
+			Values: map[string]string{"true": "allow", "false": "deny"},
+		}},
+		{Source: "name", Target: Target{Name: "x-auth-name"}, Transform: &Transform{Negate: true}},
+	}
+
+	extracted, err := extractResponseAttributes(strings.NewReader(body), mappings)
+	if err != nil {
+		t.Fatalf("unable to extract attributes: %v", err)
+	}
+	expectations := map[string]string{
+		"x-auth-allowed":  "false",
+		"x-auth-verified": "deny",
+		"x-auth-decision": "deny",
+		"x-auth-name":     "tidepool",
+	}
+	if len(extracted.headers) != len(expectations) {
+		t.Fatalf("expected %v headers, got %v", len(expectations), len(extracted.headers))
+	}
+	for _, h := range extracted.headers {
+		if expected := expectations[h.Header.Key]; h.Header.Value != expected {
+			t.Errorf("expected header %v to be %v, got %v", h.Header.Key, expected, h.Header.Value)
+		}
+	}
+}
+
+func TestMappingUsesFirstPresentCandidate(t *testing.T) {
+	attr := map[string]string{"userid|sub": "x-auth-subject-id"}
+	bodies := map[string]string{
+		"{\"userid\": \"123456\", \"sub\": \"abcdef\"}": "123456",
+		"{\"sub\": \"abcdef\"}":                         "abcdef",
+		"{\"userid\": null, \"sub\": \"abcdef\"}":       "abcdef",
+	}
+	for body, expected := range bodies {
+		extracted, err := extractResponseAttributes(strings.NewReader(body), mappingsFromResponseHeaders(attr))
+		if err != nil {
+			t.Fatalf("unable to extract attributes: %v", err)
+		}
+		if len(extracted.headers) != 1 || extracted.headers[0].Header.Value != expected {
+			t.Errorf("expected subject id %v for %v, got %v", expected, body, extracted.headers)
+		}
+	}
+
+	extracted, err := extractResponseAttributes(strings.NewReader("{\"email\": \"a@b.c\"}"), mappingsFromResponseHeaders(attr))
+	if err != nil {
+		t.Fatalf("unable to extract attributes: %v", err)
+	}
+	if len(extracted.headers) != 0 {
+		t.Errorf("expected no headers when no candidate is present, got %v", extracted.headers)
+	}
+}
+
+func TestMappingFromResponseHeader(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("X-Subject", "123456")
+	mappings := mappingsFromResponseHeaders(map[string]string{
+		"header:x-subject":   "x-auth-subject-id",
+		"header:x-missing":   "x-auth-missing",
+		"header:x-plan|plan": "x-auth-plan",
+	})
+
+	extracted := applyMappings(map[string]interface{}{"plan": "premium"}, &mappedResponse{headers: headers}, mappings)
+	expectations := []struct{ key, value string }{
+		{"x-auth-plan", "premium"},
+		{"x-auth-subject-id", "123456"},
+	}
+	if len(extracted.headers) != len(expectations) {
+		t.Fatalf("expected %v headers, got %v", len(expectations), len(extracted.headers))
+	}
+	for i, expected := range expectations {
+		if h := extracted.headers[i].Header; h.Key != expected.key || h.Value != expected.value {
+			t.Errorf("expected header %v to be %v: %v, got %v: %v", i, expected.key, expected.value, h.Key, h.Value)
+		}
+	}
+	if err := validateMapping(Mapping{Source: SourceHeaderPrefix, Target: Target{Name: "x-header"}}); err == nil {
+		t.Error("expected a header source without a name to be invalid")
+	}
+}
+
+func TestMappingFallbackChain(t *testing.T) {
+	mappings := mappingsFromResponseHeaders(map[string]string{"userid|sub|header:x-subject|default:anonymous": "x-auth-subject-id"})
+	tests := []struct {
+		name     string
+		data     map[string]interface{}
+		header   string
+		expected string
+	}{
+		{"first body attribute", map[string]interface{}{"userid": "123", "sub": "456"}, "789", "123"},
+		{"second body attribute", map[string]interface{}{"sub": "456"}, "789", "456"},
+		{"response header", map[string]interface{}{}, "789", "789"},
+		{"static default", map[string]interface{}{}, "", "anonymous"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := http.Header{}
+			if test.header != "" {
+				headers.Set("X-Subject", test.header)
+			}
+			extracted := applyMappings(test.data, &mappedResponse{headers: headers}, mappings)
+			if len(extracted.headers) != 1 || extracted.headers[0].Header.Value != test.expected {
+				t.Errorf("expected subject id %v, got %v", test.expected, extracted.headers)
+			}
+		})
+	}
+	if err := validateMapping(Mapping{Source: "userid", Sources: []string{"default:anonymous"}, Target: Target{Name: "x-header"}}); err == nil {
+		t.Error("expected a static value as a source to be invalid")
+	}
+}
+
+func TestMappingAppendMode(t *testing.T) {
+	service := newAuthService(t, &Config{
+		AuthUrl:               "http://auth",
+		ResponseHeaders:       map[string]string{"userid": "x-auth-subject-id", "role": "x-roles"},
+		AppendResponseHeaders: []string{"x-roles"},
+	})
+	extracted := applyMappings(map[string]interface{}{"userid": "123", "role": "admin"}, nil, service.Mappings)
+	if len(extracted.headers) != 2 {
+		t.Fatalf("expected 2 headers, got %v", extracted.headers)
+	}
+	for _, h := range extracted.headers {
+		if h.Append == nil {
+			t.Errorf("expected append to be set explicitly for %v", h.Header.Key)
+		} else if expected := h.Header.Key == "x-roles"; h.Append.Value != expected {
+			t.Errorf("expected append %v for %v, got %v", expected, h.Header.Key, h.Append.Value)
+		}
+	}
+}
+
+func TestMappingRepeatMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		repeated []string
+		expected []string
+	}{
+		{"joined by default", nil, []string{"x-auth-subject-id: 123 (false)", "x-role: admin,clinic (false)"}},
+		{"repeated", []string{"x-role"}, []string{"x-auth-subject-id: 123 (false)", "x-role: admin (false)", "x-role: clinic (true)"}},
+		{"repeated single value", []string{"x-auth-subject-id"}, []string{"x-role: admin,clinic (false)", "x-auth-subject-id: 123 (false)"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := newAuthService(t, &Config{
+				AuthUrl:                 "http://auth",
+				ResponseHeaders:         map[string]string{"userid": "x-auth-subject-id", "roles": "x-role"},
+				RepeatedResponseHeaders: test.repeated,
+			})
+			extracted := applyMappings(map[string]interface{}{"userid": "123", "roles": []interface{}{"admin", nil, "clinic"}}, nil, service.Mappings)
+			var headers []string
+			for _, h := range append(extracted.headers, extracted.repeatedHeaders...) {
+				headers = append(headers, fmt.Sprintf("%s: %s (%v)", h.Header.Key, h.Header.Value, h.Append.Value))
+			}
+			if strings.Join(headers, "\n") != strings.Join(test.expected, "\n") {
+				t.Errorf("expected headers %v, got %v", test.expected, headers)
+			}
+		})
+	}
+
+	if err := validateMapping(Mapping{Source: "roles", Target: Target{Type: TargetTypeMetadata, Name: "roles", Repeat: true}}); err == nil {
+		t.Error("expected a repeated metadata target to be invalid")
+	}
+}
+
+func TestMappingObjectsAsJson(t *testing.T) {
+	data := map[string]interface{}{
+		"userid": "123",
+		"profile": map[string]interface{}{
+			"name":    "Jane Doe",
+			"clinic":  map[string]interface{}{"id": "c1", "roles": []interface{}{"admin", "member"}},
+			"patient": false,
+		},
+	}
+	config := &Config{
+		AuthUrl:         "http://auth",
+		ResponseHeaders: map[string]string{"userid": "x-auth-subject-id", "profile": "x-auth-profile"},
+	}
+	if extracted := applyMappings(data, nil, newAuthService(t, config).Mappings); len(extracted.headers) != 1 {
+		t.Errorf("expected the object attribute to be skipped by default, got %v", extracted.headers)
+	}
+
+	config.ObjectAttributesAsJson = true
+	extracted := applyMappings(data, nil, newAuthService(t, config).Mappings)
+	headers := map[string]string{}
+	for _, h := range extracted.headers {
+		headers[h.Header.Key] = h.Header.Value
+	}
+	if expected := "{\"clinic\":{\"id\":\"c1\",\"roles\":[\"admin\",\"member\"]},\"name\":\"Jane Doe\",\"patient\":false}"; headers["x-auth-profile"] != expected {
+		t.Errorf("expected profile %s, got %s", expected, headers["x-auth-profile"])
+	}
+	if headers["x-auth-subject-id"] != "123" {
+		t.Errorf("expected the subject id to be unchanged, got %q", headers["x-auth-subject-id"])
+	}
+
+	single := applyMappings(data, nil, []Mapping{{Source: "profile.clinic", Target: Target{Name: "x-clinic"}, Transform: &Transform{Json: true}}})
+	if len(single.headers) != 1 || single.headers[0].Header.Value != "{\"id\":\"c1\",\"roles\":[\"admin\",\"member\"]}" {
+		t.Errorf("expected the clinic as JSON, got %v", single.headers)
+	}
+}
+
+func TestMergeDuplicateHeaders(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected []string
+	}{
+		{"", []string{"x-auth-subject-id: 123", "x-auth-plan: premium"}},
+		{DuplicateHeadersFirst, []string{"x-auth-subject-id: 123", "x-auth-plan: premium"}},
+		{DuplicateHeadersLast, []string{"X-Auth-Subject-Id: abc", "x-auth-plan: premium"}},
+		{DuplicateHeadersJoin, []string{"x-auth-subject-id: 123,abc", "x-auth-plan: premium"}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			mappings := []Mapping{
+				{Source: "userid", Target: Target{Name: "x-auth-subject-id"}},
+				{Source: "plan", Target: Target{Name: "x-auth-plan"}},
+				{Source: "sub", Target: Target{Name: "X-Auth-Subject-Id"}},
+			}
+			extracted := applyMappings(map[string]interface{}{"userid": "123", "plan": "premium", "sub": "abc"}, nil, mappings)
+			var headers []string
+			for _, h := range mergeDuplicateHeaders(extracted.headers, test.policy) {
+				headers = append(headers, h.Header.Key+": "+h.Header.Value)
+			}
+			if strings.Join(headers, "\n") != strings.Join(test.expected, "\n") {
+				t.Errorf("expected headers %v, got %v", test.expected, headers)
+			}
+		})
+	}
+}
+
+func TestMappingNullValue(t *testing.T) {
+	data := map[string]interface{}{"userid": nil, "plan": nil}
+	empty, anonymous := "", "anonymous"
+	tests := []struct {
+		name      string
+		nullValue *string
+		expected  []string
+	}{
+		{"omitted", nil, []string{"x-auth-plan: anonymous"}},
+		{"empty", &empty, []string{"x-auth-plan: ", "x-auth-subject-id: "}},
+		{"placeholder", &anonymous, []string{"x-auth-plan: anonymous", "x-auth-subject-id: anonymous"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := newAuthService(t, &Config{
+				AuthUrl:                 "http://auth",
+				ResponseHeaders:         map[string]string{"userid": "x-auth-subject-id", "plan": "x-auth-plan"},
+				ResponseHeaderDefaults:  map[string]string{"x-auth-plan": "anonymous"},
+				ResponseHeaderNullValue: test.nullValue,
+			})
+			extracted := applyMappings(data, nil, service.Mappings)
+			var headers []string
+			for _, h := range extracted.headers {
+				headers = append(headers, h.Header.Key+": "+h.Header.Value)
+			}
+			if strings.Join(headers, "\n") != strings.Join(test.expected, "\n") {
+				t.Errorf("expected headers %v, got %v", test.expected, headers)
+			}
+		})
+	}
+
+	required := Mapping{Source: "userid", Target: Target{Name: "x-auth-subject-id"}, Required: true, NullValue: &empty}
+	if extracted := applyMappings(data, nil, []Mapping{required}); len(extracted.missingRequired) != 1 {
+		t.Errorf("expected a null required attribute to be missing, got %v", extracted.headers)
+	}
+}
+
+func TestMappingDefaultWhenAttributeIsAbsent(t *testing.T) {
+	anonymous := "anonymous"
+	mappings := []Mapping{
+		{Source: "userid", Target: Target{Name: "x-auth-subject-id"}, Transform: &Transform{Upper: true}, Default: &anonymous},
+		{Source: "plan", Target: Target{Name: "x-auth-plan"}},
+	}
+
+	extracted := applyMappings(map[string]interface{}{}, nil, mappings)
+	if len(extracted.headers) != 1 || extracted.headers[0].Header.Value != "anonymous" {
+		t.Errorf("expected only the defaulted header, got %v", extracted.headers)
+	}
+	extracted = applyMappings(map[string]interface{}{"userid": "abc"}, nil, mappings)
+	if len(extracted.headers) != 1 || extracted.headers[0].Header.Value != "ABC" {
+		t.Errorf("expected the transformed attribute over the default, got %v", extracted.headers)
+	}
+}
+
+func TestMappingTransformFormatsNumbers(t *testing.T) {
+	integer, fixed := 0, 2
+	body := "{\"exp\": 1700000000, \"balance\": 12.5, \"count\": 3, \"name\": \"tidepool\"}"
+	mappings := []Mapping{
+		{Source: "exp", Target: Target{Name: "x-auth-exp"}, Transform: &Transform{Decimals: &integer}},
+		{Source: "balance", Target: Target{Name: "x-auth-balance"}, Transform: &Transform{Decimals: &fixed}},
+		{Source: "count", Target: Target{Name: "x-auth-count"}},
+		{Source: "name", Target: Target{Name: "x-auth-name"}, Transform: &Transform{Decimals: &integer}},
+	}
+
+	extracted, err := extractResponseAttributes(strings.NewReader(body), mappings)
+	if err != nil {
+		t.Fatalf("unable to extract attributes: %v", err)
+	}
+	expectations := []string{"1700000000", "12.50", "3", "tidepool"}
+	if len(extracted.headers) != len(expectations) {
+		t.Fatalf("expected %v headers, got %v", len(expectations), len(extracted.headers))
+	}
+	for i, expected := range expectations {
+		if h := extracted.headers[i].Header; h.Value != expected {
+			t.Errorf("expected header %v to be %v, got %v", h.Key, expected, h.Value)
+		}
+	}
+
+	negative := -1
+	if err := validateTransform(&Transform{Decimals: &negative}); err == nil {
+		t.Error("expected negative decimals to be invalid")
+	}
+}
+
+func TestMappingTransformFormatsEpochs(t *testing.T) {
+	body := "{\"exp\": 1700000000, \"iat\": \"1699996400\", \"updated\": 1700000000123, \"revoked\": -1, \"name\": \"tidepool\", \"sessions\": [1700000000, 1700003600]}"
+	seconds, millis := &Transform{Epoch: EpochSeconds}, &Transform{Epoch: EpochMillis}
+	mappings := []Mapping{
+		{Source: "exp", Target: Target{Name: "x-auth-exp"}, Transform: seconds},
+		{Source: "iat", Target: Target{Name: "x-auth-iat"}, Transform: seconds},
+		{Source: "updated", Target: Target{Name: "x-auth-updated"}, Transform: millis},
+		{Source: "revoked", Target: Target{Name: "x-auth-revoked"}, Transform: seconds},
+		{Source: "name", Target: Target{Name: "x-auth-name"}, Transform: seconds},
+		{Source: "sessions", Target: Target{Name: "x-auth-sessions"}, Transform: seconds},
+	}
+
+	extracted, err := extractResponseAttributes(strings.NewReader(body), mappings)
+	if err != nil {
+		t.Fatalf("unable to extract attributes: %v", err)
+	}
+	expectations := map[string]string{
+		"x-auth-exp":      "2023-11-14T22:13:20Z",
+		"x-auth-iat":      "2023-11-14T21:13:20Z",
+		"x-auth-updated":  "2023-11-14T22:13:20Z",
+		"x-auth-sessions": "2023-11-14T22:13:20Z,2023-11-14T23:13:20Z",
+	}
+	if len(extracted.headers) != len(expectations) {
+		t.Fatalf("expected %v headers, got %v", len(expectations), extracted.headers)
+	}
+	for _, header := range extracted.headers {
+		if expected := expectations[header.Header.Key]; header.Header.Value != expected {
+			t.Errorf("expected header %v to be %v, got %v", header.Header.Key, expected, header.Header.Value)
+		}
+	}
+
+	if err := validateTransform(&Transform{Epoch: "minutes"}); err == nil {
+		t.Error("expected an unknown epoch to be invalid")
+	}
+}
+
+func TestMappingChecksAttributeTypes(t *testing.T) {
+	body := "{\"age\": 42, \"zip\": \"02134\", \"height\": 1.8, \"admin\": \"yes\", \"active\": true, \"teams\": [1, \"two\"], \"name\": 7}"
+	mappings := []Mapping{
+		{Source: "age", Target: Target{Name: "x-auth-age"}, Type: AttributeTypeInt},
+		{Source: "zip", Target: Target{Name: "x-auth-zip"}, Type: AttributeTypeInt},
+		{Source: "height", Target: Target{Name: "x-auth-height"}, Type: AttributeTypeInt},
+		{Source: "admin", Target: Target{Name: "x-auth-admin"}, Type: AttributeTypeBool, Required: true},
+		{Source: "active", Target: Target{Name: "x-auth-active"}, Type: AttributeTypeBool},
+		{Source: "teams", Target: Target{Name: "x-auth-teams"}, Type: AttributeTypeInt},
+		{Source: "name", Target: Target{Name: "x-auth-name"}, Type: AttributeTypeString},
+		{Source: "missing", Target: Target{Name: "x-auth-missing"}, Type: AttributeTypeString},
+	}
+
+	extracted, err := extractResponseAttributes(strings.NewReader(body), mappings)
+	if err != nil {
+		t.Fatalf("unable to extract attributes: %v", err)
+	}
+	expectations := map[string]string{"x-auth-age": "42", "x-auth-zip": "02134", "x-auth-active": "true"}
+	if len(extracted.headers) != len(expectations) {
+		t.Fatalf("expected %v headers, got %v", len(expectations), extracted.headers)
+	}
+	for _, header := range extracted.headers {
+		if expected := expectations[header.Header.Key]; header.Header.Value != expected {
+			t.Errorf("expected header %v to be %v, got %v", header.Header.Key, expected, header.Header.Value)
+		}
+	}
+	if expected := []string{"height", "admin", "teams", "name"}; !reflect.DeepEqual(extracted.mistyped, expected) {
+		t.Errorf("expected mistyped %v, got %v", expected, extracted.mistyped)
+	}
+	if expected := []string{"admin"}; !reflect.DeepEqual(extracted.mistypedRequired, expected) {
+		t.Errorf("expected mistyped required %v, got %v", expected, extracted.mistypedRequired)
+	}
+}
+
+func TestMappingCollectsArrayElements(t *testing.T) {
+	body := "{\"grants\": [{\"scope\": \"read\"}, {\"other\": true}, {\"scope\": \"write\"}], \"roles\": [], \"teams\": [{\"ids\": [1, 2]}, {\"ids\": [3]}]}"
+	mappings := []Mapping{
+		{Source: "grants[].scope", Target: Target{Name: "x-auth-scopes"}},
+		{Source: "grants[].scope", Target: Target{Name: "x-auth-scope-list"}, Transform: &Transform{Delimiter: " "}},
+		{Source: "roles[].name", Target: Target{Name: "x-auth-roles"}},
+		{Source: "grants[].missing", Target: Target{Name: "x-auth-missing"}},
+		{Source: "teams[].ids", Target: Target{Name: "x-auth-team-ids"}},
+	}
+
+	extracted, err := extractResponseAttributes(strings.NewReader(body), mappings)
+	if err != nil {
+		t.Fatalf("unable to extract attributes: %v", err)
+	}
+	expectations := map[string]string{
+		"x-auth-scopes":     "read,write",
+		"x-auth-scope-list": "read write",
+		"x-auth-team-ids":   "1,2,3",
+	}
+	if len(extracted.headers) != len(expectations) {
+		t.Fatalf("expected %v headers, got %v", len(expectations), len(extracted.headers))
+	}
+	for _, header := range extracted.headers {
+		if expected := expectations[header.Header.Key]; header.Header.Value != expected {
+			t.Errorf("expected header %v to be %v, got %v", header.Header.Key, expected, header.Header.Value)
+		}
+	}
+}
+
+func TestSanitizeHeaderValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		clean    bool
+	}{
+		{"user\t1234", "user\t1234", true},
+		{"1234\r\nx-injected: true", "1234x-injected: true", false},
+		{"12\x0034\x7f", "1234", false},
+	}
+	for _, test := range tests {
+		sanitized, clean := sanitizeHeaderValue(test.value)
+		if sanitized != test.expected || clean != test.clean {
+			t.Errorf("expected %q to sanitize to %q (clean %v), got %q (clean %v)", test.value, test.expected, test.clean, sanitized, clean)
+		}
+	}
+}
+
+func TestMappingConditions(t *testing.T) {
+	mappings := withConditions([]Mapping{
+		{Source: "userid", Target: Target{Name: "x-auth-subject-id"}},
+		{Source: "clinic", Target: Target{Name: "x-auth-clinic-id"}, When: map[string]string{"plan": "^premium$"}, Required: true},
+		{Source: "userid", Target: Target{Name: "x-auth-verified-id"}, When: map[string]string{"plan": "^premium$", "verified": "^true$"}},
+	})
+	tests := []struct {
+		body     string
+		expected []string
+	}{
+		{"{\"userid\": \"1234\", \"plan\": \"premium\", \"clinic\": \"c1\", \"verified\": true}", []string{"x-auth-subject-id: 1234", "x-auth-clinic-id: c1", "x-auth-verified-id: 1234"}},
+		{"{\"userid\": \"1234\", \"plan\": \"premium\", \"clinic\": \"c1\"}", []string{"x-auth-subject-id: 1234", "x-auth-clinic-id: c1"}},
+		{"{\"userid\": \"1234\", \"plan\": \"basic\", \"clinic\": \"c1\", \"verified\": true}", []string{"x-auth-subject-id: 1234"}},
+		{"{\"userid\": \"1234\", \"clinic\": \"c1\"}", []string{"x-auth-subject-id: 1234"}},
+	}
+	for _, test := range tests {
+		extracted, err := extractResponseAttributes(strings.NewReader(test.body), mappings)
+		if err != nil {
+			t.Fatalf("%v: unable to extract attributes: %v", test.body, err)
+		}
+		var headers []string
+		for _, h := range extracted.headers {
+			headers = append(headers, h.Header.Key+": "+h.Header.Value)
+		}
+		if strings.Join(headers, "\n") != strings.Join(test.expected, "\n") {
+			t.Errorf("%v: expected headers %v, got %v", test.body, test.expected, headers)
+		}
+		if len(extracted.missingRequired) > 0 {
+			t.Errorf("%v: expected unmet conditions not to require the mapping, got %v", test.body, extracted.missingRequired)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"errors"
+	"regexp"
+)
+
+// attributeMatcher requires an auth response attribute to match a pattern, see
+// Config.RequiredAttributeMatches.
+type attributeMatcher struct {
+	attribute string
+	pattern   *regexp.Regexp
+}
+
+// newAttributeMatchers compiles the patterns, ordered by attribute so the rule reported as failing
+// doesn't depend on map iteration order. The patterns were checked by validateConfig.
+func newAttributeMatchers(matches map[string]string) []attributeMatcher {
+	var matchers []attributeMatcher
+	for _, attribute := range sortedKeys(matches) {
+		matchers = append(matchers, attributeMatcher{attribute: attribute, pattern: regexp.MustCompile(matches[attribute])})
+	}
+	return matchers
+}
+
+// unmatchedAttribute returns the first matcher whose attribute is missing from data or doesn't
+// match its pattern, or nil when they all match. Arrays are matched joined with DefaultDelimiter.
+func unmatchedAttribute(data map[string]interface{}, matchers []attributeMatcher) *attributeMatcher {
+	for i, matcher := range matchers {
+		raw, ok := lookupPath(data, matcher.attribute)
+		if !ok || raw == nil {
+			return &matchers[i]
+		}
+		value := stringifyValue(raw)
+		if value == nil || !matcher.pattern.MatchString(*value) {
+			return &matchers[i]
+		}
+	}
+	return nil
+}
+
+// validateAttributeMatch checks an attribute path and the pattern it must match.
+func validateAttributeMatch(attribute string, pattern string) error {
+	if attribute == "" {
+		return errors.New("attribute is required")
+	}
+	if err := validateAttributePath(attribute); err != nil {
+		return err
+	}
+	_, err := regexp.Compile(pattern)
+	return err
+}
@@ -0,0 +1,52 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeRequiresAttributeMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		allowed bool
+	}{
+		{"matching", "{\"scope\": \"api:read\", \"roles\": [\"clinic\", \"admin\"]}", true},
+		{"mismatched scope", "{\"scope\": \"web:read\", \"roles\": [\"admin\"]}", false},
+		{"mismatched array", "{\"scope\": \"api:read\", \"roles\": [\"clinic\"]}", false},
+		{"missing attribute", "{\"roles\": [\"admin\"]}", false},
+		{"null attribute", "{\"scope\": null, \"roles\": [\"admin\"]}", false},
+		{"undecodable body", "not json", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, test.body)
+			}))
+			defer server.Close()
+
+			service := newAuthService(t, &Config{
+				AuthUrl:                  server.URL,
+				RequiredAttributeMatches: map[string]string{"scope": "^api:", "roles": "(^|,)admin(,|$)"},
+			})
+			response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+			if allowed := err == nil && isAllowedResponse(response); allowed != test.allowed {
+				t.Errorf("expected allowed to be %v, got %v (%v)", test.allowed, allowed, err)
+			}
+		})
+	}
+}
+
+func TestUnmatchedAttributeReportsFirstFailedRule(t *testing.T) {
+	matchers := newAttributeMatchers(map[string]string{"scope": "^api:", "audience": "^tidepool$"})
+	unmatched := unmatchedAttribute(map[string]interface{}{"scope": "web", "audience": "other"}, matchers)
+	if unmatched == nil || unmatched.attribute != "audience" {
+		t.Errorf("expected the audience rule to fail first, got %v", unmatched)
+	}
+	if unmatched := unmatchedAttribute(map[string]interface{}{"scope": "api:read", "audience": "tidepool"}, matchers); unmatched != nil {
+		t.Errorf("expected every rule to match, got %v", unmatched.attribute)
+	}
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"sync/atomic"
+)
+
+// Outcomes counted by DedupeMetrics.
+const (
+	// Decision served from the response cache.
+	OutcomeCacheHit = "cache_hit"
+	// Decision not in the response cache, or expired.
+	OutcomeCacheMiss = "cache_miss"
+	// Expired cached decision served by ServeStaleOnError.
+	OutcomeCacheStale = "cache_stale"
+	// Request that shared its auth call with concurrent identical requests.
+	OutcomeCoalesced = "coalesced"
+	// Request that made its own auth call with EnableRequestDeduplication.
+	OutcomeNotCoalesced = "not_coalesced"
+)
+
+// dedupeMetrics counts the outcomes of the response cache and request deduplication. The counters
+// are all created upfront, so recording only takes an atomic increment.
+type dedupeMetrics struct {
+	counts map[string]*uint64
+}
+
+func newDedupeMetrics() *dedupeMetrics {
+	counts := map[string]*uint64{}
+	for _, outcome := range []string{OutcomeCacheHit, OutcomeCacheMiss, OutcomeCacheStale, OutcomeCoalesced, OutcomeNotCoalesced} {
+		counts[outcome] = new(uint64)
+	}
+	return &dedupeMetrics{counts: counts}
+}
+
+// record counts an outcome; it's a no-op when metrics are disabled.
+func (m *dedupeMetrics) record(outcome string) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(m.counts[outcome], 1)
+}
+
+func (m *dedupeMetrics) snapshot() map[string]uint64 {
+	snapshot := make(map[string]uint64, len(m.counts))
+	for outcome, count := range m.counts {
+		snapshot[outcome] = atomic.LoadUint64(count)
+	}
+	return snapshot
+}
+
+// DedupeMetrics returns how many requests had each Outcome since the service was created, and
+// whether EnableMetrics is set.
+func (c *RemoteAuthService) DedupeMetrics() (map[string]uint64, bool) {
+	if c.metrics == nil {
+		return nil, false
+	}
+	return c.metrics.snapshot(), true
+}
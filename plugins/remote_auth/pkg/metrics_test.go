@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDedupeMetricsCountCacheOutcomes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-tidepool-session-token") == "denied" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"x-tidepool-session-token"},
+		CacheTTL:              "1m",
+		EnableMetrics:         true,
+	})
+	for _, token := range []string{"a", "a", "b", "denied", "denied", "a"} {
+		request := newAuthorizationRequest(map[string]string{"x-tidepool-session-token": token})
+		if _, err := service.Authorize(context.Background(), request); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	metrics, enabled := service.DedupeMetrics()
+	if !enabled {
+		t.Fatal("expected metrics to be enabled")
+	}
+	if metrics[OutcomeCacheHit] != 2 || metrics[OutcomeCacheMiss] != 4 || metrics[OutcomeCacheStale] != 0 {
+		t.Errorf("expected 2 cache hits and 4 misses, got %v", metrics)
+	}
+	if _, enabled := newAuthService(t, &Config{AuthUrl: server.URL}).DedupeMetrics(); enabled {
+		t.Error("expected metrics to be disabled by default")
+	}
+}
+
+func TestDedupeMetricsCountCoalescedRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:                    server.URL,
+		ForwardRequestHeaders:      []string{"x-tidepool-session-token"},
+		EnableRequestDeduplication: true,
+		EnableMetrics:              true,
+	})
+	tokens := []string{"a", "a", "a", "b"}
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(i int, token string) {
+			defer wg.Done()
+			request := newAuthorizationRequest(map[string]string{
+				"x-tidepool-session-token": token,
+				"x-request-id":             fmt.Sprintf("request-%d", i),
+			})
+			if _, err := service.Authorize(context.Background(), request); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(i, token)
+	}
+	wg.Wait()
+
+	if metrics, _ := service.DedupeMetrics(); metrics[OutcomeCoalesced] != 3 || metrics[OutcomeNotCoalesced] != 1 {
+		t.Errorf("expected 3 coalesced requests and 1 not coalesced, got %v", metrics)
+	}
+}
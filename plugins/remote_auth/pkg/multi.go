@@ -0,0 +1,279 @@
+package pkg
+
+import (
+	"context"
+	envoycorev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoyauthv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+const (
+	AuthUrlPolicyAll = "all"
+	AuthUrlPolicyAny = "any"
+
+	BodyMergeFirst = "first"
+	BodyMergeLast  = "last"
+	BodyMergeError = "error"
+)
+
+var BodyMergeConflictError = func(path string) error {
+	return &bodyMergeConflictError{path: path}
+}
+
+type bodyMergeConflictError struct {
+	path string
+}
+
+func (e *bodyMergeConflictError) Error() string {
+	return "conflicting values of attribute " + e.path + " in merged response bodies"
+}
+
+// decideAll calls AuthUrl and every AdditionalAuthUrls entry in parallel and combines their
+// decisions by AuthUrlPolicy. With "all", the default, every backend must allow: an error from any
+// backend fails the request, otherwise the first denial, in config order, is returned. With "any",
+// one allowing backend is enough and errors and denials of the others are ignored; when none
+// allows, the first denial is returned, or the first error if every backend failed.
+//
+// The headers and dynamic metadata of the allowing backends are merged in config order, AuthUrl
+// first: when several backends set the same header or metadata field, the earliest one wins. With
+// BodyMergePolicy, the response bodies are merged instead, see mergeBodies, and headers are only
+// extracted from the merged body, along with the response headers of AuthUrl.
+func (c *RemoteAuthService) decideAll(ctx context.Context, requestCtx context.Context, log *zap.SugaredLogger, authzRequest *api.AuthorizationRequest, span *span) (*api.AuthorizationResponse, error) {
+	responses := make([]*api.AuthorizationResponse, len(c.AdditionalAuthUrls)+1)
+	errs := make([]error, len(responses))
+	var merge *bodyMerge
+	if c.BodyMergePolicy != "" {
+		merge = newBodyMerge(len(responses), c.BodyMergePolicy)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(responses))
+	go func() {
+		defer wg.Done()
+		responses[0], errs[0] = c.decide(ctx, withBodyMergeSlot(requestCtx, merge, 0), log, authzRequest, span)
+	}()
+	for i, authUrl := range c.AdditionalAuthUrls {
+		go func(i int, authUrl string) {
+			defer wg.Done()
+			// A backend denying or failing before handing over its body is left out of the merge.
+			defer merge.finish(i, nil)
+			// The span isn't safe for concurrent use, so only the AuthUrl call is recorded.
+			responses[i], errs[i] = c.decideUrl(ctx, withBodyMergeSlot(requestCtx, merge, i), log.With("auth_url", authUrl), authUrl, "", authzRequest, nil)
+		}(i+1, authUrl)
+	}
+	wg.Wait()
+
+	if clientCancelled(ctx) {
+		return nil, ClientCancelledError
+	}
+	return combineDecisions(c.AuthUrlPolicy, responses, errs)
+}
+
+func combineDecisions(policy string, responses []*api.AuthorizationResponse, errs []error) (*api.AuthorizationResponse, error) {
+	var allowed []*api.AuthorizationResponse
+	var firstDenied *api.AuthorizationResponse
+	var firstErr error
+	for i, response := range responses {
+		switch {
+		case errs[i] != nil:
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+		case isAllowedResponse(response):
+			allowed = append(allowed, response)
+		case firstDenied == nil:
+			firstDenied = response
+		}
+	}
+
+	switch policy {
+	case AuthUrlPolicyAny:
+		if len(allowed) == 0 {
+			if firstDenied != nil {
+				return firstDenied, nil
+			}
+			return nil, firstErr
+		}
+	default:
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		if firstDenied != nil {
+			return firstDenied, nil
+		}
+	}
+	return mergeAllowedResponses(allowed), nil
+}
+
+func isAllowedResponse(response *api.AuthorizationResponse) bool {
+	return response.CheckResponse.GetStatus().GetCode() == int32(code.Code_OK)
+}
+
+func mergeAllowedResponses(responses []*api.AuthorizationResponse) *api.AuthorizationResponse {
+	var headers []*envoycorev2.HeaderValueOption
+	var metadata *structpb.Struct
+	seen := map[string]bool{}
+	for _, response := range responses {
+		ok := response.CheckResponse.GetOkResponse()
+		for _, header := range ok.GetHeaders() {
+			if key := header.GetHeader().GetKey(); !seen[key] {
+				seen[key] = true
+				headers = append(headers, header)
+			}
+		}
+		for key, value := range ok.GetDynamicMetadata().GetFields() {
+			if metadata == nil {
+				metadata = &structpb.Struct{Fields: map[string]*structpb.Value{}}
+			}
+			if _, exists := metadata.Fields[key]; !exists {
+				metadata.Fields[key] = value
+			}
+		}
+	}
+
+	merged := api.AuthorizedResponse()
+	merged.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_OkResponse{
+		OkResponse: &envoyauthv2.OkHttpResponse{
+			Headers:         headers,
+			DynamicMetadata: metadata,
+		},
+	}
+	return merged
+}
+
+type bodyMergeSlotKey struct{}
+
+// bodyMerge collects the decoded response bodies of AuthUrl and AdditionalAuthUrls for
+// BodyMergePolicy. The additional backends hand their body over instead of extracting headers from
+// it, and AuthUrl waits for every one of them to finish before extracting from the merged body.
+type bodyMerge struct {
+	policy   string
+	mu       sync.Mutex
+	bodies   []map[string]interface{}
+	finished []bool
+	pending  int
+	ready    chan struct{}
+}
+
+type bodyMergeSlot struct {
+	merge *bodyMerge
+	index int
+}
+
+func newBodyMerge(backends int, policy string) *bodyMerge {
+	merge := &bodyMerge{
+		policy:   policy,
+		bodies:   make([]map[string]interface{}, backends),
+		finished: make([]bool, backends),
+		pending:  backends - 1,
+		ready:    make(chan struct{}),
+	}
+	if merge.pending == 0 {
+		close(merge.ready)
+	}
+	return merge
+}
+
+// withBodyMergeSlot returns ctx carrying the index of a backend in merge, or ctx as is when merge
+// is nil.
+func withBodyMergeSlot(ctx context.Context, merge *bodyMerge, index int) context.Context {
+	if merge == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, bodyMergeSlotKey{}, bodyMergeSlot{merge, index})
+}
+
+func bodyMergeSlotFrom(ctx context.Context) (bodyMergeSlot, bool) {
+	slot, ok := ctx.Value(bodyMergeSlotKey{}).(bodyMergeSlot)
+	return slot, ok
+}
+
+// finish hands over the body of an additional backend, which is nil when it has none. Only the
+// first call for a backend counts.
+func (m *bodyMerge) finish(index int, body map[string]interface{}) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.finished[index] {
+		return
+	}
+	m.finished[index] = true
+	m.bodies[index] = body
+	if m.pending--; m.pending == 0 {
+		close(m.ready)
+	}
+}
+
+// merged waits for the additional backends, then merges their bodies into the body of AuthUrl.
+func (m *bodyMerge) merged(ctx context.Context, body map[string]interface{}) (map[string]interface{}, error) {
+	select {
+	case <-m.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return mergeBodies(append([]map[string]interface{}{body}, m.bodies[1:]...), m.policy)
+}
+
+// mergeBodies deeply merges response bodies in config order. Objects are merged key by key, while
+// other values, arrays included, are kept whole. When two bodies have different values at the same
+// path, the "first" policy keeps the earliest, "last" the latest, and "error" fails with a
+// BodyMergeConflictError. Equal values don't conflict.
+func mergeBodies(bodies []map[string]interface{}, policy string) (map[string]interface{}, error) {
+	merged := map[string]interface{}{}
+	for _, body := range bodies {
+		if err := mergeInto(merged, body, policy, ""); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+func mergeInto(dst map[string]interface{}, src map[string]interface{}, policy string, prefix string) error {
+	keys := make([]string, 0, len(src))
+	for key := range src {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := src[key]
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = value
+			continue
+		}
+		existingObject, existingIsObject := existing.(map[string]interface{})
+		valueObject, valueIsObject := value.(map[string]interface{})
+		if existingIsObject && valueIsObject {
+			// Merged into a copy, so the bodies being merged are left untouched.
+			copied := make(map[string]interface{}, len(existingObject))
+			for k, v := range existingObject {
+				copied[k] = v
+			}
+			if err := mergeInto(copied, valueObject, policy, prefix+key+"."); err != nil {
+				return err
+			}
+			dst[key] = copied
+			continue
+		}
+		if reflect.DeepEqual(existing, value) {
+			continue
+		}
+		switch policy {
+		case BodyMergeLast:
+			dst[key] = value
+		case BodyMergeError:
+			return BodyMergeConflictError(prefix + key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newDecisionServer(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestAuthorizeAuthUrlPolicies(t *testing.T) {
+	identity := newDecisionServer(http.StatusOK, "{\"userid\": \"123456\", \"role\": \"patient\"}")
+	policy := newDecisionServer(http.StatusOK, "{\"role\": \"clinician\", \"plan\": \"premium\"}")
+	denying := newDecisionServer(http.StatusForbidden, "")
+	unreachable := newDecisionServer(http.StatusOK, "")
+	unreachable.Close()
+	defer identity.Close()
+	defer policy.Close()
+	defer denying.Close()
+
+	tests := []struct {
+		name       string
+		policy     string
+		additional []string
+		allowed    bool
+		err        bool
+	}{
+		{"all allow", AuthUrlPolicyAll, []string{policy.URL}, true, false},
+		{"all with a denial", "", []string{policy.URL, denying.URL}, false, false},
+		{"all with an error", AuthUrlPolicyAll, []string{unreachable.URL}, false, true},
+		{"any with a denial", AuthUrlPolicyAny, []string{denying.URL}, true, false},
+		{"any with an error", AuthUrlPolicyAny, []string{unreachable.URL}, true, false},
+	}
+	for _, test := range tests {
+		service := newAuthService(t, &Config{
+			AuthUrl:            identity.URL,
+			AdditionalAuthUrls: test.additional,
+			AuthUrlPolicy:      test.policy,
+			ResponseHeaders:    map[string]string{"userid": "x-auth-subject-id", "role": "x-auth-role", "plan": "x-auth-plan"},
+		})
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if allowed := response.CheckResponse.GetOkResponse() != nil; allowed != test.allowed {
+			t.Errorf("%s: expected allowed %v, got %v", test.name, test.allowed, allowed)
+		}
+	}
+}
+
+func TestAuthorizeMergesHeadersInConfigOrder(t *testing.T) {
+	identity := newDecisionServer(http.StatusOK, "{\"userid\": \"123456\", \"role\": \"patient\"}")
+	policy := newDecisionServer(http.StatusOK, "{\"role\": \"clinician\", \"plan\": \"premium\"}")
+	defer identity.Close()
+	defer policy.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:            identity.URL,
+		AdditionalAuthUrls: []string{policy.URL},
+		ResponseHeaders:    map[string]string{"userid": "x-auth-subject-id", "role": "x-auth-role", "plan": "x-auth-plan"},
+	})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectations := map[string]string{"x-auth-subject-id": "123456", "x-auth-role": "patient", "x-auth-plan": "premium"}
+	if headers := response.CheckResponse.GetOkResponse().GetHeaders(); len(headers) != len(expectations) {
+		t.Errorf("expected %v headers, got %v", len(expectations), headers)
+	}
+	for key, expected := range expectations {
+		if value, _ := responseHeaderValue(response, key); value != expected {
+			t.Errorf("expected header %v to be %v, got %q", key, expected, value)
+		}
+	}
+}
+
+func TestAuthorizeMergesResponseBodies(t *testing.T) {
+	identity := newDecisionServer(http.StatusOK, "{\"claims\": {\"userid\": \"123456\", \"role\": \"patient\"}}")
+	entitlements := newDecisionServer(http.StatusOK, "{\"claims\": {\"role\": \"clinician\", \"plan\": \"premium\"}}")
+	denying := newDecisionServer(http.StatusForbidden, "")
+	defer identity.Close()
+	defer entitlements.Close()
+	defer denying.Close()
+
+	tests := []struct {
+		policy         string
+		additionalUrls []string
+		expected       map[string]string
+		allowed        bool
+		err            bool
+	}{
+		{BodyMergeFirst, []string{entitlements.URL}, map[string]string{"x-auth-subject-id": "123456", "x-auth-role": "patient", "x-auth-plan": "premium"}, true, false},
+		{BodyMergeLast, []string{entitlements.URL}, map[string]string{"x-auth-subject-id": "123456", "x-auth-role": "clinician", "x-auth-plan": "premium"}, true, false},
+		{BodyMergeError, []string{entitlements.URL}, nil, false, true},
+		{BodyMergeFirst, []string{entitlements.URL, denying.URL}, nil, false, false},
+	}
+	for _, test := range tests {
+		service := newAuthService(t, &Config{
+			AuthUrl:            identity.URL,
+			AdditionalAuthUrls: test.additionalUrls,
+			BodyMergePolicy:    test.policy,
+			Mappings: []Mapping{
+				{Source: "claims.userid", Target: Target{Name: "x-auth-subject-id"}},
+				{Source: "claims.role", Target: Target{Name: "x-auth-role"}},
+				// Only the entitlements backend has the plan.
+				{Source: "claims.plan", Target: Target{Name: "x-auth-plan"}, Required: true},
+			},
+		})
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		if (err != nil) != test.err {
+			t.Fatalf("%v: unexpected error: %v", test.policy, err)
+		}
+		if err != nil {
+			continue
+		}
+		if isAllowedResponse(response) != test.allowed {
+			t.Fatalf("%v: expected allowed %v", test.policy, test.allowed)
+		}
+		if headers := response.CheckResponse.GetOkResponse().GetHeaders(); len(headers) != len(test.expected) {
+			t.Errorf("%v: expected %v headers, got %v", test.policy, len(test.expected), headers)
+		}
+		for key, expected := range test.expected {
+			if value, _ := responseHeaderValue(response, key); value != expected {
+				t.Errorf("%v: expected header %v to be %v, got %q", test.policy, key, expected, value)
+			}
+		}
+	}
+}
+
+func TestAuthorizeMergedBodiesDenyPerBackend(t *testing.T) {
+	identity := newDecisionServer(http.StatusOK, "{\"authorized\": true, \"userid\": \"123456\"}")
+	policy := newDecisionServer(http.StatusOK, "{\"authorized\": false, \"reason\": \"no consent\"}")
+	defer identity.Close()
+	defer policy.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:             identity.URL,
+		AdditionalAuthUrls:  []string{policy.URL},
+		BodyMergePolicy:     BodyMergeFirst,
+		AllowAttribute:      "authorized",
+		DenyReasonAttribute: "reason",
+		ResponseHeaders:     map[string]string{"userid": "x-auth-subject-id"},
+	})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isAllowedResponse(response) {
+		t.Error("expected the additional backend's denial not to be overwritten by the merge")
+	}
+}
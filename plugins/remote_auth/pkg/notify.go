@@ -0,0 +1,96 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const DefaultDenyNotifyTimeout = 2 * time.Second
+
+// denyNotifier posts an event to DenyNotifyUrl for every denied request. Events are sent in the
+// background with their own timeout, so a slow or failing webhook never holds up or changes the
+// decision; failures are only logged.
+type denyNotifier struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+}
+
+type denyEvent struct {
+	RequestId  string `json:"request_id,omitempty"`
+	Reason     string `json:"reason"`
+	SourceIp   string `json:"source_ip,omitempty"`
+	StatusCode int32  `json:"status_code"`
+	Time       string `json:"time"`
+}
+
+func newDenyNotifier(url string, timeout time.Duration) *denyNotifier {
+	if url == "" {
+		return nil
+	}
+	return &denyNotifier{url: url, client: &http.Client{}, timeout: timeout}
+}
+
+// notifyDenied sends the deny event of a response, unless it allows the request.
+func (c *RemoteAuthService) notifyDenied(log *zap.SugaredLogger, authzRequest *api.AuthorizationRequest, response *api.AuthorizationResponse) {
+	if c.denyNotifier == nil || response == nil || isAllowedResponse(response) {
+		return
+	}
+	denied := response.CheckResponse.GetDeniedResponse()
+	event := denyEvent{
+		Reason:     deniedReason(denied.GetBody(), int(denied.GetStatus().GetCode())),
+		SourceIp:   extractClientAddress(authzRequest),
+		StatusCode: int32(denied.GetStatus().GetCode()),
+		Time:       time.Now().UTC().Format(time.RFC3339),
+	}
+	if requestId := c.extractRequestId(authzRequest); requestId != nil {
+		event.RequestId = *requestId
+	}
+	go c.denyNotifier.send(log, event)
+}
+
+// deniedReason returns the reason of a denied response body set by EnableDenyReasons, or the text
+// of its status code.
+func deniedReason(body string, statusCode int) string {
+	var reason denyReasonBody
+	if json.Unmarshal([]byte(body), &reason) == nil && reason.Reason != "" {
+		return reason.Reason
+	}
+	if text := http.StatusText(statusCode); text != "" {
+		return text
+	}
+	return "Denied"
+}
+
+func (n *denyNotifier) send(log *zap.SugaredLogger, event denyEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Warnw("Unable to encode deny notification", zap.Error(err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), n.timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, "POST", n.url, bytes.NewReader(body))
+	if err != nil {
+		log.Warnw("Unable to create deny notification", zap.Error(err))
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := n.client.Do(request)
+	if err != nil {
+		log.Warnw("Unable to send deny notification", zap.Error(err))
+		return
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, DefaultMaxResponseBytes))
+	if response.StatusCode >= 300 {
+		log.Warnw("Unsuccessful response to deny notification", zap.Int("status_code", response.StatusCode))
+	}
+}
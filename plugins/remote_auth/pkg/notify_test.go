@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	envoycorev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoyauthv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeNotifiesDenials(t *testing.T) {
+	status := http.StatusForbidden
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, "{\"reason\": \"expired\"}")
+	}))
+	defer server.Close()
+	events := make(chan denyEvent, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event denyEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("unable to decode deny event: %v", err)
+		}
+		events <- event
+	}))
+	defer webhook.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:           server.URL,
+		RequestIdHeader:   "x-request-id",
+		EnableDenyReasons: true,
+		DenyNotifyUrl:     webhook.URL,
+	})
+	request := newAuthorizationRequest(map[string]string{"x-request-id": "abc"})
+	request.CheckRequest.Attributes.Source = &envoyauthv2.AttributeContext_Peer{
+		Address: &envoycorev2.Address{Address: &envoycorev2.Address_SocketAddress{
+			SocketAddress: &envoycorev2.SocketAddress{Address: "10.0.0.1"},
+		}},
+	}
+	if _, err := service.Authorize(context.Background(), request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case event := <-events:
+		if event.RequestId != "abc" || event.Reason != "expired" || event.SourceIp != "10.0.0.1" || event.StatusCode != 401 {
+			t.Errorf("unexpected deny event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a deny event")
+	}
+
+	status = http.StatusOK
+	if _, err := service.Authorize(context.Background(), request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("expected no deny event for an allowed request, got %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDenyNotificationsDontBlockDecisions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer webhook.Close()
+	defer close(release)
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, DenyNotifyUrl: webhook.URL, DenyNotifyTimeout: "50ms"})
+	started := time.Now()
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isAllowedResponse(response) {
+		t.Error("expected the request to be denied")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("expected the decision not to wait for the webhook, took %v", elapsed)
+	}
+}
@@ -0,0 +1,25 @@
+package pkg
+
+// addPrefixedHeaders sets the keys of an object of the auth response body as headers named by the
+// key after prefix, for ResponseHeaderPrefixes. Nested objects are expanded with their keys after
+// the key of the object and "-" when the mapping recurses, or skipped like other values that can't
+// be stringified. Null values and keys making an invalid header name are skipped.
+func (e *extractedAttributes) addPrefixedHeaders(mapping Mapping, prefix string, object map[string]interface{}) {
+	for _, key := range sortedObjectKeys(object) {
+		name := prefix + key
+		if !isValidHeaderName(name) {
+			continue
+		}
+		raw := object[key]
+		if nested, ok := raw.(map[string]interface{}); ok && mapping.recurse {
+			e.addPrefixedHeaders(mapping, name+"-", nested)
+			continue
+		}
+		if raw == nil {
+			continue
+		}
+		if value := mapping.Transform.stringify(mapping.Transform.applyRaw(raw)); value != nil {
+			e.addHeaders(mapping, name, []string{mapping.Transform.apply(*value)})
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAuthorizeExpandsPrefixedObjects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"userid": "123", "attributes": {"a": "1", "b": 2, "roles": ["x", "y"], "empty": null, "bad key": "v", "address": {"city": "Oslo", "geo": {"lat": 59.9}}}}`)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		recurse  bool
+		expected map[string]string
+	}{
+		{"nested objects skipped", false, map[string]string{
+			"x-auth-subject-id": "123",
+			"x-attr-a":          "1",
+			"x-attr-b":          "2",
+			"x-attr-roles":      "x,y",
+		}},
+		{"nested objects recursed", true, map[string]string{
+			"x-auth-subject-id":      "123",
+			"x-attr-a":               "1",
+			"x-attr-b":               "2",
+			"x-attr-roles":           "x,y",
+			"x-attr-address-city":    "Oslo",
+			"x-attr-address-geo-lat": "59.9",
+		}},
+	}
+	for _, test := range tests {
+		service := newAuthService(t, &Config{
+			AuthUrl:                server.URL,
+			ResponseHeaders:        map[string]string{"userid": "x-auth-subject-id"},
+			ResponseHeaderPrefixes: map[string]string{"attributes": "x-attr-"},
+			RecursePrefixedObjects: test.recurse,
+		})
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		headers := map[string]string{}
+		for _, header := range response.CheckResponse.GetOkResponse().GetHeaders() {
+			headers[header.Header.Key] = header.Header.Value
+		}
+		if !reflect.DeepEqual(headers, test.expected) {
+			t.Errorf("%s: expected headers %v, got %v", test.name, test.expected, headers)
+		}
+	}
+}
+
+func TestAuthorizeSkipsMissingPrefixedObjects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"attributes": "not an object"}`)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:                server.URL,
+		ResponseHeaderPrefixes: map[string]string{"attributes": "x-attr-", "claims": "x-claim-"},
+	})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if headers := response.CheckResponse.GetOkResponse().GetHeaders(); len(headers) != 0 {
+		t.Errorf("expected no headers, got %v", headers)
+	}
+}
@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"errors"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"sort"
+	"strings"
+)
+
+// PathPatternWildcard ends a PathResponseHeaders pattern matching every path it's a prefix of.
+const PathPatternWildcard = "*"
+
+// responseHeaderProfile holds the mappings used instead of ResponseHeaders for requests whose path
+// matches pattern, see Config.PathResponseHeaders.
+type responseHeaderProfile struct {
+	pattern  string
+	mappings []Mapping
+}
+
+// matches reports whether path is the pattern or, for a pattern ending in PathPatternWildcard,
+// starts with the part before it.
+func (p *responseHeaderProfile) matches(path string) bool {
+	if prefix := strings.TrimSuffix(p.pattern, PathPatternWildcard); prefix != p.pattern {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == p.pattern
+}
+
+// newResponseHeaderProfiles builds a profile per PathResponseHeaders pattern, ordered by
+// precedence: exact patterns first, then prefixes from the longest, so the first match is the
+// most specific one.
+func newResponseHeaderProfiles(config *Config) []responseHeaderProfile {
+	var profiles []responseHeaderProfile
+	for pattern, responseHeaders := range config.PathResponseHeaders {
+		profiles = append(profiles, responseHeaderProfile{
+			pattern:  pattern,
+			mappings: responseHeaderMappings(config, responseHeaders),
+		})
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		iPrefix := strings.HasSuffix(profiles[i].pattern, PathPatternWildcard)
+		jPrefix := strings.HasSuffix(profiles[j].pattern, PathPatternWildcard)
+		if iPrefix != jPrefix {
+			return !iPrefix
+		}
+		if len(profiles[i].pattern) != len(profiles[j].pattern) {
+			return len(profiles[i].pattern) > len(profiles[j].pattern)
+		}
+		return profiles[i].pattern < profiles[j].pattern
+	})
+	return profiles
+}
+
+// responseHeaderMappings converts ResponseHeaders, or a PathResponseHeaders profile, to mappings
+// with the ResponseHeader* options of their headers, followed by those of ResponseHeaderPrefixes,
+// Mappings and those of ResponseMetadata.
+func responseHeaderMappings(config *Config, responseHeaders map[string]string) []Mapping {
+	mappings := mappingsFromResponseHeaders(responseHeaders)
+	for i := range mappings {
+		mappings[i].Transform = config.ResponseHeaderTransforms[mappings[i].Target.Name]
+		mappings[i].Type = config.ResponseHeaderTypes[mappings[i].Target.Name]
+		mappings[i].When = config.ResponseHeaderConditions[mappings[i].Target.Name]
+		if value, ok := config.ResponseHeaderDefaults[mappings[i].Target.Name]; ok {
+			mappings[i].Default = &value
+		}
+		mappings[i].NullValue = config.ResponseHeaderNullValue
+		for _, header := range config.RequiredResponseHeaders {
+			mappings[i].Required = mappings[i].Required || header == mappings[i].Target.Name
+		}
+		for _, header := range config.AppendResponseHeaders {
+			mappings[i].Target.Append = mappings[i].Target.Append || header == mappings[i].Target.Name
+		}
+		for _, header := range config.RepeatedResponseHeaders {
+			mappings[i].Target.Repeat = mappings[i].Target.Repeat || header == mappings[i].Target.Name
+		}
+	}
+	prefixMappings := mappingsFromResponseHeaders(config.ResponseHeaderPrefixes)
+	for i := range prefixMappings {
+		prefixMappings[i].prefixed = true
+		prefixMappings[i].recurse = config.RecursePrefixedObjects
+	}
+	metadataMappings := mappingsFromResponseHeaders(config.ResponseMetadata)
+	for i := range metadataMappings {
+		metadataMappings[i].Target.Type = TargetTypeMetadata
+		metadataMappings[i].typed = true
+	}
+	mappings = withConditions(append(append(append(mappings, prefixMappings...), config.Mappings...), metadataMappings...))
+	if config.ObjectAttributesAsJson {
+		mappings = withJsonObjects(mappings)
+	}
+	return mappings
+}
+
+// mappingsFor returns the mappings of the profile selected for the request, or Mappings when none
+// is.
+func (c *RemoteAuthService) mappingsFor(authzRequest *api.AuthorizationRequest) []Mapping {
+	if profile := c.profileFor(authzRequest); profile != nil {
+		return profile.mappings
+	}
+	return c.Mappings
+}
+
+// profileFor returns the first profile matching the request path, without its query, or nil when
+// none does.
+func (c *RemoteAuthService) profileFor(authzRequest *api.AuthorizationRequest) *responseHeaderProfile {
+	if len(c.responseHeaderProfiles) == 0 {
+		return nil
+	}
+	path := requestAttribute(authzRequest, QuerySourcePath)
+	for i := range c.responseHeaderProfiles {
+		if c.responseHeaderProfiles[i].matches(path) {
+			return &c.responseHeaderProfiles[i]
+		}
+	}
+	return nil
+}
+
+// allMappings returns Mappings followed by those of every profile, for what has to account for
+// any of them, such as the attributes streamed from the auth response.
+func (c *RemoteAuthService) allMappings() []Mapping {
+	mappings := c.Mappings
+	for _, profile := range c.responseHeaderProfiles {
+		mappings = append(mappings[:len(mappings):len(mappings)], profile.mappings...)
+	}
+	return mappings
+}
+
+// validatePathPattern checks a PathResponseHeaders pattern: a path, with PathPatternWildcard only
+// as its last character.
+func validatePathPattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return errors.New("pattern must start with /")
+	}
+	if strings.Contains(strings.TrimSuffix(pattern, PathPatternWildcard), PathPatternWildcard) {
+		return errors.New("pattern may only end with " + PathPatternWildcard)
+	}
+	if strings.Contains(pattern, "?") {
+		return errors.New("pattern must not have a query")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAuthorizeSelectsResponseHeadersByPath(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{\"userid\": \"123\", \"clinicid\": \"456\", \"role\": \"admin\"}")
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:         server.URL,
+		ResponseHeaders: map[string]string{"userid": "x-auth-subject-id"},
+		PathResponseHeaders: map[string]map[string]string{
+			"/v1/clinics/*":      {"clinicid": "x-auth-clinic-id"},
+			"/v1/clinics/admin*": {"role": "x-auth-role"},
+			"/v1/clinics/export": {"userid": "x-auth-exporter-id"},
+		},
+	})
+	tests := []struct {
+		path     string
+		header   string
+		expected string
+	}{
+		{"/v1/users/123", "x-auth-subject-id", "123"},
+		{"/v1/clinics", "x-auth-subject-id", "123"},
+		{"/v1/clinics/456?full=true", "x-auth-clinic-id", "456"},
+		{"/v1/clinics/admins", "x-auth-role", "admin"},
+		{"/v1/clinics/export", "x-auth-exporter-id", "123"},
+	}
+	for _, test := range tests {
+		request := newAuthorizationRequest(nil)
+		request.CheckRequest.Attributes.Request.Http.Path = test.path
+		response, err := service.Authorize(context.Background(), request)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.path, err)
+		}
+		headers := response.CheckResponse.GetOkResponse().GetHeaders()
+		if len(headers) != 1 {
+			t.Errorf("%s: expected the headers of a single profile, got %v", test.path, headers)
+		}
+		if value, _ := responseHeaderValue(response, test.header); value != test.expected {
+			t.Errorf("%s: expected %v to be %q, got %q", test.path, test.header, test.expected, value)
+		}
+	}
+}
+
+func TestAuthorizeCachesPerResponseHeaderProfile(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprint(w, "{\"userid\": \"123\", \"clinicid\": \"456\"}")
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl: server.URL,
+		PathResponseHeaders: map[string]map[string]string{
+			"/v1/users/*":   {"userid": "x-auth-subject-id"},
+			"/v1/clinics/*": {"clinicid": "x-auth-clinic-id"},
+		},
+		CacheTTL: "1m",
+	})
+	tests := []struct {
+		path     string
+		header   string
+		expected string
+	}{
+		{"/v1/users/123", "x-auth-subject-id", "123"},
+		{"/v1/clinics/456", "x-auth-clinic-id", "456"},
+		{"/v1/users/789", "x-auth-subject-id", "123"},
+		{"/v1/clinics/456", "x-auth-clinic-id", "456"},
+	}
+	for _, test := range tests {
+		request := newAuthorizationRequest(nil)
+		request.CheckRequest.Attributes.Request.Http.Path = test.path
+		response, err := service.Authorize(context.Background(), request)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.path, err)
+		}
+		if value, _ := responseHeaderValue(response, test.header); value != test.expected {
+			t.Errorf("%s: expected %v to be %q, got %q", test.path, test.header, test.expected, value)
+		}
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("expected one upstream call per profile, got %v", calls)
+	}
+}
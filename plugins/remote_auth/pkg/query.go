@@ -0,0 +1,186 @@
+package pkg
+
+import (
+	"errors"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	QuerySourcePath   = "path"
+	QuerySourceMethod = "method"
+	QuerySourceHost   = "host"
+	QuerySourceScheme = "scheme"
+	// The HTTP protocol of the downstream request, e.g. "HTTP/1.1" or "HTTP/2".
+	QuerySourceProtocol = "protocol"
+	// "true" when the downstream connection used TLS and "false" when it was plaintext.
+	QuerySourceTls = "tls"
+	// The principal of the downstream client certificate, e.g. its SPIFFE ID, when mTLS was used.
+	QuerySourcePeerPrincipal = "peer_principal"
+	QuerySourceHeaderPrefix  = "header:"
+	// Prefix of sources read from the context extensions of the check request, which Envoy sets per
+	// route, e.g. "context:route_name".
+	QuerySourceContextPrefix = "context:"
+	// Prefix of sources read from the query string of the original request, e.g. "query:page".
+	QuerySourceQueryPrefix = "query:"
+	// Prefix of sources read from the filter metadata of the check request, as
+	// "metadata:<namespace>:<key>", e.g. "metadata:io.solo.auth:backend". Envoy only sends the
+	// namespaces listed in metadata_context_namespaces of its ext_authz filter.
+	QuerySourceMetadataPrefix = "metadata:"
+
+	// Source of the virtual host name sent in VirtualHostHeader, which Gloo routes can set with the
+	// context extensions of their extauth config.
+	DefaultVirtualHostSource = "context:virtual_host"
+)
+
+func validateQuerySource(source string) error {
+	switch {
+	case source == QuerySourcePath, source == QuerySourceMethod, source == QuerySourceHost, source == QuerySourceScheme:
+		return nil
+	case source == QuerySourceProtocol, source == QuerySourceTls, source == QuerySourcePeerPrincipal:
+		return nil
+	case strings.HasPrefix(source, QuerySourceHeaderPrefix) && len(source) > len(QuerySourceHeaderPrefix):
+		return nil
+	case strings.HasPrefix(source, QuerySourceContextPrefix) && len(source) > len(QuerySourceContextPrefix):
+		return nil
+	case strings.HasPrefix(source, QuerySourceQueryPrefix) && len(source) > len(QuerySourceQueryPrefix):
+		return nil
+	case strings.HasPrefix(source, QuerySourceMetadataPrefix):
+		parts := strings.SplitN(strings.TrimPrefix(source, QuerySourceMetadataPrefix), ":", 2)
+		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			return nil
+		}
+	}
+	return errors.New("unknown source " + source + ", must be one of path, method, host, scheme, protocol, tls, peer_principal, header:<name>, context:<key>, metadata:<namespace>:<key> or query:<name>")
+}
+
+// withQueryParameters adds the configured request attributes and StaticQueryParams to the query
+// of authUrl. Parameters already present in authUrl are kept unless they are also configured, in
+// which case the configured value replaces them. Attributes missing from the request are skipped.
+func (c *RemoteAuthService) withQueryParameters(authUrl string, authzRequest *api.AuthorizationRequest) (string, error) {
+	if len(c.QueryParameters) == 0 && len(c.staticQueryParams) == 0 {
+		return authUrl, nil
+	}
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for param, source := range c.QueryParameters {
+		if value := requestAttribute(authzRequest, source); value != "" {
+			query.Set(param, value)
+		}
+	}
+	for param, value := range c.staticQueryParams {
+		query.Set(param, value)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// redactQueryParams masks the values of the StaticQueryParams and the client assertion in the URL
+// of a failed auth request, which the http client includes in its errors, so they don't end up in
+// the logs.
+func (c *RemoteAuthService) redactQueryParams(err error) error {
+	var urlErr *url.Error
+	if (len(c.staticQueryParams) == 0 && !c.clientAssertion.inQuery()) || !errors.As(err, &urlErr) {
+		return err
+	}
+	u, parseErr := url.Parse(urlErr.URL)
+	if parseErr != nil {
+		return err
+	}
+	query := u.Query()
+	for param := range c.staticQueryParams {
+		if _, ok := query[param]; ok {
+			query.Set(param, "xxxxx")
+		}
+	}
+	if _, ok := query[ClientAssertionParam]; ok && c.clientAssertion.inQuery() {
+		query.Set(ClientAssertionParam, "xxxxx")
+	}
+	u.RawQuery = query.Encode()
+	return &url.Error{Op: urlErr.Op, URL: u.String(), Err: urlErr.Err}
+}
+
+// requestAttribute returns the value of a QueryParameters or RequestAttributeHeaders source, or ""
+// when the request doesn't have it.
+func requestAttribute(authzRequest *api.AuthorizationRequest, source string) string {
+	httpRequest := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp()
+	switch {
+	case source == QuerySourcePath:
+		return strings.SplitN(httpRequest.GetPath(), "?", 2)[0]
+	case source == QuerySourceMethod:
+		return httpRequest.GetMethod()
+	case source == QuerySourceHost:
+		return httpRequest.GetHost()
+	case source == QuerySourceScheme:
+		return httpRequest.GetScheme()
+	case source == QuerySourceProtocol:
+		return httpRequest.GetProtocol()
+	case source == QuerySourceTls:
+		return downstreamTls(authzRequest)
+	case source == QuerySourcePeerPrincipal:
+		return authzRequest.CheckRequest.GetAttributes().GetSource().GetPrincipal()
+	case strings.HasPrefix(source, QuerySourceHeaderPrefix):
+		return httpRequest.GetHeaders()[strings.TrimPrefix(source, QuerySourceHeaderPrefix)]
+	case strings.HasPrefix(source, QuerySourceContextPrefix):
+		return authzRequest.CheckRequest.GetAttributes().GetContextExtensions()[strings.TrimPrefix(source, QuerySourceContextPrefix)]
+	case strings.HasPrefix(source, QuerySourceQueryPrefix):
+		return queryParameter(httpRequest.GetPath(), strings.TrimPrefix(source, QuerySourceQueryPrefix))
+	case strings.HasPrefix(source, QuerySourceMetadataPrefix):
+		return filterMetadataValue(authzRequest, strings.TrimPrefix(source, QuerySourceMetadataPrefix))
+	}
+	return ""
+}
+
+// filterMetadataValue returns the "<namespace>:<key>" field of the check request filter metadata
+// when it's a string, number or bool, or "" when it's missing or of another kind.
+func filterMetadataValue(authzRequest *api.AuthorizationRequest, path string) string {
+	parts := strings.SplitN(path, ":", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	namespace := authzRequest.CheckRequest.GetAttributes().GetMetadataContext().GetFilterMetadata()[parts[0]]
+	switch kind := namespace.GetFields()[parts[1]].GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return kind.StringValue
+	case *structpb.Value_NumberValue:
+		return strconv.FormatFloat(kind.NumberValue, 'f', -1, 64)
+	case *structpb.Value_BoolValue:
+		return strconv.FormatBool(kind.BoolValue)
+	}
+	return ""
+}
+
+// downstreamTls returns whether the downstream connection used TLS, or "" when Envoy didn't send
+// enough to tell. A client certificate implies TLS; otherwise the scheme Envoy derived from the
+// connection is used.
+func downstreamTls(authzRequest *api.AuthorizationRequest) string {
+	source := authzRequest.CheckRequest.GetAttributes().GetSource()
+	if source.GetCertificate() != "" || source.GetPrincipal() != "" {
+		return "true"
+	}
+	switch strings.ToLower(authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp().GetScheme()) {
+	case "https":
+		return "true"
+	case "http":
+		return "false"
+	}
+	return ""
+}
+
+// queryParameter returns the decoded value of the first name parameter in the query string of
+// path, or "" when it's missing. Malformed parameters are skipped like url.ParseQuery does.
+func queryParameter(path string, name string) string {
+	parts := strings.SplitN(path, "?", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	values, _ := url.ParseQuery(parts[1])
+	return values.Get(name)
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"context"
+	envoyauthv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestWithQueryParameters(t *testing.T) {
+	service := &RemoteAuthService{QueryParameters: map[string]string{
+		"resource": QuerySourcePath,
+		"method":   QuerySourceMethod,
+		"host":     QuerySourceHost,
+		"scheme":   QuerySourceScheme,
+		"client":   "header:x-client",
+		"missing":  "header:x-missing",
+		"version":  "header:x-version",
+	}}
+	request := newAuthorizationRequest(map[string]string{"x-client": "a&b=c", "x-version": "2"})
+	httpRequest := request.CheckRequest.Attributes.Request.Http
+	httpRequest.Path, httpRequest.Method, httpRequest.Host = "/api/foo?bar=baz", "GET", "api.example.com"
+	httpRequest.Scheme = "https"
+
+	authUrl, err := service.withQueryParameters("http://auth/check?static=1&version=1", request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		t.Fatalf("unable to parse %v: %v", authUrl, err)
+	}
+	expectations := map[string]string{
+		"static":   "1",
+		"resource": "/api/foo",
+		"method":   "GET",
+		"host":     "api.example.com",
+		"scheme":   "https",
+		"client":   "a&b=c",
+		"version":  "2",
+	}
+	query := u.Query()
+	if len(query) != len(expectations) {
+		t.Errorf("expected %v query parameters, got %v", len(expectations), query)
+	}
+	for param, expected := range expectations {
+		if value := query.Get(param); value != expected {
+			t.Errorf("expected query parameter %v to be %v, got %v", param, expected, value)
+		}
+	}
+}
+
+func TestValidateQuerySource(t *testing.T) {
+	for _, source := range []string{"path", "method", "host", "scheme", "protocol", "tls", "peer_principal", "header:x-client", "context:route_name", "metadata:io.solo.auth:backend", "query:page"} {
+		if err := validateQuerySource(source); err != nil {
+			t.Errorf("unexpected error for %v: %v", source, err)
+		}
+	}
+	for _, source := range []string{"", "header:", "context:", "metadata:", "metadata:io.solo.auth", "metadata::backend", "query:", "body"} {
+		if err := validateQuerySource(source); err == nil {
+			t.Errorf("expected source %q to be invalid", source)
+		}
+	}
+}
+
+func TestAllowedHeadersIncludesRequestAttributes(t *testing.T) {
+	service := &RemoteAuthService{RequestAttributeHeaders: map[string]string{
+		"x-forwarded-proto": QuerySourceScheme,
+		"x-forwarded-host":  QuerySourceHost,
+		"x-forwarded-path":  QuerySourcePath,
+		"x-route-name":      "context:route_name",
+		"x-route-version":   "context:route_version",
+		"x-page":            "query:page",
+		"x-filter":          "query:filter",
+		"x-missing":         "query:missing",
+	}}
+	request := newAuthorizationRequest(map[string]string{})
+	httpRequest := request.CheckRequest.Attributes.Request.Http
+	httpRequest.Scheme, httpRequest.Host = "https", "api.example.com"
+	httpRequest.Path = "/v1/users?page=2&filter=name%3DJane+Doe&bad=%zz&page=3"
+	request.CheckRequest.Attributes.ContextExtensions = map[string]string{"route_name": "patients"}
+
+	headers := service.allowedHeaders(request)
+	expectations := map[string]string{
+		"x-forwarded-proto": "https",
+		"x-forwarded-host":  "api.example.com",
+		"x-forwarded-path":  "/v1/users",
+		"x-route-name":      "patients",
+		"x-page":            "2",
+		"x-filter":          "name=Jane Doe",
+	}
+	if len(headers) != len(expectations) {
+		t.Errorf("expected %v headers, got %v", len(expectations), headers)
+	}
+	for header, expected := range expectations {
+		if value := headers[header]; value != expected {
+			t.Errorf("expected header %v to be %v, got %v", header, expected, value)
+		}
+	}
+}
+
+func TestRequestAttributeConnectionDetails(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheme    string
+		source    *envoyauthv2.AttributeContext_Peer
+		tls       string
+		principal string
+	}{
+		{"plaintext", "http", nil, "false", ""},
+		{"tls", "https", nil, "true", ""},
+		{"mtls", "https", &envoyauthv2.AttributeContext_Peer{Principal: "spiffe://tidepool/shoreline"}, "true", "spiffe://tidepool/shoreline"},
+		{"client certificate without scheme", "", &envoyauthv2.AttributeContext_Peer{Certificate: "-----BEGIN CERTIFICATE-----"}, "true", ""},
+		{"unknown", "", nil, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := newAuthorizationRequest(map[string]string{})
+			request.CheckRequest.Attributes.Request.Http.Scheme = test.scheme
+			request.CheckRequest.Attributes.Request.Http.Protocol = "HTTP/2"
+			request.CheckRequest.Attributes.Source = test.source
+			if value := requestAttribute(request, QuerySourceTls); value != test.tls {
+				t.Errorf("expected tls %q, got %q", test.tls, value)
+			}
+			if value := requestAttribute(request, QuerySourcePeerPrincipal); value != test.principal {
+				t.Errorf("expected peer principal %q, got %q", test.principal, value)
+			}
+			if value := requestAttribute(request, QuerySourceProtocol); value != "HTTP/2" {
+				t.Errorf("expected protocol HTTP/2, got %q", value)
+			}
+		})
+	}
+}
+
+func TestAuthorizeSendsStaticQueryParams(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:           server.URL + "/check?api_key=old&version=1",
+		StaticQueryParams: map[string]string{"api_key": "s3cr3t&x=y"},
+	})
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value := query.Get("api_key"); value != "s3cr3t&x=y" {
+		t.Errorf("expected the static api key to replace the auth url one, got %q", value)
+	}
+	if value := query.Get("version"); value != "1" {
+		t.Errorf("expected the auth url parameters to be kept, got %q", value)
+	}
+}
+
+func TestStaticQueryParamsAreRedactedFromErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, StaticQueryParams: map[string]string{"api_key": "s3cr3t"}})
+	_, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err == nil {
+		t.Fatal("expected an error calling a closed server")
+	}
+	if strings.Contains(err.Error(), "s3cr3t") || !strings.Contains(err.Error(), "api_key=xxxxx") {
+		t.Errorf("expected the api key to be redacted, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+	"math"
+	"time"
+)
+
+// newRateLimiter returns nil, disabling limiting, unless a positive RateLimit is configured.
+func newRateLimiter(config *Config) *rate.Limiter {
+	if config.RateLimit <= 0 {
+		return nil
+	}
+	burst := config.RateLimitBurst
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(config.RateLimit)))
+	}
+	return rate.NewLimiter(rate.Limit(config.RateLimit), burst)
+}
+
+// waitForRateLimit blocks until the limiter allows another upstream call, returning false if that
+// would take longer than the request context allows.
+func (c *RemoteAuthService) waitForRateLimit(ctx context.Context, log *zap.SugaredLogger) bool {
+	if c.rateLimiter == nil {
+		return true
+	}
+	if err := c.rateLimiter.Wait(ctx); err != nil {
+		log.Warnw("Outbound auth request rate limit exceeded, denying access", zap.Error(err))
+		return false
+	}
+	return true
+}
+
+// waitToRetry blocks until the limiter allows a retry or fallback attempt, which counts against
+// RateLimit like the first one, returning false if that would take longer than ctx or budgetEnds,
+// unless it's zero, allow.
+func (c *RemoteAuthService) waitToRetry(ctx context.Context, log *zap.SugaredLogger, budgetEnds time.Time) bool {
+	if c.rateLimiter == nil {
+		return true
+	}
+	if !budgetEnds.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, budgetEnds)
+		defer cancel()
+	}
+	if err := c.rateLimiter.Wait(ctx); err != nil {
+		log.Infow("Outbound auth request rate limit exceeded, not calling the upstream again", zap.Error(err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,75 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiterDisabledByDefault(t *testing.T) {
+	if limiter := newRateLimiter(&Config{}); limiter != nil {
+		t.Error("expected no limiter without a RateLimit")
+	}
+	if limiter := newRateLimiter(&Config{RateLimit: 0.5}); limiter == nil || limiter.Burst() != 1 {
+		t.Errorf("expected a limiter with a burst of 1, got %v", limiter)
+	}
+}
+
+func TestAuthorizeDeniesWhenRateLimitExceedsDeadline(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, RateLimit: 0.1, RateLimitBurst: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	first, err := service.Authorize(ctx, newAuthorizationRequest(nil))
+	if err != nil || first.CheckResponse.GetOkResponse() == nil {
+		t.Fatalf("expected the first request to be allowed, got %v, %v", first, err)
+	}
+	second, err := service.Authorize(ctx, newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code := second.CheckResponse.GetDeniedResponse().GetStatus().GetCode(); code != 429 {
+		t.Errorf("expected the second request to be denied with 429, got %v", code)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 upstream call, got %v", calls)
+	}
+}
+
+func TestAuthorizeRetriesWaitForRateLimit(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:         server.URL,
+		FallbackAuthUrl: server.URL,
+		MaxRetries:      3,
+		RetryBackoff:    "1ms",
+		RequestTimeout:  "200ms",
+		RateLimit:       1,
+		RateLimitBurst:  2,
+	})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isAllowedResponse(response) {
+		t.Error("expected the last unsuccessful response to deny the request")
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("expected retries and fallback attempts to stop with the rate limit, got %v calls", calls)
+	}
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"fmt"
+	envoycorev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	envoyauthv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"strings"
+)
+
+// ensureRequestId sets a generated request id on authzRequest when GenerateRequestId is enabled
+// and the request doesn't have one, so it's logged and forwarded like a received id.
+func (c *RemoteAuthService) ensureRequestId(authzRequest *api.AuthorizationRequest) {
+	if !c.GenerateRequestId || c.extractRequestId(authzRequest) != nil {
+		return
+	}
+	httpRequest := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp()
+	if httpRequest == nil {
+		return
+	}
+	if httpRequest.Headers == nil {
+		httpRequest.Headers = map[string]string{}
+	}
+	httpRequest.Headers[c.RequestIdHeader] = newUuid()
+}
+
+// withRequestIdHeader sets the request id, received or generated, in RequestIdResponseHeader of an
+// authorized response and, with RequestIdOnDeny, of a denied one, so clients can quote it. An
+// authorized response the auth backend already set the header on is left as is.
+func (c *RemoteAuthService) withRequestIdHeader(authzRequest *api.AuthorizationRequest, response *api.AuthorizationResponse) *api.AuthorizationResponse {
+	if c.RequestIdResponseHeader == "" || response == nil {
+		return response
+	}
+	requestId := c.extractRequestId(authzRequest)
+	if requestId == nil {
+		return response
+	}
+	header := &envoycorev2.HeaderValueOption{Header: &envoycorev2.HeaderValue{Key: c.RequestIdResponseHeader, Value: *requestId}}
+	if isAllowedResponse(response) {
+		if ok := response.CheckResponse.GetOkResponse(); ok != nil {
+			if hasHeader(ok.Headers, c.RequestIdResponseHeader) {
+				return response
+			}
+			ok.Headers = append(ok.Headers, header)
+		} else {
+			response.CheckResponse.HttpResponse = &envoyauthv2.CheckResponse_OkResponse{
+				OkResponse: &envoyauthv2.OkHttpResponse{Headers: []*envoycorev2.HeaderValueOption{header}},
+			}
+		}
+		return response
+	}
+	if c.RequestIdOnDeny {
+		statusCode := envoytype.StatusCode_Forbidden
+		if response.CheckResponse.GetStatus().GetCode() == int32(code.Code_UNAUTHENTICATED) {
+			statusCode = envoytype.StatusCode_Unauthorized
+		}
+		withDenyHeaders(response, statusCode, []*envoycorev2.HeaderValueOption{header})
+	}
+	return response
+}
+
+// hasHeader reports whether headers has one named key, compared case-insensitively.
+func hasHeader(headers []*envoycorev2.HeaderValueOption, key string) bool {
+	for _, header := range headers {
+		if strings.EqualFold(header.GetHeader().GetKey(), key) {
+			return true
+		}
+	}
+	return false
+}
+
+// newUuid returns a random (version 4) UUID.
+func newUuid() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizeGeneratesMissingRequestId(t *testing.T) {
+	var forwarded []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get("x-tidepool-trace-request"))
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:           server.URL,
+		RequestIdHeader:   "x-tidepool-trace-request",
+		GenerateRequestId: true,
+	})
+	for _, headers := range []map[string]string{{"x-tidepool-trace-request": "request-1"}, {}, {}} {
+		if _, err := service.Authorize(context.Background(), newAuthorizationRequest(headers)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if forwarded[0] != "request-1" {
+		t.Errorf("expected the received request id to be kept, got %q", forwarded[0])
+	}
+	uuid := regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$")
+	for _, requestId := range forwarded[1:] {
+		if !uuid.MatchString(requestId) {
+			t.Errorf("expected a generated UUID request id, got %q", requestId)
+		}
+	}
+	if forwarded[1] == forwarded[2] {
+		t.Errorf("expected distinct generated request ids, got %q twice", forwarded[1])
+	}
+}
+
+func TestAuthorizeDoesNotGenerateRequestIdByDefault(t *testing.T) {
+	var forwarded http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, RequestIdHeader: "x-tidepool-trace-request"})
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{})); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if values, ok := forwarded["X-Tidepool-Trace-Request"]; ok {
+		t.Errorf("expected no request id, got %v", values)
+	}
+}
+
+func TestAuthorizeSetsRequestIdResponseHeader(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name            string
+		status          int
+		headers         map[string]string
+		requestIdOnDeny bool
+		expected        *regexp.Regexp
+	}{
+		{"received", http.StatusOK, map[string]string{"x-request-id": "request-1"}, false, regexp.MustCompile("^request-1$")},
+		{"generated", http.StatusOK, nil, false, regexp.MustCompile("^[0-9a-f]{8}-[0-9a-f]{4}-4")},
+		{"denied", http.StatusUnauthorized, map[string]string{"x-request-id": "request-1"}, false, nil},
+		{"denied with RequestIdOnDeny", http.StatusUnauthorized, map[string]string{"x-request-id": "request-1"}, true, regexp.MustCompile("^request-1$")},
+	}
+	for _, test := range tests {
+		status = test.status
+		service := newAuthService(t, &Config{
+			AuthUrl:                 server.URL,
+			RequestIdHeader:         "x-request-id",
+			GenerateRequestId:       true,
+			RequestIdResponseHeader: "X-Request-Id",
+			RequestIdOnDeny:         test.requestIdOnDeny,
+		})
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(test.headers))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		headers := response.CheckResponse.GetOkResponse().GetHeaders()
+		if denied := response.CheckResponse.GetDeniedResponse(); denied != nil {
+			headers = denied.GetHeaders()
+			if denied.GetStatus().GetCode() != 401 {
+				t.Errorf("%s: expected the denied status to be kept, got %v", test.name, denied.GetStatus())
+			}
+		}
+		var value string
+		for _, header := range headers {
+			if header.Header.Key == "X-Request-Id" {
+				value = header.Header.Value
+			}
+		}
+		if test.expected == nil && value != "" {
+			t.Errorf("%s: expected no request id header, got %q", test.name, value)
+		}
+		if test.expected != nil && !test.expected.MatchString(value) {
+			t.Errorf("%s: expected a request id header matching %v, got %q", test.name, test.expected, value)
+		}
+	}
+}
+
+func TestAuthorizeSetsRequestIdOnCachedDecisions(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:                 server.URL,
+		RequestIdHeader:         "x-request-id",
+		RequestIdResponseHeader: "X-Request-Id",
+		CacheTTL:                "1m",
+	})
+	for _, requestId := range []string{"request-1", "request-2"} {
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{"x-request-id": requestId}))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		headers := response.CheckResponse.GetOkResponse().GetHeaders()
+		if len(headers) != 1 || headers[0].Header.Value != requestId {
+			t.Errorf("expected only the %v request id header, got %v", requestId, headers)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected the decision to be cached, got %v auth calls", calls)
+	}
+}
+
+func TestAuthorizeKeepsRequestIdSetByBackend(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{\"request_id\": \"backend-1\"}")
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:                 server.URL,
+		RequestIdHeader:         "x-request-id",
+		RequestIdResponseHeader: "X-Request-Id",
+		ResponseHeaders:         map[string]string{"request_id": "x-request-id"},
+	})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{"x-request-id": "envoy-1"}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var values []string
+	for _, header := range response.CheckResponse.GetOkResponse().GetHeaders() {
+		if strings.EqualFold(header.Header.Key, "x-request-id") {
+			values = append(values, header.Header.Value)
+		}
+	}
+	if len(values) != 1 || values[0] != "backend-1" {
+		t.Errorf("expected only the request id set by the backend, got %v", values)
+	}
+}
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"strings"
+)
+
+const (
+	InvalidRequestJwtSkip = "skip"
+	InvalidRequestJwtDeny = "deny"
+)
+
+// requestJwtClaims decodes the JWT the incoming request carries in RequestJwtHeader, after
+// RequestJwtPrefix. It returns nil claims and no error when the request has no token.
+func (c *RemoteAuthService) requestJwtClaims(authzRequest *api.AuthorizationRequest) (map[string]interface{}, error) {
+	value := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp().GetHeaders()[c.requestJwtHeader]
+	if value == "" {
+		return nil, nil
+	}
+	if prefix := c.RequestJwtPrefix; prefix != "" {
+		if len(value) < len(prefix) || !strings.EqualFold(value[:len(prefix)], prefix) {
+			return nil, InvalidJwtError("expected the " + prefix + " prefix")
+		}
+		value = value[len(prefix):]
+	}
+	return decodeJwtClaims(strings.TrimSpace(value), c.requestJwtVerifier)
+}
+
+// requestJwtHeaders returns the RequestJwtClaimHeaders set from the claims of the request JWT,
+// none when the request has no valid one.
+func (c *RemoteAuthService) requestJwtHeaders(authzRequest *api.AuthorizationRequest) map[string]string {
+	claims, err := c.requestJwtClaims(authzRequest)
+	if err != nil || claims == nil {
+		return nil
+	}
+	extracted := applyMappings(claims, nil, c.requestJwtClaimMappings)
+	headers := make(map[string]string, len(extracted.headers))
+	for _, header := range extracted.headers {
+		headers[header.GetHeader().GetKey()] = header.GetHeader().GetValue()
+	}
+	return headers
+}
+
+// invalidRequestJwt reports whether the request is denied for carrying a JWT that's malformed or,
+// with RequestJwtVerificationKey, not validly signed, which OnInvalidRequestJwt deny does. Such
+// requests are forwarded without the claim headers otherwise.
+func (c *RemoteAuthService) invalidRequestJwt(log *zap.SugaredLogger, authzRequest *api.AuthorizationRequest) bool {
+	if len(c.requestJwtClaimMappings) == 0 {
+		return false
+	}
+	if _, err := c.requestJwtClaims(authzRequest); err != nil {
+		if c.OnInvalidRequestJwt == InvalidRequestJwtDeny {
+			log.Infow("Invalid request JWT, denying it without calling the auth backend", zap.Error(err))
+			return true
+		}
+		log.Infow("Invalid request JWT, forwarding the request without its claims", zap.Error(err))
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestAuthorizeForwardsRequestJwtClaims(t *testing.T) {
+	token := hs256Jwt(t, "s3cr3t", `{"iss": "https://clinic.example", "sub": "123"}`)
+	tests := []struct {
+		name          string
+		authorization string
+		policy        string
+		allowed       bool
+		issuer        string
+	}{
+		{"valid token", "Bearer " + token, "", true, "https://clinic.example"},
+		{"lowercase prefix", "bearer " + token, "", true, "https://clinic.example"},
+		{"no token", "", InvalidRequestJwtDeny, true, ""},
+		{"wrong signature skipped", "Bearer " + hs256Jwt(t, "other", `{"iss": "evil"}`), "", true, ""},
+		{"malformed token skipped", "Bearer abc", InvalidRequestJwtSkip, true, ""},
+		{"missing prefix skipped", token, "", true, ""},
+		{"malformed token denied", "Bearer abc", InvalidRequestJwtDeny, false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var forwarded http.Header
+			calls := 0
+			service := newAuthService(t, &Config{
+				AuthUrl:                   "http://auth",
+				RequestJwtHeader:          "Authorization",
+				RequestJwtPrefix:          "Bearer ",
+				RequestJwtClaimHeaders:    map[string]string{"iss": "x-token-issuer", "sub": "x-token-subject"},
+				RequestJwtVerificationKey: "s3cr3t",
+				OnInvalidRequestJwt:       test.policy,
+			})
+			service.httpClient = doerFunc(func(request *http.Request) (*http.Response, error) {
+				calls++
+				forwarded = request.Header
+				return stubResponse(http.StatusOK, "")(request)
+			})
+			headers := map[string]string{}
+			if test.authorization != "" {
+				headers["authorization"] = test.authorization
+			}
+			response, err := service.Authorize(context.Background(), newAuthorizationRequest(headers))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if isAllowedResponse(response) != test.allowed {
+				t.Fatalf("expected allowed %v, got %v", test.allowed, isAllowedResponse(response))
+			}
+			if !test.allowed {
+				if calls != 0 {
+					t.Errorf("expected no auth call for a denied request, got %v", calls)
+				}
+				return
+			}
+			if value := forwarded.Get("X-Token-Issuer"); value != test.issuer {
+				t.Errorf("expected the issuer header to be %q, got %q", test.issuer, value)
+			}
+			if value := forwarded.Get("X-Token-Subject"); test.issuer != "" && value != "123" {
+				t.Errorf("expected the subject header to be 123, got %q", value)
+			}
+		})
+	}
+}
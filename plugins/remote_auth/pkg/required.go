@@ -0,0 +1,19 @@
+package pkg
+
+import (
+	"github.com/solo-io/ext-auth-plugins/api"
+)
+
+const DefaultMissingHeaderReason = "Missing required request header"
+
+// missingRequestHeader returns the first of RequiredRequestHeaders the request lacks, or carries
+// with an empty value, or "" when it has them all.
+func (c *RemoteAuthService) missingRequestHeader(authzRequest *api.AuthorizationRequest) string {
+	headers := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	for _, header := range c.requiredRequestHeaders {
+		if headers[header] == "" {
+			return header
+		}
+	}
+	return ""
+}
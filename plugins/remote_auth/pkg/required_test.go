@@ -0,0 +1,44 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestAuthorizeDeniesMissingRequiredHeaders(t *testing.T) {
+	calls := 0
+	service := newAuthService(t, &Config{
+		AuthUrl:                "http://auth",
+		RequiredRequestHeaders: []string{"Authorization", "X-Tidepool-Session-Token"},
+		MissingHeaderReason:    "Token required",
+	})
+	service.httpClient = doerFunc(func(request *http.Request) (*http.Response, error) {
+		calls++
+		return stubResponse(http.StatusOK, "")(request)
+	})
+
+	tests := []struct {
+		headers map[string]string
+		allowed bool
+		calls   int
+	}{
+		{map[string]string{"authorization": "Bearer abc", "x-tidepool-session-token": "xyz"}, true, 1},
+		{map[string]string{"authorization": "Bearer abc"}, false, 0},
+		{map[string]string{"authorization": "", "x-tidepool-session-token": "xyz"}, false, 0},
+		{nil, false, 0},
+	}
+	for _, test := range tests {
+		calls = 0
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(test.headers))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if isAllowedResponse(response) != test.allowed || calls != test.calls {
+			t.Errorf("%v: expected allowed %v after %v auth calls, got %v after %v", test.headers, test.allowed, test.calls, isAllowedResponse(response), calls)
+		}
+		if body := response.CheckResponse.GetDeniedResponse().GetBody(); !test.allowed && body != `{"reason":"Token required"}` {
+			t.Errorf("%v: expected the configured deny reason, got %q", test.headers, body)
+		}
+	}
+}
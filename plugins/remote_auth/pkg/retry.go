@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// RetryBudgetSpentError fails an attempt whose response didn't arrive within the TotalRetryBudget.
+var RetryBudgetSpentError = errors.New("retry budget spent before the auth backend responded")
+
+// retryBudgetEnds returns when a TotalRetryBudget starting now ends, or the zero time without one.
+func (c *RemoteAuthService) retryBudgetEnds() time.Time {
+	if c.totalRetryBudget <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.totalRetryBudget)
+}
+
+// callUpstreamWithinBudget calls authUrl once, cancelling the call with RetryBudgetSpentError when
+// its response hasn't arrived by budgetEnds, unless it's zero. The budget stops applying once the
+// response arrives, so a decision received in time isn't cut short while its body is read.
+func (c *RemoteAuthService) callUpstreamWithinBudget(ctx context.Context, budgetEnds time.Time, authUrl string, authzRequest *api.AuthorizationRequest, span *span) (*http.Response, error) {
+	if budgetEnds.IsZero() {
+		return c.callUpstream(ctx, authUrl, authzRequest, span)
+	}
+	// Released with ctx once the response has been read.
+	attemptCtx, cancel := context.WithCancel(ctx)
+	timer := time.AfterFunc(time.Until(budgetEnds), cancel)
+	response, err := c.callUpstream(attemptCtx, authUrl, authzRequest, span)
+	if !timer.Stop() && ctx.Err() == nil {
+		if err == nil {
+			response.Body.Close()
+		}
+		return nil, RetryBudgetSpentError
+	}
+	return response, err
+}
+
+// callUpstreamWithRetries calls authUrl, retrying up to MaxRetries times on connection errors and
+// on 429, 502, 503 and 504 responses. Retries wait for the Retry-After of 429 and 503 responses
+// or else back off exponentially from RetryBackoff with jitter, and for a RateLimit token. A retry
+// that can't be made before budgetEnds, unless it's zero, or the deadline of ctx isn't attempted
+// and the last result is returned instead. Requests with a non-idempotent method are only retried
+// with RetryNonIdempotent.
+func (c *RemoteAuthService) callUpstreamWithRetries(ctx context.Context, log *zap.SugaredLogger, budgetEnds time.Time, authUrl string, authzRequest *api.AuthorizationRequest, span *span) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		response, err := c.callUpstreamWithinBudget(ctx, budgetEnds, authUrl, authzRequest, span)
+		if attempt >= c.MaxRetries || ctx.Err() != nil || err == RetryBudgetSpentError || !c.retriesMethod(c.authMethod) || !isRetryable(response, err) {
+			return response, err
+		}
+		delay := c.retryDelay(attempt, response)
+		retryLog := log
+		if !budgetEnds.IsZero() {
+			remaining := time.Until(budgetEnds)
+			if delay >= remaining {
+				log.Infow("Not retrying upstream call past the retry budget",
+					zap.Duration("delay", delay), zap.Duration("remaining_budget", remaining))
+				return response, err
+			}
+			retryLog = log.With(zap.Duration("remaining_budget", remaining))
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			log.Debugw("Not retrying upstream call past the request deadline", zap.Duration("delay", delay))
+			return response, err
+		}
+		if !c.waitToRetry(ctx, log, budgetEnds) {
+			return response, err
+		}
+
+		if err != nil {
+			retryLog.Infow("Retrying upstream call after error", zap.Error(err), zap.Int("attempt", attempt+1), zap.Duration("delay", delay))
+		} else {
+			retryLog.Infow("Retrying upstream call after unsuccessful response",
+				zap.Int("status_code", response.StatusCode), zap.Int("attempt", attempt+1), zap.Duration("delay", delay))
+			io.Copy(ioutil.Discard, io.LimitReader(response.Body, int64(c.maxResponseBytes)))
+			response.Body.Close()
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// retriesMethod reports whether auth requests with the method may be retried.
+func (c *RemoteAuthService) retriesMethod(method string) bool {
+	return c.RetryNonIdempotent || isIdempotentMethod(method)
+}
+
+func isIdempotentMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+func isRetryable(response *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns the wait before retrying the given attempt, counting from 0.
+func (c *RemoteAuthService) retryDelay(attempt int, response *http.Response) time.Duration {
+	if response != nil && (response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable) {
+		if delay, ok := parseRetryAfter(response.Header.Get("Retry-After"), time.Now()); ok {
+			return delay
+		}
+	}
+	backoff := c.retryBackoff << uint(attempt)
+	if backoff <= 0 {
+		return c.retryBackoff
+	}
+	// Waits between half and all of the backoff, so instances don't retry in lockstep.
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// parseRetryAfter parses a Retry-After header in either its delay-seconds or HTTP-date form.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
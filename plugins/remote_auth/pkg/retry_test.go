@@ -0,0 +1,238 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeRetriesUnavailableBackend(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, MaxRetries: 2, RetryBackoff: "10ms"})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !isAllowedResponse(response) {
+		t.Error("expected the request to be allowed after retrying")
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 3 {
+		t.Errorf("expected 3 upstream calls, got %v", calls)
+	}
+}
+
+func TestAuthorizeDoesNotRetryDenials(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, MaxRetries: 2, RetryBackoff: "10ms"})
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("expected a single upstream call, got %v", calls)
+	}
+}
+
+func TestAuthorizeDoesNotRetryPastDeadline(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, MaxRetries: 2, RequestTimeout: "1s"})
+	started := time.Now()
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if isAllowedResponse(response) {
+		t.Error("expected the request to be denied")
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("expected no wait for a retry past the deadline, took %v", elapsed)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("expected a single upstream call, got %v", calls)
+	}
+}
+
+func TestAuthorizeStopsRetryingWhenBudgetIsSpent(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(40 * time.Millisecond)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	// The third attempt starts at about 80ms and is cancelled with the budget at 100ms.
+	for _, failureMode := range []string{FailureModeClosed, FailureModeOpen} {
+		atomic.StoreInt32(&calls, 0)
+		service := newAuthService(t, &Config{
+			AuthUrl:          server.URL,
+			MaxRetries:       10,
+			RetryBackoff:     "1ms",
+			TotalRetryBudget: "100ms",
+			FailureMode:      failureMode,
+		})
+		started := time.Now()
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		if failureMode == FailureModeClosed && err == nil {
+			t.Errorf("%v: expected an error, got response %v", failureMode, response)
+		}
+		if failureMode == FailureModeOpen && (err != nil || !isAllowedResponse(response)) {
+			t.Errorf("%v: expected the request to fail open, got response %v and error %v", failureMode, response, err)
+		}
+		if elapsed := time.Since(started); elapsed > 250*time.Millisecond {
+			t.Errorf("%v: expected retries to stop within the budget, took %v", failureMode, elapsed)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != 3 {
+			t.Errorf("%v: expected the budget to allow 3 attempts, got %v", failureMode, calls)
+		}
+	}
+}
+
+func TestAuthorizeFailsPerFailureModeWhenBudgetIsSpent(t *testing.T) {
+	var calls int32
+	service := newAuthService(t, &Config{
+		AuthUrl:          "http://auth.example.com",
+		MaxRetries:       5,
+		RetryBackoff:     "50ms",
+		TotalRetryBudget: "60ms",
+		FailureMode:      FailureModeOpen,
+	})
+	service.httpClient = doerFunc(func(request *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, errors.New("connection refused")
+	})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil || !isAllowedResponse(response) {
+		t.Errorf("expected the request to fail open, got response %v and error %v", response, err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls >= 5 {
+		t.Errorf("expected the budget to stop retries early, got %v calls", calls)
+	}
+}
+
+func TestAuthorizeCancelsAttemptsPastBudget(t *testing.T) {
+	var primaryCalls int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryCalls, 1)
+		time.Sleep(30 * time.Millisecond)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer fallback.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:          primary.URL,
+		FallbackAuthUrl:  fallback.URL,
+		MaxRetries:       1,
+		RetryBackoff:     "10ms",
+		TotalRetryBudget: "150ms",
+	})
+	started := time.Now()
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err == nil {
+		t.Error("expected the request to fail with the fallback attempt cancelled")
+	}
+	if elapsed := time.Since(started); elapsed > 400*time.Millisecond {
+		t.Errorf("expected the fallback attempt to be cancelled with the budget, took %v", elapsed)
+	}
+	if calls := atomic.LoadInt32(&primaryCalls); calls != 2 {
+		t.Errorf("expected the primary to be retried once, got %v calls", calls)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"-1", 0, false},
+		{"Sun, 01 Mar 2020 12:00:10 GMT", 10 * time.Second, true},
+		{"Sun, 01 Mar 2020 11:59:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		delay, ok := parseRetryAfter(test.value, now)
+		if delay != test.delay || ok != test.ok {
+			t.Errorf("expected %q to parse to %v (%v), got %v (%v)", test.value, test.delay, test.ok, delay, ok)
+		}
+	}
+}
+
+func TestRetryDelayBacksOffWithJitter(t *testing.T) {
+	service := &RemoteAuthService{retryBackoff: 100 * time.Millisecond}
+	for attempt, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		for i := 0; i < 20; i++ {
+			if delay := service.retryDelay(attempt, nil); delay < expected/2 || delay > expected {
+				t.Errorf("expected attempt %v to wait between %v and %v, got %v", attempt, expected/2, expected, delay)
+			}
+		}
+	}
+}
+
+func TestAuthorizeRetriesOnlyIdempotentMethods(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		method             string
+		retryNonIdempotent bool
+		expectedCalls      int32
+	}{
+		{http.MethodGet, false, 3},
+		{http.MethodHead, false, 3},
+		{http.MethodPost, false, 1},
+		{http.MethodPut, false, 1},
+		{http.MethodPost, true, 3},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&calls, 0)
+		service := newAuthService(t, &Config{AuthUrl: server.URL, MaxRetries: 2, RetryBackoff: "1ms", RetryNonIdempotent: test.retryNonIdempotent})
+		service.authMethod = test.method
+		if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.method, err)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != test.expectedCalls {
+			t.Errorf("%s with RetryNonIdempotent %v: expected %v upstream calls, got %v", test.method, test.retryNonIdempotent, test.expectedCalls, calls)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	SchemaViolationDeny  = "deny"
+	SchemaViolationError = "error"
+)
+
+// responseSchema is a compiled ResponseSchema. The supported JSON Schema subset is type, as a
+// name or a list of names among "object", "array", "string", "number", "integer", "boolean" and
+// "null", enum, const, required, properties, additionalProperties as a boolean or a schema, items
+// as a single schema, minItems, maxItems, minLength, maxLength, pattern, minimum and maximum.
+// Annotations such as title and description are ignored, any other keyword is rejected so a
+// schema never checks less than it appears to.
+type responseSchema struct {
+	types      []string
+	enum       []interface{}
+	required   []string
+	properties map[string]*responseSchema
+	// Schema of the properties not in properties, nil when they aren't checked.
+	additionalProperties *responseSchema
+	// Set when additionalProperties is false.
+	noAdditionalProperties bool
+	items                  *responseSchema
+	minItems               *float64
+	maxItems               *float64
+	minLength              *float64
+	maxLength              *float64
+	pattern                *regexp.Regexp
+	minimum                *float64
+	maximum                *float64
+}
+
+var schemaAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+}
+
+var schemaTypes = map[string]bool{
+	"object":  true,
+	"array":   true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"null":    true,
+}
+
+// schemaViolationError is returned by extractResponse when the auth response body doesn't match
+// ResponseSchema.
+type schemaViolationError struct {
+	violations []string
+}
+
+func (e *schemaViolationError) Error() string {
+	return "auth response doesn't match ResponseSchema: " + strings.Join(e.violations, "; ")
+}
+
+// compileResponseSchema parses a ResponseSchema, returning nil when it's empty.
+func compileResponseSchema(schema string) (*responseSchema, error) {
+	if schema == "" {
+		return nil, nil
+	}
+	var raw interface{}
+	if err := json.Unmarshal([]byte(schema), &raw); err != nil {
+		return nil, err
+	}
+	return compileSchema(raw, "$")
+}
+
+func compileSchema(raw interface{}, path string) (*responseSchema, error) {
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: schema must be an object", path)
+	}
+	schema := &responseSchema{}
+	for _, keyword := range sortedObjectKeys(object) {
+		value := object[keyword]
+		var err error
+		switch keyword {
+		case "type":
+			schema.types, err = schemaTypeNames(value)
+		case "enum":
+			values, ok := value.([]interface{})
+			if !ok || len(values) == 0 {
+				err = errors.New("must be a non-empty array")
+			}
+			schema.enum = values
+		case "const":
+			schema.enum = []interface{}{value}
+		case "required":
+			schema.required, err = schemaStrings(value)
+		case "properties":
+			properties, ok := value.(map[string]interface{})
+			if !ok {
+				err = errors.New("must be an object")
+				break
+			}
+			schema.properties = make(map[string]*responseSchema, len(properties))
+			for name, property := range properties {
+				if schema.properties[name], err = compileSchema(property, path+"."+name); err != nil {
+					return nil, err
+				}
+			}
+		case "additionalProperties":
+			if allowed, ok := value.(bool); ok {
+				schema.noAdditionalProperties = !allowed
+				break
+			}
+			if schema.additionalProperties, err = compileSchema(value, path+".*"); err != nil {
+				return nil, err
+			}
+		case "items":
+			if schema.items, err = compileSchema(value, path+"[*]"); err != nil {
+				return nil, err
+			}
+		case "minItems":
+			schema.minItems, err = schemaBound(value)
+		case "maxItems":
+			schema.maxItems, err = schemaBound(value)
+		case "minLength":
+			schema.minLength, err = schemaBound(value)
+		case "maxLength":
+			schema.maxLength, err = schemaBound(value)
+		case "pattern":
+			pattern, ok := value.(string)
+			if !ok {
+				err = errors.New("must be a string")
+				break
+			}
+			schema.pattern, err = regexp.Compile(pattern)
+		case "minimum":
+			schema.minimum, err = schemaNumber(value)
+		case "maximum":
+			schema.maximum, err = schemaNumber(value)
+		default:
+			if !schemaAnnotations[keyword] {
+				err = errors.New("unsupported keyword")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s %v", path, keyword, err)
+		}
+	}
+	return schema, nil
+}
+
+// validate appends a violation per way value doesn't match the schema, as "<path>: <problem>".
+func (s *responseSchema) validate(value interface{}, path string, violations []string) []string {
+	if len(s.types) > 0 && !hasSchemaType(value, s.types) {
+		return append(violations, fmt.Sprintf("%s: expected %s, got %s", path, strings.Join(s.types, " or "), schemaTypeOf(value)))
+	}
+	if len(s.enum) > 0 {
+		matched := false
+		for _, allowed := range s.enum {
+			matched = matched || reflect.DeepEqual(value, allowed)
+		}
+		if !matched {
+			violations = append(violations, fmt.Sprintf("%s: not one of the allowed values", path))
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				violations = append(violations, fmt.Sprintf("%s: missing required property %s", path, name))
+			}
+		}
+		for _, name := range sortedObjectKeys(v) {
+			if property, ok := s.properties[name]; ok {
+				violations = property.validate(v[name], path+"."+name, violations)
+			} else if s.noAdditionalProperties {
+				violations = append(violations, fmt.Sprintf("%s: unexpected property %s", path, name))
+			} else if s.additionalProperties != nil {
+				violations = s.additionalProperties.validate(v[name], path+"."+name, violations)
+			}
+		}
+	case []interface{}:
+		if s.minItems != nil && float64(len(v)) < *s.minItems {
+			violations = append(violations, fmt.Sprintf("%s: expected at least %v items, got %d", path, *s.minItems, len(v)))
+		}
+		if s.maxItems != nil && float64(len(v)) > *s.maxItems {
+			violations = append(violations, fmt.Sprintf("%s: expected at most %v items, got %d", path, *s.maxItems, len(v)))
+		}
+		if s.items != nil {
+			for i, item := range v {
+				violations = s.items.validate(item, fmt.Sprintf("%s[%d]", path, i), violations)
+			}
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if s.minLength != nil && length < *s.minLength {
+			violations = append(violations, fmt.Sprintf("%s: expected at least %v characters", path, *s.minLength))
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			violations = append(violations, fmt.Sprintf("%s: expected at most %v characters", path, *s.maxLength))
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			violations = append(violations, fmt.Sprintf("%s: doesn't match %s", path, s.pattern))
+		}
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			violations = append(violations, fmt.Sprintf("%s: expected at least %v, got %v", path, *s.minimum, v))
+		}
+		if s.maximum != nil && v > *s.maximum {
+			violations = append(violations, fmt.Sprintf("%s: expected at most %v, got %v", path, *s.maximum, v))
+		}
+	}
+	return violations
+}
+
+// checkResponseSchema returns a schemaViolationError when data, the decoded auth response body,
+// doesn't match the schema.
+func checkResponseSchema(schema *responseSchema, data map[string]interface{}) error {
+	var value interface{} = data
+	if data == nil {
+		value = nil
+	}
+	if violations := schema.validate(value, "$", nil); len(violations) > 0 {
+		return &schemaViolationError{violations: violations}
+	}
+	return nil
+}
+
+func hasSchemaType(value interface{}, types []string) bool {
+	actual := schemaTypeOf(value)
+	for _, t := range types {
+		if t == actual || t == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaTypeOf returns the JSON Schema type of a decoded value; numbers without a fractional part
+// are integers.
+func schemaTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func schemaTypeNames(value interface{}) ([]string, error) {
+	var names []string
+	if name, ok := value.(string); ok {
+		names = []string{name}
+	} else {
+		var err error
+		if names, err = schemaStrings(value); err != nil || len(names) == 0 {
+			return nil, errors.New("must be a type name or a non-empty array of them")
+		}
+	}
+	for _, name := range names {
+		if !schemaTypes[name] {
+			return nil, errors.New("unknown type " + name)
+		}
+	}
+	return names, nil
+}
+
+func schemaStrings(value interface{}) ([]string, error) {
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("must be an array of strings")
+	}
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.New("must be an array of strings")
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func schemaNumber(value interface{}) (*float64, error) {
+	number, ok := value.(float64)
+	if !ok {
+		return nil, errors.New("must be a number")
+	}
+	return &number, nil
+}
+
+func schemaBound(value interface{}) (*float64, error) {
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != math.Trunc(number) {
+		return nil, errors.New("must be a non-negative integer")
+	}
+	return &number, nil
+}
+
+// sortedObjectKeys returns the keys of object in order, so violations and errors are reported
+// deterministically.
+func sortedObjectKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
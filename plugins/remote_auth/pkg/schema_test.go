@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const userSchema = `{
+	"type": "object",
+	"required": ["userid"],
+	"properties": {
+		"userid": {"type": "string", "pattern": "^[0-9a-f]+$"},
+		"roles": {"type": "array", "items": {"enum": ["admin", "clinician"]}, "maxItems": 2},
+		"age": {"type": "integer", "minimum": 0}
+	},
+	"additionalProperties": false
+}`
+
+func TestResponseSchemaValidate(t *testing.T) {
+	schema, err := compileResponseSchema(userSchema)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		body     string
+		expected []string
+	}{
+		{`{"userid": "abc", "roles": ["admin"], "age": 30}`, nil},
+		{`{"roles": []}`, []string{"$: missing required property userid"}},
+		{`{"userid": 123}`, []string{"$.userid: expected string, got integer"}},
+		{`{"userid": "xyz"}`, []string{"$.userid: doesn't match ^[0-9a-f]+$"}},
+		{`{"userid": "abc", "roles": ["admin", "patient", "clinician"]}`, []string{
+			"$.roles: expected at most 2 items, got 3",
+			"$.roles[1]: not one of the allowed values",
+		}},
+		{`{"userid": "abc", "age": 1.5}`, []string{"$.age: expected integer, got number"}},
+		{`{"userid": "abc", "email": "a@b.c"}`, []string{"$: unexpected property email"}},
+		{`null`, []string{"$: expected object, got null"}},
+	}
+	for _, test := range tests {
+		data, err := decodeResponseBody(strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.body, err)
+		}
+		var violations []string
+		if err := checkResponseSchema(schema, data); err != nil {
+			violations = err.(*schemaViolationError).violations
+		}
+		if !reflect.DeepEqual(violations, test.expected) {
+			t.Errorf("%s: expected violations %q, got %q", test.body, test.expected, violations)
+		}
+	}
+}
+
+func TestCompileResponseSchemaRejectsUnsupportedKeywords(t *testing.T) {
+	for _, schema := range []string{
+		`{"type": "object", "properties": {"userid": {"format": "uuid"}}}`,
+		`{"oneOf": [{"type": "string"}]}`,
+		`{"type": "uuid"}`,
+		`{"minLength": -1}`,
+		`[]`,
+	} {
+		if _, err := compileResponseSchema(schema); err == nil {
+			t.Errorf("expected %s to be rejected", schema)
+		}
+	}
+	if _, err := compileResponseSchema(`{"title": "user", "description": "the user", "type": ["object", "null"]}`); err != nil {
+		t.Errorf("expected annotations to be ignored, got %v", err)
+	}
+}
+
+func TestAuthorizeChecksResponseSchema(t *testing.T) {
+	body := `{"userid": "abc"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "schema")
+	if err != nil {
+		t.Fatalf("unable to create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	schemaFile := filepath.Join(dir, "schema.json")
+	if err := ioutil.WriteFile(schemaFile, []byte(userSchema), 0600); err != nil {
+		t.Fatalf("unable to write the schema: %v", err)
+	}
+	for _, onViolation := range []string{"", SchemaViolationError} {
+		service := newAuthService(t, &Config{
+			AuthUrl:           server.URL,
+			ResponseHeaders:   map[string]string{"userid": "x-auth-subject-id"},
+			ResponseSchema:    SecretFilePrefix + schemaFile,
+			OnSchemaViolation: onViolation,
+		})
+
+		body = `{"userid": "abc"}`
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != "abc" {
+			t.Errorf("expected a matching response to be allowed with its headers, got %q", value)
+		}
+
+		body = `{"user_id": "abc"}`
+		response, err = service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		if onViolation == SchemaViolationError {
+			if _, ok := err.(*schemaViolationError); !ok {
+				t.Errorf("expected a schema violation error, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if isAllowedResponse(response) {
+			t.Error("expected a response violating the schema to be denied")
+		}
+	}
+}
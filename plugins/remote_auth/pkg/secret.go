@@ -0,0 +1,74 @@
+package pkg
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	SecretFilePrefix = "file://"
+	SecretEnvPrefix  = "env:"
+)
+
+// resolveSecrets returns a copy of the config with the secret fields that reference a file, e.g.
+// "file:///etc/remote-auth/signing-secret", or an environment variable, e.g. "env:SIGNING_SECRET",
+// replaced by their contents, so secrets can be kept out of the plugin config. References are
+// resolved each time a service is created from the config, so a changed file is picked up by the
+// next config instantiation. The resolved fields are SigningSecret, ClientAssertionKey,
+// JwtVerificationKey, RequestJwtVerificationKey, BypassValue and the StaticQueryParams values, as
+// well as ResponseSchema, which isn't secret but is often kept in a file of its own.
+func resolveSecrets(config *Config) (*Config, error) {
+	resolved := *config
+	secrets := []struct {
+		field string
+		value *string
+	}{
+		{"SigningSecret", &resolved.SigningSecret},
+		{"ClientAssertionKey", &resolved.ClientAssertionKey},
+		{"JwtVerificationKey", &resolved.JwtVerificationKey},
+		{"RequestJwtVerificationKey", &resolved.RequestJwtVerificationKey},
+		{"BypassValue", &resolved.BypassValue},
+		{"ResponseSchema", &resolved.ResponseSchema},
+	}
+	for _, secret := range secrets {
+		value, err := resolveSecret(*secret.value)
+		if err != nil {
+			return nil, InvalidConfigError(secret.field, err)
+		}
+		*secret.value = value
+	}
+	if len(config.StaticQueryParams) > 0 {
+		resolved.StaticQueryParams = make(map[string]string, len(config.StaticQueryParams))
+		for name, value := range config.StaticQueryParams {
+			value, err := resolveSecret(value)
+			if err != nil {
+				return nil, InvalidConfigError("StaticQueryParams", err)
+			}
+			resolved.StaticQueryParams[name] = value
+		}
+	}
+	return &resolved, nil
+}
+
+// resolveSecret reads a "file://<path>" or "env:<name>" reference, returning any other value as
+// is. A trailing newline of the file is dropped, as most editors and kubectl secrets add one.
+func resolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SecretFilePrefix):
+		b, err := ioutil.ReadFile(strings.TrimPrefix(value, SecretFilePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r"), nil
+	case strings.HasPrefix(value, SecretEnvPrefix):
+		name := strings.TrimPrefix(value, SecretEnvPrefix)
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("environment variable " + name + " is not set")
+		}
+		return resolved, nil
+	}
+	return value, nil
+}
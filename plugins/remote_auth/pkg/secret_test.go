@@ -0,0 +1,81 @@
+package pkg
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatalf("unable to create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("unable to write the secret: %v", err)
+	}
+	os.Setenv("REMOTE_AUTH_TEST_SECRET", "from-env")
+	defer os.Unsetenv("REMOTE_AUTH_TEST_SECRET")
+
+	tests := []struct {
+		value    string
+		expected string
+		fails    bool
+	}{
+		{"inline", "inline", false},
+		{SecretFilePrefix + path, "from-file", false},
+		{SecretEnvPrefix + "REMOTE_AUTH_TEST_SECRET", "from-env", false},
+		{SecretFilePrefix + filepath.Join(dir, "missing"), "", true},
+		{SecretEnvPrefix + "REMOTE_AUTH_TEST_UNSET", "", true},
+	}
+	for _, test := range tests {
+		resolved, err := resolveSecret(test.value)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: expected failure %v, got %v", test.value, test.fails, err)
+		}
+		if resolved != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.value, test.expected, resolved)
+		}
+	}
+}
+
+func TestGetAuthServiceResolvesSecretReferences(t *testing.T) {
+	var apiKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey = r.URL.Query().Get("api_key")
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatalf("unable to create a temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api-key")
+
+	config := &Config{AuthUrl: server.URL, StaticQueryParams: map[string]string{"api_key": SecretFilePrefix + path}}
+	for _, key := range []string{"first", "rotated"} {
+		if err := ioutil.WriteFile(path, []byte(key), 0600); err != nil {
+			t.Fatalf("unable to write the secret: %v", err)
+		}
+		if _, err := newAuthService(t, config).Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if apiKey != key {
+			t.Errorf("expected the api key %q read from the file, got %q", key, apiKey)
+		}
+	}
+	if config.StaticQueryParams["api_key"] != SecretFilePrefix+path {
+		t.Errorf("expected the config to keep the reference, got %q", config.StaticQueryParams["api_key"])
+	}
+
+	config = &Config{AuthUrl: server.URL, SigningSecret: SecretEnvPrefix + "REMOTE_AUTH_TEST_UNSET"}
+	if _, err := new(RemoteAuthPlugin).GetAuthService(context.Background(), config); err == nil {
+		t.Error("expected an unresolvable reference to fail")
+	}
+}
@@ -0,0 +1,25 @@
+package pkg
+
+import (
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/code"
+)
+
+// shadowResponse logs the decision of a ShadowMode request and allows it regardless. Authorized
+// responses are returned as is, so their headers still reach the upstream service.
+func (c *RemoteAuthService) shadowResponse(log *zap.SugaredLogger, response *api.AuthorizationResponse, err error) *api.AuthorizationResponse {
+	if err != nil {
+		log.Warnw("Shadow mode: request would have failed, allowing", zap.Error(err))
+		return api.AuthorizedResponse()
+	}
+	if response.CheckResponse.GetStatus().GetCode() != int32(code.Code_OK) {
+		denied := response.CheckResponse.GetDeniedResponse()
+		log.Infow("Shadow mode: request would have been denied, allowing",
+			zap.Int32("grpc_status_code", response.CheckResponse.GetStatus().GetCode()),
+			zap.Int32("denied_status_code", int32(denied.GetStatus().GetCode())),
+			zap.String("deny_body", denied.GetBody()))
+		return api.AuthorizedResponse()
+	}
+	return response
+}
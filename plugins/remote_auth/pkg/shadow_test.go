@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeShadowModeNeverDenies(t *testing.T) {
+	status := http.StatusUnauthorized
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, "{\"userid\": \"123456\", \"reason\": \"expired\"}")
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:           server.URL,
+		ResponseHeaders:   map[string]string{"userid": "x-auth-subject-id"},
+		EnableDenyReasons: true,
+		ShadowMode:        true,
+	})
+	response, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if response.CheckResponse.GetStatus().GetCode() != int32(code.Code_OK) {
+		t.Errorf("expected a denied request to be allowed in shadow mode, got %v", response.CheckResponse)
+	}
+
+	status = http.StatusOK
+	response, err = service.Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != "123456" {
+		t.Errorf("expected allowed responses to keep their headers, got %q", value)
+	}
+
+	server.Close()
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != nil {
+		t.Errorf("expected upstream errors to be allowed in shadow mode, got %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const DefaultDrainTimeout = 5 * time.Second
+
+var (
+	ServiceStoppedError = errors.New("auth service is stopped")
+	DrainTimeoutError   = errors.New("timed out draining in-flight auth requests")
+)
+
+// shutdown tracks in-flight Authorize calls so that stopping the service can wait for them to
+// complete before cancelling the stragglers.
+type shutdown struct {
+	mu           sync.Mutex
+	stopping     bool
+	inFlight     sync.WaitGroup
+	stopped      chan struct{}
+	stopOnce     sync.Once
+	drainTimeout time.Duration
+}
+
+func newShutdown(drainTimeout time.Duration) *shutdown {
+	return &shutdown{stopped: make(chan struct{}), drainTimeout: drainTimeout}
+}
+
+// track registers an in-flight call, returning the func to call once it completes, or
+// ServiceStoppedError once the service is stopping.
+func (s *shutdown) track() (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopping {
+		return nil, ServiceStoppedError
+	}
+	s.inFlight.Add(1)
+	return s.inFlight.Done, nil
+}
+
+func (s *shutdown) isStopping() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stopping
+}
+
+// stop rejects new calls and waits for in-flight calls for up to the drain timeout, or until ctx
+// is done, then cancels the remaining ones.
+func (s *shutdown) stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		s.inFlight.Wait()
+		close(drained)
+	}()
+	timer := time.NewTimer(s.drainTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-drained:
+	case <-timer.C:
+		err = DrainTimeoutError
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	s.stopOnce.Do(func() { close(s.stopped) })
+	return err
+}
+
+// Start stops the service once ctx is done, as the plugin API has no stop hook of its own, and
+// starts the WarmupDuration, health checks and admin server when configured.
+func (c *RemoteAuthService) Start(ctx context.Context) error {
+	c.startWarmup()
+	go c.stopWhenDone(ctx, c.Stop)
+	if c.health != nil {
+		go c.checkHealthPeriodically(c.requestLogger(ctx))
+	}
+	if c.admin != nil {
+		go c.serveAdmin(c.requestLogger(ctx))
+	}
+	return nil
+}
+
+func (c *RemoteAuthService) stopWhenDone(ctx context.Context, stop func(context.Context) error) {
+	<-ctx.Done()
+	if err := stop(context.Background()); err != nil {
+		c.requestLogger(ctx).Warnw("Unable to drain in-flight auth requests", zap.Error(err))
+	}
+}
+
+// Stop waits for in-flight Authorize calls to complete, for up to DrainTimeout, cancels those
+// still running, shuts the admin server down and releases the shared transport, closing its idle
+// connections to the auth backend unless another service still uses it. Later calls to Authorize
+// fail with ServiceStoppedError.
+func (c *RemoteAuthService) Stop(ctx context.Context) error {
+	err := c.shutdown.stop(ctx)
+	if adminErr := c.stopAdmin(ctx); err == nil {
+		err = adminErr
+	}
+	if c.releaseTransport != nil {
+		c.releaseTransport()
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStopDrainsInFlightRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, DrainTimeout: "1s"})
+	result := make(chan error, 1)
+	go func() {
+		_, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := service.Stop(context.Background()); err != nil {
+		t.Errorf("unexpected error stopping the service: %v", err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("expected the in-flight request to complete, got %v", err)
+	}
+	if _, err := service.Authorize(context.Background(), newAuthorizationRequest(nil)); err != ServiceStoppedError {
+		t.Errorf("expected ServiceStoppedError after stopping, got %v", err)
+	}
+}
+
+func TestStopCancelsRequestsAfterDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	service := newAuthService(t, &Config{AuthUrl: server.URL, DrainTimeout: "20ms"})
+	result := make(chan error, 1)
+	go func() {
+		_, err := service.Authorize(context.Background(), newAuthorizationRequest(nil))
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := service.Start(ctx); err != nil {
+		t.Fatalf("unexpected error starting the service: %v", err)
+	}
+	cancel()
+
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("expected the in-flight request to be cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the in-flight request to be cancelled after the drain timeout")
+	}
+}
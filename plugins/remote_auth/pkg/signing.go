@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultSignatureHeader = "x-remote-auth-signature"
+
+	redactedValue = "[redacted]"
+)
+
+// requestSigner signs outgoing auth requests with an HMAC-SHA256 over a canonical form of the
+// signed headers: for each header, ordered by lowercased name, a "<name>:<value>\n" line with the
+// lowercased name and the trimmed value, or an empty value when the header isn't set. Multiple
+// values of a header are joined with ",". The signature is sent hex encoded.
+type requestSigner struct {
+	secret  []byte
+	headers []string
+	header  string
+}
+
+func newRequestSigner(config *Config) *requestSigner {
+	if config.SigningSecret == "" {
+		return nil
+	}
+	headers := make([]string, 0, len(config.SignedHeaders))
+	for _, header := range config.SignedHeaders {
+		headers = append(headers, strings.ToLower(header))
+	}
+	sort.Strings(headers)
+	header := DefaultSignatureHeader
+	if config.SignatureHeader != "" {
+		header = config.SignatureHeader
+	}
+	return &requestSigner{secret: []byte(config.SigningSecret), headers: headers, header: header}
+}
+
+func (s *requestSigner) sign(request *http.Request) {
+	if s == nil {
+		return
+	}
+	request.Header.Set(s.header, s.signature(request.Header))
+}
+
+func (s *requestSigner) signature(headers http.Header) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(s.canonicalHeaders(headers)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *requestSigner) canonicalHeaders(headers http.Header) string {
+	var canonical strings.Builder
+	for _, name := range s.headers {
+		var values []string
+		for _, value := range headers[http.CanonicalHeaderKey(name)] {
+			values = append(values, strings.TrimSpace(value))
+		}
+		canonical.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+	return canonical.String()
+}
+
+// Headers carrying credentials, whose values are never logged.
+var DefaultRedactedHeaders = []string{"authorization", "proxy-authorization", "cookie", "x-api-key", "x-tidepool-session-token"}
+
+// newRedactedHeaders returns the lowercased names of the headers whose values aren't logged: the
+// DefaultRedactedHeaders, the SignatureHeader and the configured RedactedHeaders.
+func newRedactedHeaders(config *Config) map[string]bool {
+	headers := map[string]bool{DefaultSignatureHeader: true}
+	if config.SignatureHeader != "" {
+		headers[strings.ToLower(config.SignatureHeader)] = true
+	}
+	for _, header := range DefaultRedactedHeaders {
+		headers[header] = true
+	}
+	for _, header := range config.RedactedHeaders {
+		headers[strings.ToLower(header)] = true
+	}
+	return headers
+}
+
+// redacted hides secret config values from logs while still showing whether they are set.
+func redacted(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedValue
+}
@@ -0,0 +1,77 @@
+package pkg
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"go.uber.org/zap/zapcore"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAuthorizeSignsRequest(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer server.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:               server.URL,
+		ForwardRequestHeaders: []string{"x-tidepool-session-token", "x-tidepool-trace-request"},
+		SigningSecret:         "secret",
+		SignedHeaders:         []string{"X-Tidepool-Trace-Request", "x-tidepool-session-token", "x-missing"},
+	})
+	request := newAuthorizationRequest(map[string]string{
+		"x-tidepool-session-token": " token ",
+		"x-tidepool-trace-request": "request-1",
+	})
+	if _, err := service.Authorize(context.Background(), request); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("x-missing:\nx-tidepool-session-token:token\nx-tidepool-trace-request:request-1\n"))
+	if expected := hex.EncodeToString(mac.Sum(nil)); received.Get(DefaultSignatureHeader) != expected {
+		t.Errorf("expected signature %v, got %v", expected, received.Get(DefaultSignatureHeader))
+	}
+}
+
+func TestRedactedHidesSecrets(t *testing.T) {
+	if value := redacted("secret"); value == "secret" {
+		t.Error("expected the secret to be redacted")
+	}
+	if value := redacted(""); value != "" {
+		t.Errorf("expected an unset secret to stay empty, got %v", value)
+	}
+}
+
+func TestForwardedHeadersAreRedacted(t *testing.T) {
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret")
+	headers.Set("X-Tidepool-Session-Token", "token")
+	headers.Set("X-Custom-Secret", "custom")
+	headers.Set(DefaultSignatureHeader, "signature")
+	headers.Add("X-Trace", "a")
+	headers.Add("X-Trace", "b")
+
+	encoder := zapcore.NewMapObjectEncoder()
+	redactedHeaders := newRedactedHeaders(&Config{RedactedHeaders: []string{"X-Custom-Secret"}})
+	if err := encoder.AddArray("headers", ForwardedHeaders{Headers: headers, Redacted: redactedHeaders}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []interface{}{
+		"Authorization: " + redactedValue,
+		"X-Custom-Secret: " + redactedValue,
+		"X-Remote-Auth-Signature: " + redactedValue,
+		"X-Tidepool-Session-Token: " + redactedValue,
+		"X-Trace: a",
+		"X-Trace: b",
+	}
+	if logged := encoder.Fields["headers"]; !reflect.DeepEqual(logged, expected) {
+		t.Errorf("expected logged headers %v, got %v", expected, logged)
+	}
+}
@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// topLevelAttributes returns the keys of the auth response body that the attributes are read
+// from, when they're all top-level, so the body can be streamed with decodeTopLevelAttributes. It
+// returns nil when an attribute is a nested path or a JSONPath expression and the whole body has
+// to be decoded, as it is when checked against ResponseSchema. With a ResponseRoot, the root is the
+// only key.
+func (c *RemoteAuthService) topLevelAttributes() []string {
+	if c.responseSchema != nil {
+		return nil
+	}
+	var paths []string
+	if c.ResponseRoot != "" {
+		paths = append(paths, c.ResponseRoot)
+	} else {
+		for _, mapping := range c.allMappings() {
+			for _, source := range mapping.sources() {
+				if !isResponseSource(source) {
+					paths = append(paths, source)
+				}
+			}
+			for attribute := range mapping.When {
+				paths = append(paths, attribute)
+			}
+		}
+		if c.AllowAttribute != "" {
+			paths = append(paths, c.AllowAttribute, c.DenyReasonAttribute)
+		}
+		if c.ExpiryAttribute != "" {
+			paths = append(paths, c.ExpiryAttribute)
+		}
+		if len(c.jwtClaimMappings) > 0 {
+			paths = append(paths, c.JwtAttribute)
+		}
+		for _, matcher := range c.attributeMatchers {
+			paths = append(paths, matcher.attribute)
+		}
+	}
+
+	keys := map[string]bool{}
+	for _, path := range paths {
+		if isJsonPath(path) || strings.ContainsAny(path, ".[") {
+			return nil
+		}
+		keys[path] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// decodeTopLevelAttributes decodes the keys of a JSON object body, skipping the values of other
+// keys without decoding them, and stops decoding once every key has been found. The rest of the
+// body is still read, so MaxResponseBytes applies to all of it and the connection can be reused,
+// but unlike decodeResponseBody it isn't checked to be valid JSON and the first of repeated keys
+// is used.
+func decodeTopLevelAttributes(body io.Reader, keys []string) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return nil, &json.UnmarshalTypeError{Value: "non-object", Type: reflect.TypeOf(map[string]interface{}{}), Offset: decoder.InputOffset()}
+	}
+
+	remaining := map[string]bool{}
+	for _, key := range keys {
+		remaining[key] = true
+	}
+	data := map[string]interface{}{}
+	for len(remaining) > 0 && decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := token.(string)
+		if !remaining[key] {
+			var skipped json.RawMessage
+			if err := decoder.Decode(&skipped); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		data[key] = value
+		delete(remaining, key)
+	}
+	if len(remaining) > 0 {
+		// The whole object was read, so its end must be there too.
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.Copy(ioutil.Discard, io.MultiReader(decoder.Buffered(), body)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,83 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeTopLevelAttributes(t *testing.T) {
+	body := "{\"grants\": [{\"scope\": \"read\"}], \"userid\": \"1234\", \"allow\": true, \"profile\": [}"
+	data, err := decodeTopLevelAttributes(strings.NewReader(body), []string{"allow", "userid"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]interface{}{"userid": "1234", "allow": true}; !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %v, got %v", expected, data)
+	}
+
+	data, err = decodeTopLevelAttributes(strings.NewReader("{\"userid\": \"1234\"}"), []string{"allow", "userid"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := map[string]interface{}{"userid": "1234"}; !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected %v, got %v", expected, data)
+	}
+
+	if data, err := decodeTopLevelAttributes(strings.NewReader("null"), []string{"userid"}); err != nil || data != nil {
+		t.Errorf("expected a null body to decode to nothing, got %v, %v", data, err)
+	}
+	for _, body := range []string{"", "[\"userid\"]", "{\"userid\": ", "{\"userid\": \"1234\""} {
+		if _, err := decodeTopLevelAttributes(strings.NewReader(body), []string{"allow", "userid"}); err == nil {
+			t.Errorf("expected %q to fail to decode", body)
+		}
+	}
+}
+
+func TestTopLevelAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   *Config
+		expected []string
+	}{
+		{"flat", &Config{
+			ResponseHeaders: map[string]string{"userid": "x-auth-subject-id", "header:x-role": "x-auth-role"},
+			AllowAttribute:  "allow",
+		}, []string{"allow", "reason", "userid"}},
+		{"nested", &Config{ResponseHeaders: map[string]string{"userid": "x-auth-subject-id", "claims.role": "x-auth-role"}}, nil},
+		{"json path", &Config{ResponseHeaders: map[string]string{"$.userid": "x-auth-subject-id"}}, nil},
+		{"response root", &Config{ResponseHeaders: map[string]string{"claims.role": "x-auth-role"}, ResponseRoot: "data"}, []string{"data"}},
+	}
+	for _, test := range tests {
+		test.config.AuthUrl = "http://auth"
+		service := newAuthService(t, test.config)
+		if !reflect.DeepEqual(service.streamedAttributes, test.expected) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.expected, service.streamedAttributes)
+		}
+	}
+}
+
+func TestAuthorizeStreamsTopLevelAttributes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "{\"userid\": \"1234\", \"profile\": {\"bio\": \"%s\"}}", strings.Repeat("x", 1024))
+	}))
+	defer server.Close()
+
+	config := &Config{AuthUrl: server.URL, ResponseHeaders: map[string]string{"userid": "x-auth-subject-id"}}
+	response, err := newAuthService(t, config).Authorize(context.Background(), newAuthorizationRequest(nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != "1234" {
+		t.Errorf("expected subject id 1234, got %q", value)
+	}
+
+	config.MaxResponseBytes = 256
+	if _, err := newAuthService(t, config).Authorize(context.Background(), newAuthorizationRequest(nil)); err == nil {
+		t.Error("expected an error for a body over MaxResponseBytes after the attributes")
+	}
+}
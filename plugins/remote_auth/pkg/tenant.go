@@ -0,0 +1,30 @@
+package pkg
+
+import (
+	"github.com/solo-io/ext-auth-plugins/api"
+	"strings"
+)
+
+// authUrl returns the RouteAuthUrls entry for the request's RouteSelector value, else the
+// TenantAuthUrls entry for its TenantHeader value, or AuthUrl when neither is listed. The route,
+// respectively the tenant, is "" when its auth URL isn't used.
+func (c *RemoteAuthService) authUrl(authzRequest *api.AuthorizationRequest) (string, string, string) {
+	if c.RouteSelector != "" {
+		route := requestAttribute(authzRequest, c.RouteSelector)
+		if authUrl, ok := c.RouteAuthUrls[route]; ok && route != "" {
+			return authUrl, route, ""
+		}
+	}
+	if c.TenantHeader == "" {
+		return c.AuthUrl, "", ""
+	}
+	headers := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	tenant, ok := headers[strings.ToLower(c.TenantHeader)]
+	if !ok {
+		return c.AuthUrl, "", ""
+	}
+	if authUrl, ok := c.TenantAuthUrls[tenant]; ok {
+		return authUrl, "", tenant
+	}
+	return c.AuthUrl, "", ""
+}
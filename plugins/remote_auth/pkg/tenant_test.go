@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	envoycorev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeSelectsTenantAuthUrl(t *testing.T) {
+	newServer := func(userid string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "{\"userid\": \"%s\"}", userid)
+		}))
+	}
+	primary, acme := newServer("default"), newServer("acme")
+	defer primary.Close()
+	defer acme.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:         primary.URL,
+		TenantHeader:    "X-Tenant",
+		TenantAuthUrls:  map[string]string{"acme": acme.URL},
+		ResponseHeaders: map[string]string{"userid": "x-auth-subject-id"},
+	})
+	tests := []struct {
+		headers  map[string]string
+		expected string
+	}{
+		{map[string]string{"x-tenant": "acme"}, "acme"},
+		{map[string]string{"x-tenant": "globex"}, "default"},
+		{nil, "default"},
+	}
+	for _, test := range tests {
+		response, err := service.Authorize(context.Background(), newAuthorizationRequest(test.headers))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != test.expected {
+			t.Errorf("expected %v to be authorized by %v, got %q", test.headers, test.expected, value)
+		}
+	}
+}
+
+func TestAuthorizeSelectsRouteAuthUrl(t *testing.T) {
+	newServer := func(userid string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "{\"userid\": \"%s\"}", userid)
+		}))
+	}
+	primary, care, acme := newServer("default"), newServer("care"), newServer("acme")
+	defer primary.Close()
+	defer care.Close()
+	defer acme.Close()
+
+	service := newAuthService(t, &Config{
+		AuthUrl:         primary.URL,
+		RouteSelector:   "metadata:io.solo.auth:backend",
+		RouteAuthUrls:   map[string]string{"care": care.URL},
+		TenantHeader:    "X-Tenant",
+		TenantAuthUrls:  map[string]string{"acme": acme.URL},
+		ResponseHeaders: map[string]string{"userid": "x-auth-subject-id"},
+	})
+	tests := []struct {
+		backend  string
+		headers  map[string]string
+		expected string
+	}{
+		{"care", map[string]string{"x-tenant": "acme"}, "care"},
+		{"unknown", map[string]string{"x-tenant": "acme"}, "acme"},
+		{"", nil, "default"},
+	}
+	for _, test := range tests {
+		request := newAuthorizationRequest(test.headers)
+		if test.backend != "" {
+			request.CheckRequest.Attributes.MetadataContext = &envoycorev2.Metadata{FilterMetadata: map[string]*structpb.Struct{
+				"io.solo.auth": {Fields: map[string]*structpb.Value{"backend": {Kind: &structpb.Value_StringValue{StringValue: test.backend}}}},
+			}}
+		}
+		response, err := service.Authorize(context.Background(), request)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if value, _ := responseHeaderValue(response, "x-auth-subject-id"); value != test.expected {
+			t.Errorf("expected backend %q to be authorized by %v, got %q", test.backend, test.expected, value)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"errors"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.uber.org/zap"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	InvalidTimestampDeny  = "deny"
+	InvalidTimestampAllow = "allow"
+)
+
+// staleRequest reports whether the TimestampHeader of the request is more than MaxRequestAge away
+// from now. Timestamps in the future count too, so a request can't be dated ahead to be replayed
+// later. A missing or unparseable timestamp is stale unless OnInvalidTimestamp is allow.
+func (c *RemoteAuthService) staleRequest(log *zap.SugaredLogger, authzRequest *api.AuthorizationRequest) bool {
+	if c.timestampHeader == "" {
+		return false
+	}
+	value := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp().GetHeaders()[c.timestampHeader]
+	timestamp, err := parseRequestTimestamp(value)
+	if err != nil {
+		if c.OnInvalidTimestamp == InvalidTimestampAllow {
+			log.Warnw("Invalid request timestamp, allowing it as OnInvalidTimestamp is allow",
+				zap.String("header", c.timestampHeader), zap.Error(err))
+			return false
+		}
+		log.Infow("Invalid request timestamp, denying it without calling the auth backend",
+			zap.String("header", c.timestampHeader), zap.Error(err))
+		return true
+	}
+	if age := time.Since(timestamp); age > c.maxRequestAge || -age > c.maxRequestAge {
+		log.Infow("Request timestamp is out of MaxRequestAge, denying it without calling the auth backend",
+			zap.Duration("age", age), zap.Duration("max_request_age", c.maxRequestAge))
+		return true
+	}
+	return false
+}
+
+// staleRequestDenial denies a request with a stale or invalid timestamp, with a deny reason when
+// EnableDenyReasons is set.
+func (c *RemoteAuthService) staleRequestDenial() *api.AuthorizationResponse {
+	denial := api.UnauthenticatedResponse()
+	if c.EnableDenyReasons {
+		denial = withDenyReason(denial, envoytype.StatusCode_Unauthorized, "Stale request")
+	}
+	return denial
+}
+
+// parseRequestTimestamp parses an HTTP date, as in the Date header, an RFC 3339 timestamp, or Unix
+// seconds.
+func parseRequestTimestamp(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, errors.New("missing timestamp")
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	if timestamp, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return timestamp, nil
+	}
+	return http.ParseTime(value)
+}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeDeniesStaleRequests(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		timestamp string
+		policy    string
+		allowed   bool
+	}{
+		{"recent http date", now.Add(-time.Minute).UTC().Format(http.TimeFormat), "", true},
+		{"recent unix seconds", strconv.FormatInt(now.Unix(), 10), "", true},
+		{"recent rfc 3339", now.Add(time.Minute).Format(time.RFC3339), "", true},
+		{"stale", now.Add(-10 * time.Minute).UTC().Format(http.TimeFormat), "", false},
+		{"future", now.Add(10 * time.Minute).Format(time.RFC3339), "", false},
+		{"stale when invalid are allowed", strconv.FormatInt(now.Add(-time.Hour).Unix(), 10), InvalidTimestampAllow, false},
+		{"invalid", "yesterday", "", false},
+		{"missing", "", InvalidTimestampDeny, false},
+		{"invalid allowed", "yesterday", InvalidTimestampAllow, true},
+		{"missing allowed", "", InvalidTimestampAllow, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			service := newAuthService(t, &Config{
+				AuthUrl:            "http://auth",
+				TimestampHeader:    "Date",
+				MaxRequestAge:      "5m",
+				OnInvalidTimestamp: test.policy,
+			})
+			service.httpClient = doerFunc(func(request *http.Request) (*http.Response, error) {
+				calls++
+				return stubResponse(http.StatusOK, "")(request)
+			})
+			headers := map[string]string{}
+			if test.timestamp != "" {
+				headers["date"] = test.timestamp
+			}
+			response, err := service.Authorize(context.Background(), newAuthorizationRequest(headers))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if isAllowedResponse(response) != test.allowed {
+				t.Errorf("expected allowed %v, got %v", test.allowed, isAllowedResponse(response))
+			}
+			if !test.allowed && calls != 0 {
+				t.Errorf("expected no auth call for a denied request, got %v", calls)
+			}
+		})
+	}
+}
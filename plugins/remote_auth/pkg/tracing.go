@@ -0,0 +1,142 @@
+package pkg
+
+import (
+	"context"
+	"encoding/hex"
+	"github.com/solo-io/ext-auth-plugins/api"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strings"
+)
+
+// W3C trace context headers, see https://www.w3.org/TR/trace-context/. This is the propagation
+// format used by OpenTelemetry, so spans created here join the caller's trace.
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// Name of the OpenTelemetry tracer recording the spans of EnableTracing.
+const TracerName = "github.com/tidepool-org/gloo-remote-auth-plugin"
+
+var traceContextPropagator = propagation.TraceContext{}
+
+type span struct {
+	parentCtx context.Context
+	ctx       context.Context
+	span      trace.Span
+}
+
+// startSpan starts a client span with tracer, as a child of the trace context found in the
+// incoming request headers, or else of the span in ctx, if any. All span methods are safe to call
+// on a nil span.
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, incomingHeaders map[string]string) *span {
+	parentCtx := traceContextPropagator.Extract(ctx, headerMapCarrier(incomingHeaders))
+	spanCtx, s := tracer.Start(parentCtx, name, trace.WithSpanKind(trace.SpanKindClient))
+	return &span{parentCtx: parentCtx, ctx: spanCtx, span: s}
+}
+
+// inject sets the traceparent and tracestate headers of the span, or of its parent when no
+// TracerProvider records it, so the auth backend still joins the caller's trace.
+func (s *span) inject(request *http.Request) {
+	if s == nil {
+		return
+	}
+	ctx := s.ctx
+	if !s.span.SpanContext().IsValid() {
+		ctx = s.parentCtx
+	}
+	traceContextPropagator.Inject(ctx, propagation.HeaderCarrier(request.Header))
+}
+
+func (s *span) setAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.Any(key, value))
+}
+
+func (s *span) setError(message string) {
+	if s == nil {
+		return
+	}
+	s.span.SetStatus(codes.Error, message)
+}
+
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.span.End()
+}
+
+// headerMapCarrier reads the trace context from the lowercase header map of an auth request.
+type headerMapCarrier map[string]string
+
+func (c headerMapCarrier) Get(key string) string {
+	return c[strings.ToLower(key)]
+}
+
+func (c headerMapCarrier) Set(key string, value string) {
+	c[strings.ToLower(key)] = value
+}
+
+func (c headerMapCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// extractTraceId returns the trace id of the incoming W3C trace context when PropagateTraceContext
+// is enabled, or "" when there's no valid one.
+func (c *RemoteAuthService) extractTraceId(authzRequest *api.AuthorizationRequest) string {
+	if !c.PropagateTraceContext {
+		return ""
+	}
+	headers := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	traceId, _, _, _ := parseTraceParent(headers[TraceParentHeader])
+	return traceId
+}
+
+// traceContextHeaders returns the incoming traceparent and tracestate headers to forward when
+// PropagateTraceContext is enabled. Neither is forwarded without a valid traceparent, as the
+// tracestate is meaningless without it.
+func (c *RemoteAuthService) traceContextHeaders(authzRequest *api.AuthorizationRequest) map[string]string {
+	if c.extractTraceId(authzRequest) == "" {
+		return nil
+	}
+	headers := authzRequest.CheckRequest.GetAttributes().GetRequest().GetHttp().GetHeaders()
+	traceContext := map[string]string{TraceParentHeader: headers[TraceParentHeader]}
+	if traceState, ok := headers[TraceStateHeader]; ok {
+		traceContext[TraceStateHeader] = traceState
+	}
+	return traceContext
+}
+
+func parseTraceParent(value string) (traceId, parentSpanId, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", "", false
+	}
+	traceId, parentSpanId, flags = parts[1], parts[2], parts[3]
+	if len(traceId) != 32 || len(parentSpanId) != 16 || len(flags) != 2 {
+		return "", "", "", false
+	}
+	if !isHex(traceId) || !isHex(parentSpanId) || !isHex(flags) {
+		return "", "", "", false
+	}
+	if strings.Trim(traceId, "0") == "" || strings.Trim(parentSpanId, "0") == "" {
+		return "", "", "", false
+	}
+	return strings.ToLower(traceId), strings.ToLower(parentSpanId), strings.ToLower(flags), true
+}
+
+func isHex(value string) bool {
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/oteltest"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeRecordsSpan(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name    string
+		status  int
+		code    codes.Code
+		outcome string
+	}{
+		{"allowed", http.StatusOK, codes.Unset, "allow"},
+		{"denied", http.StatusForbidden, codes.Error, "deny"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var forwarded string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwarded = r.Header.Get(TraceParentHeader)
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			recorder := new(oteltest.SpanRecorder)
+			service := newAuthService(t, &Config{AuthUrl: server.URL, EnableTracing: true})
+			service.tracer = oteltest.NewTracerProvider(oteltest.WithSpanRecorder(recorder)).Tracer(TracerName)
+			if _, err := service.Authorize(context.Background(), newAuthorizationRequest(map[string]string{TraceParentHeader: traceParent})); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			spans := recorder.Completed()
+			if len(spans) != 1 {
+				t.Fatalf("expected a single span, got %v", len(spans))
+			}
+			s := spans[0]
+			if traceId := s.SpanContext().TraceID().String(); traceId != "4bf92f3577b34da6a3ce929d0e0e4736" {
+				t.Errorf("expected the incoming trace to be continued, got %v", traceId)
+			}
+			if parent := s.ParentSpanID().String(); parent != "00f067aa0ba902b7" {
+				t.Errorf("expected parent span id 00f067aa0ba902b7, got %v", parent)
+			}
+			if s.StatusCode() != test.code {
+				t.Errorf("expected status %v, got %v", test.code, s.StatusCode())
+			}
+			attributes := s.Attributes()
+			if url := attributes["http.url"].AsString(); url != server.URL {
+				t.Errorf("expected http.url %v, got %q", server.URL, url)
+			}
+			if status := attributes["http.status_code"].AsInt64(); status != int64(test.status) {
+				t.Errorf("expected http.status_code %v, got %v", test.status, status)
+			}
+			if decision := attributes["auth.decision"].AsString(); decision != test.outcome {
+				t.Errorf("expected auth.decision %q, got %q", test.outcome, decision)
+			}
+			if expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + s.SpanContext().SpanID().String() + "-01"; forwarded != expected {
+				t.Errorf("expected traceparent %v to be propagated, got %q", expected, forwarded)
+			}
+		})
+	}
+}
+
+func TestUnrecordedSpanPropagatesIncomingTrace(t *testing.T) {
+	incoming := map[string]string{
+		TraceParentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		TraceStateHeader:  "congo=t61rcWkgMzE",
+	}
+	s := startSpan(context.Background(), trace.NewNoopTracerProvider().Tracer(TracerName), "test", incoming)
+	request, _ := http.NewRequest("GET", "http://localhost", nil)
+	s.inject(request)
+	if value := request.Header.Get(TraceParentHeader); value != incoming[TraceParentHeader] {
+		t.Errorf("expected the incoming traceparent to be propagated, got %q", value)
+	}
+	if value := request.Header.Get(TraceStateHeader); value != incoming[TraceStateHeader] {
+		t.Errorf("expected the incoming tracestate to be propagated, got %q", value)
+	}
+}
+
+func TestNilSpanIsNoop(t *testing.T) {
+	var s *span
+	request, _ := http.NewRequest("GET", "http://localhost", nil)
+	s.inject(request)
+	s.setAttribute("key", "value")
+	s.setError("error")
+	s.end()
+	if request.Header.Get(TraceParentHeader) != "" {
+		t.Error("expected no traceparent from a nil span")
+	}
+}
+
+func TestPropagateTraceContext(t *testing.T) {
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name      string
+		enabled   bool
+		headers   map[string]string
+		traceId   string
+		forwarded map[string]string
+	}{
+		{"disabled", false, map[string]string{TraceParentHeader: traceParent, TraceStateHeader: "tidepool=1"}, "", map[string]string{}},
+		{"forwarded", true, map[string]string{TraceParentHeader: traceParent, TraceStateHeader: "tidepool=1"}, "4bf92f3577b34da6a3ce929d0e0e4736",
+			map[string]string{TraceParentHeader: traceParent, TraceStateHeader: "tidepool=1"}},
+		{"without tracestate", true, map[string]string{TraceParentHeader: traceParent}, "4bf92f3577b34da6a3ce929d0e0e4736",
+			map[string]string{TraceParentHeader: traceParent}},
+		{"invalid traceparent", true, map[string]string{TraceParentHeader: "garbage", TraceStateHeader: "tidepool=1"}, "", map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service := &RemoteAuthService{PropagateTraceContext: test.enabled}
+			request := newAuthorizationRequest(test.headers)
+			if traceId := service.extractTraceId(request); traceId != test.traceId {
+				t.Errorf("expected trace id %q, got %q", test.traceId, traceId)
+			}
+			headers := service.allowedHeaders(request)
+			if len(headers) != len(test.forwarded) {
+				t.Errorf("expected headers %v, got %v", test.forwarded, headers)
+			}
+			for header, expected := range test.forwarded {
+				if headers[header] != expected {
+					t.Errorf("expected %v to be %q, got %q", header, expected, headers[header])
+				}
+			}
+		})
+	}
+}
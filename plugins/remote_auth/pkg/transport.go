@@ -0,0 +1,373 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Tuned for many concurrent requests to a single auth backend; Go's defaults keep only 2 idle
+	// connections per host, which forces new connections under load.
+	DefaultMaxIdleConns        = 100
+	DefaultMaxIdleConnsPerHost = 100
+	DefaultIdleConnTimeout     = 90 * time.Second
+
+	// Go's defaults, so connection problems fail fast enough without a RequestTimeout.
+	DefaultDialTimeout         = 30 * time.Second
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+
+	DefaultMinTLSVersion = "1.2"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func validateMinTLSVersion(version string) error {
+	if _, ok := tlsVersions[version]; version != "" && !ok {
+		return errors.New("must be one of 1.0, 1.1, 1.2, 1.3")
+	}
+	return nil
+}
+
+func newTransport(config *Config) (*http.Transport, error) {
+	idleConnTimeout, err := parseDuration("IdleConnTimeout", config.IdleConnTimeout, DefaultIdleConnTimeout)
+	if err != nil {
+		return nil, err
+	}
+	dialTimeout, err := parseDuration("DialTimeout", config.DialTimeout, DefaultDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	tlsHandshakeTimeout, err := parseDuration("TLSHandshakeTimeout", config.TLSHandshakeTimeout, DefaultTLSHandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = DefaultMaxIdleConns
+	if config.MaxIdleConns > 0 {
+		transport.MaxIdleConns = config.MaxIdleConns
+	}
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	transport.IdleConnTimeout = idleConnTimeout
+	transport.DisableKeepAlives = config.DisableKeepAlives
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = tlsHandshakeTimeout
+	if config.ProxyUrl != "" {
+		proxyUrl, err := url.Parse(config.ProxyUrl)
+		if err != nil {
+			return nil, InvalidConfigError("ProxyUrl", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	if transport.TLSClientConfig, err = newTLSConfig(config); err != nil {
+		return nil, err
+	}
+
+	return transport, nil
+}
+
+// newTLSConfig returns the TLS config of connections to the auth backend, from TLSServerName,
+// InsecureSkipVerify and MinTLSVersion.
+func newTLSConfig(config *Config) (*tls.Config, error) {
+	minTLSVersion := config.MinTLSVersion
+	if minTLSVersion == "" {
+		minTLSVersion = DefaultMinTLSVersion
+	}
+	minVersion, ok := tlsVersions[minTLSVersion]
+	if !ok {
+		return nil, InvalidConfigError("MinTLSVersion", validateMinTLSVersion(minTLSVersion))
+	}
+	return &tls.Config{
+		MinVersion:         minVersion,
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}, nil
+}
+
+// Config affecting the transport. Services whose config has the same key share a transport, so
+// its idle connections survive config reloads instead of being dropped with each old service.
+type transportKey struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     string
+	disableKeepAlives   bool
+	proxyUrl            string
+	useHTTP2            bool
+	tlsServerName       string
+	insecureSkipVerify  bool
+	minTLSVersion       string
+	dialTimeout         string
+	tlsHandshakeTimeout string
+}
+
+func newTransportKey(config *Config) transportKey {
+	return transportKey{
+		maxIdleConns:        config.MaxIdleConns,
+		maxIdleConnsPerHost: config.MaxIdleConnsPerHost,
+		idleConnTimeout:     config.IdleConnTimeout,
+		disableKeepAlives:   config.DisableKeepAlives,
+		proxyUrl:            config.ProxyUrl,
+		useHTTP2:            config.UseHTTP2,
+		tlsServerName:       config.TLSServerName,
+		insecureSkipVerify:  config.InsecureSkipVerify,
+		minTLSVersion:       config.MinTLSVersion,
+		dialTimeout:         config.DialTimeout,
+		tlsHandshakeTimeout: config.TLSHandshakeTimeout,
+	}
+}
+
+type sharedTransport struct {
+	roundTripper http.RoundTripper
+	references   int
+}
+
+var (
+	sharedTransportsMu sync.Mutex
+	sharedTransports   = map[transportKey]*sharedTransport{}
+)
+
+// acquireTransport returns the transport shared by services with the same transport config,
+// creating it when there is none, and a func releasing it. Once every service has released it,
+// its idle connections are closed and the next service creates a new transport. The release func
+// may be called more than once.
+func acquireTransport(config *Config) (http.RoundTripper, func(), error) {
+	key := newTransportKey(config)
+	sharedTransportsMu.Lock()
+	defer sharedTransportsMu.Unlock()
+
+	shared, ok := sharedTransports[key]
+	if !ok {
+		roundTripper, err := newRoundTripper(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		shared = &sharedTransport{roundTripper: roundTripper}
+		sharedTransports[key] = shared
+	}
+	shared.references++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			sharedTransportsMu.Lock()
+			defer sharedTransportsMu.Unlock()
+			shared.references--
+			if shared.references > 0 {
+				return
+			}
+			delete(sharedTransports, key)
+			if closer, ok := shared.roundTripper.(interface{ CloseIdleConnections() }); ok {
+				closer.CloseIdleConnections()
+			}
+		})
+	}
+	return shared.roundTripper, release, nil
+}
+
+// redactedUrl hides the password of a URL from logs, keeping the rest of it.
+func redactedUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.User == nil {
+		return rawUrl
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "xxxxx")
+	}
+	return u.String()
+}
+
+// newRoundTripper returns the transport used to call the auth backend, speaking only HTTP/2 when
+// UseHTTP2 is set.
+func newRoundTripper(config *Config) (http.RoundTripper, error) {
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	if !config.UseHTTP2 {
+		return transport, nil
+	}
+	return newHTTP2Transport(transport), nil
+}
+
+// http2Transport requires HTTP/2 for https URLs, negotiated with ALPN using the TLS config of the
+// HTTP/1.1 transport, and uses h2c with prior knowledge for plaintext http URLs, meaning the
+// backend must accept HTTP/2 without an upgrade.
+type http2Transport struct {
+	tls *http2.Transport
+	h2c *http2.Transport
+}
+
+func newHTTP2Transport(base *http.Transport) *http2Transport {
+	tlsTransport := &http2.Transport{TLSClientConfig: base.TLSClientConfig}
+	tlsTransport.ConnPool = newHTTP2ConnPool(tlsTransport, func(ctx context.Context, addr string) (net.Conn, error) {
+		return dialTLS(ctx, base, addr)
+	})
+	h2cTransport := &http2.Transport{AllowHTTP: true}
+	h2cTransport.ConnPool = newHTTP2ConnPool(h2cTransport, func(ctx context.Context, addr string) (net.Conn, error) {
+		return base.DialContext(ctx, "tcp", addr)
+	})
+	return &http2Transport{tls: tlsTransport, h2c: h2cTransport}
+}
+
+// dialTLS opens an HTTP/2 connection with the dial and TLS handshake timeouts of the HTTP/1.1
+// transport, or the deadline of ctx when sooner, requiring the backend to negotiate h2.
+func dialTLS(ctx context.Context, base *http.Transport, addr string) (net.Conn, error) {
+	conn, err := base.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	var deadline time.Time
+	if base.TLSHandshakeTimeout > 0 {
+		deadline = time.Now().Add(base.TLSHandshakeTimeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+	tlsConn := tls.Client(conn, http2TLSConfig(base.TLSClientConfig, addr))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if protocol := tlsConn.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+		conn.Close()
+		return nil, errors.New("auth backend negotiated protocol " + strconv.Quote(protocol) + " instead of h2")
+	}
+	return tlsConn, nil
+}
+
+// http2TLSConfig returns a copy of config offering only h2 by ALPN, verifying the host of addr
+// unless config names another server.
+func http2TLSConfig(config *tls.Config, addr string) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.NextProtos = []string{"h2"}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		}
+	}
+	return config
+}
+
+// http2ConnPool keeps the connections of an http2.Transport, dialing new ones under the context
+// of the request that needs them, so its deadline and cancellation apply to the dial and TLS
+// handshake. The pool of x/net dials detached from any request.
+type http2ConnPool struct {
+	transport *http2.Transport
+	dial      func(ctx context.Context, addr string) (net.Conn, error)
+	mu        sync.Mutex
+	conns     map[string][]*http2.ClientConn
+}
+
+func newHTTP2ConnPool(transport *http2.Transport, dial func(ctx context.Context, addr string) (net.Conn, error)) *http2ConnPool {
+	return &http2ConnPool{transport: transport, dial: dial, conns: map[string][]*http2.ClientConn{}}
+}
+
+func (p *http2ConnPool) GetClientConn(request *http.Request, addr string) (*http2.ClientConn, error) {
+	p.mu.Lock()
+	for _, conn := range p.conns[addr] {
+		if conn.CanTakeNewRequest() {
+			p.mu.Unlock()
+			return conn, nil
+		}
+	}
+	p.mu.Unlock()
+
+	netConn, err := p.dial(request.Context(), addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := p.transport.NewClientConn(netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[addr] = append(p.conns[addr], conn)
+	return conn, nil
+}
+
+func (p *http2ConnPool) MarkDead(dead *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conns := range p.conns {
+		for i, conn := range conns {
+			if conn == dead {
+				p.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+				if len(p.conns[addr]) == 0 {
+					delete(p.conns, addr)
+				}
+				return
+			}
+		}
+	}
+}
+
+// closeConnections shuts every connection down once its in-flight requests are done.
+func (p *http2ConnPool) closeConnections() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = map[string][]*http2.ClientConn{}
+	p.mu.Unlock()
+	for _, addrConns := range conns {
+		for _, conn := range addrConns {
+			go conn.Shutdown(context.Background())
+		}
+	}
+}
+
+func (t *http2Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(request)
+	}
+	return t.tls.RoundTrip(request)
+}
+
+func (t *http2Transport) CloseIdleConnections() {
+	t.tls.ConnPool.(*http2ConnPool).closeConnections()
+	t.h2c.ConnPool.(*http2ConnPool).closeConnections()
+}
+
+// newHttpClient returns the client calling the auth backend, which doesn't follow redirects unless
+// FollowRedirects is enabled.
+func newHttpClient(config *Config, transport http.RoundTripper) *http.Client {
+	client := &http.Client{Transport: transport}
+	if !config.FollowRedirects && config.OnRedirect != RedirectFollow {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	} else if len(config.AllowedAuthHosts) > 0 {
+		client.CheckRedirect = checkRedirectHost(newAllowedAuthHosts(config.AllowedAuthHosts))
+	}
+	return client
+}
+
+var UnexpectedRedirectError = func(statusCode int, location string) error {
+	return errors.New("unexpected redirect " + strconv.Itoa(statusCode) + " from auth backend to " + location)
+}
+
+func isRedirect(statusCode int) bool {
+	return statusCode >= 300 && statusCode < 400 && statusCode != http.StatusNotModified
+}
@@ -0,0 +1,869 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap/zapcore"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// validateConfig checks the config contents so that misconfiguration is reported by
+// GetAuthService at deploy time rather than on the first authorization request.
+func validateConfig(config *Config) error {
+	switch config.Protocol {
+	case "", ProtocolHttp:
+		if err := validateAuthUrl(config.AuthUrl, "http", "https"); err != nil {
+			return InvalidConfigError("AuthUrl", err)
+		}
+		if config.FallbackAuthUrl != "" {
+			if err := validateAuthUrl(config.FallbackAuthUrl, "http", "https"); err != nil {
+				return InvalidConfigError("FallbackAuthUrl", err)
+			}
+		}
+		if config.CanaryAuthUrl != "" {
+			if err := validateAuthUrl(config.CanaryAuthUrl, "http", "https"); err != nil {
+				return InvalidConfigError("CanaryAuthUrl", err)
+			}
+		}
+		for i, authUrl := range config.AdditionalAuthUrls {
+			if err := validateAuthUrl(authUrl, "http", "https"); err != nil {
+				return InvalidConfigError(fmt.Sprintf("AdditionalAuthUrls[%d]", i), err)
+			}
+		}
+		for tenant, authUrl := range config.TenantAuthUrls {
+			if err := validateAuthUrl(authUrl, "http", "https"); err != nil {
+				return InvalidConfigError(fmt.Sprintf("TenantAuthUrls[%s]", tenant), err)
+			}
+		}
+		for route, authUrl := range config.RouteAuthUrls {
+			if err := validateAuthUrl(authUrl, "http", "https"); err != nil {
+				return InvalidConfigError(fmt.Sprintf("RouteAuthUrls[%s]", route), err)
+			}
+		}
+	case ProtocolGrpc:
+		if err := validateAuthUrl(config.AuthUrl, "grpc", "grpcs"); err != nil {
+			return InvalidConfigError("AuthUrl", err)
+		}
+		if config.FallbackAuthUrl != "" {
+			return InvalidConfigError("FallbackAuthUrl", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.TenantAuthUrls) > 0 {
+			return InvalidConfigError("TenantAuthUrls", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.RouteAuthUrls) > 0 {
+			return InvalidConfigError("RouteAuthUrls", errors.New("not supported with the grpc protocol"))
+		}
+		if config.ResponseSchema != "" {
+			return InvalidConfigError("ResponseSchema", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.PathResponseHeaders) > 0 {
+			return InvalidConfigError("PathResponseHeaders", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.AdditionalAuthUrls) > 0 {
+			return InvalidConfigError("AdditionalAuthUrls", errors.New("not supported with the grpc protocol"))
+		}
+		if config.CacheTTL != "" {
+			return InvalidConfigError("CacheTTL", errors.New("not supported with the grpc protocol"))
+		}
+		if config.FingerprintHeader != "" {
+			return InvalidConfigError("FingerprintHeader", errors.New("not supported with the grpc protocol"))
+		}
+		if config.EnableMetrics {
+			return InvalidConfigError("EnableMetrics", errors.New("not supported with the grpc protocol"))
+		}
+		if config.LatencyLogSampleRate != 0 {
+			return InvalidConfigError("LatencyLogSampleRate", errors.New("not supported with the grpc protocol"))
+		}
+		if config.CanaryAuthUrl != "" {
+			return InvalidConfigError("CanaryAuthUrl", errors.New("not supported with the grpc protocol"))
+		}
+		if config.OnRedirect != "" {
+			return InvalidConfigError("OnRedirect", errors.New("not supported with the grpc protocol"))
+		}
+		if config.DialTimeout != "" {
+			return InvalidConfigError("DialTimeout", errors.New("not supported with the grpc protocol"))
+		}
+		if config.TLSHandshakeTimeout != "" {
+			return InvalidConfigError("TLSHandshakeTimeout", errors.New("not supported with the grpc protocol"))
+		}
+		if config.ClientAssertionKey != "" {
+			return InvalidConfigError("ClientAssertionKey", errors.New("not supported with the grpc protocol"))
+		}
+		if config.BodyHashHeader != "" {
+			return InvalidConfigError("BodyHashHeader", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.EchoedHeaders) > 0 {
+			return InvalidConfigError("EchoedHeaders", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.AllowedAuthHosts) > 0 {
+			return InvalidConfigError("AllowedAuthHosts", errors.New("not supported with the grpc protocol"))
+		}
+		if config.MaxConcurrentRequests > 0 {
+			return InvalidConfigError("MaxConcurrentRequests", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.RequiredAttributeMatches) > 0 {
+			return InvalidConfigError("RequiredAttributeMatches", errors.New("not supported with the grpc protocol"))
+		}
+		if config.TimeoutHeader != "" {
+			return InvalidConfigError("TimeoutHeader", errors.New("not supported with the grpc protocol, which propagates deadlines itself"))
+		}
+		if config.HealthCheckInterval != "" && config.HealthCheckUrl == "" {
+			return InvalidConfigError("HealthCheckUrl", errors.New("required with HealthCheckInterval and the grpc protocol"))
+		}
+		if config.MaxRetries > 0 {
+			return InvalidConfigError("MaxRetries", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.Mappings) > 0 {
+			return InvalidConfigError("Mappings", errors.New("not supported with the grpc protocol"))
+		}
+		if config.SigningSecret != "" {
+			return InvalidConfigError("SigningSecret", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.QueryParameters) > 0 {
+			return InvalidConfigError("QueryParameters", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.StaticQueryParams) > 0 {
+			return InvalidConfigError("StaticQueryParams", errors.New("not supported with the grpc protocol"))
+		}
+		if config.EnableTracing {
+			return InvalidConfigError("EnableTracing", errors.New("not supported with the grpc protocol"))
+		}
+		if config.DurationHeader != "" {
+			return InvalidConfigError("DurationHeader", errors.New("not supported with the grpc protocol"))
+		}
+		if config.EnableRequestDeduplication {
+			return InvalidConfigError("EnableRequestDeduplication", errors.New("not supported with the grpc protocol"))
+		}
+		if config.UseHTTP2 {
+			return InvalidConfigError("UseHTTP2", errors.New("not supported with the grpc protocol"))
+		}
+		if config.ProxyUrl != "" {
+			return InvalidConfigError("ProxyUrl", errors.New("not supported with the grpc protocol"))
+		}
+		if len(config.ResponseHeaders) > 0 {
+			return InvalidConfigError("ResponseHeaders", errors.New("not supported with the grpc protocol"))
+		}
+	default:
+		return InvalidConfigError("Protocol", errors.New("must be one of http, grpc"))
+	}
+
+	if strings.ContainsAny(config.AuthHost, "/ \t\r\n") {
+		return InvalidConfigError("AuthHost", errors.New("invalid host "+config.AuthHost))
+	}
+
+	if config.LatencyLogSampleRate < 0 || config.LatencyLogSampleRate > 1 {
+		return InvalidConfigError("LatencyLogSampleRate", errors.New("must be between 0 and 1"))
+	}
+	if config.CanaryWeight < 0 || config.CanaryWeight > 100 {
+		return InvalidConfigError("CanaryWeight", errors.New("must be between 0 and 100"))
+	}
+	if (config.CanaryWeight > 0 || config.CanaryCompare) && config.CanaryAuthUrl == "" {
+		return InvalidConfigError("CanaryAuthUrl", errors.New("required with CanaryWeight or CanaryCompare"))
+	}
+
+	for attribute, pattern := range config.RequiredAttributeMatches {
+		if err := validateAttributeMatch(attribute, pattern); err != nil {
+			return InvalidConfigError(fmt.Sprintf("RequiredAttributeMatches[%s]", attribute), err)
+		}
+	}
+
+	switch config.AuthUrlPolicy {
+	case "", AuthUrlPolicyAll, AuthUrlPolicyAny:
+	default:
+		return InvalidConfigError("AuthUrlPolicy", errors.New("must be one of all, any"))
+	}
+	switch config.BodyMergePolicy {
+	case "":
+	case BodyMergeFirst, BodyMergeLast, BodyMergeError:
+		if len(config.AdditionalAuthUrls) == 0 {
+			return InvalidConfigError("BodyMergePolicy", errors.New("requires AdditionalAuthUrls"))
+		}
+		if config.AuthUrlPolicy == AuthUrlPolicyAny {
+			return InvalidConfigError("BodyMergePolicy", errors.New("requires the all AuthUrlPolicy"))
+		}
+	default:
+		return InvalidConfigError("BodyMergePolicy", errors.New("must be one of first, last, error"))
+	}
+
+	for i, header := range config.ForwardRequestHeaders {
+		if _, ok := config.ForwardPseudoHeaders[header]; ok {
+			continue
+		}
+		if strings.HasSuffix(header, ForwardHeaderWildcard) {
+			if prefix := strings.TrimSuffix(header, ForwardHeaderWildcard); prefix == "" || strings.Contains(prefix, ForwardHeaderWildcard) || !isValidHeaderName(prefix) {
+				return InvalidConfigError(fmt.Sprintf("ForwardRequestHeaders[%d]", i), errors.New("invalid header prefix "+header))
+			}
+			continue
+		}
+		if strings.HasPrefix(header, ":") {
+			return InvalidConfigError(fmt.Sprintf("ForwardRequestHeaders[%d]", i), errors.New("pseudo-header "+header+" requires a name in ForwardPseudoHeaders"))
+		}
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("ForwardRequestHeaders[%d]", i), errors.New("invalid header name "+header))
+		}
+	}
+	for pseudoHeader, header := range config.ForwardPseudoHeaders {
+		if !strings.HasPrefix(pseudoHeader, ":") {
+			return InvalidConfigError(fmt.Sprintf("ForwardPseudoHeaders[%s]", pseudoHeader), errors.New("not a pseudo-header"))
+		}
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("ForwardPseudoHeaders[%s]", pseudoHeader), errors.New("invalid header name "+header))
+		}
+	}
+	for header, name := range config.ForwardHeaderNames {
+		if !isValidHeaderName(header) || !isValidHeaderName(name) {
+			return InvalidConfigError(fmt.Sprintf("ForwardHeaderNames[%s]", header), errors.New("invalid header name "+name))
+		}
+	}
+	for i, header := range config.SignedHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("SignedHeaders[%d]", i), errors.New("invalid header name "+header))
+		}
+	}
+	if len(config.SignedHeaders) > 0 && config.SigningSecret == "" {
+		return InvalidConfigError("SigningSecret", errors.New("required with SignedHeaders"))
+	}
+	if config.GenerateRequestId && config.RequestIdHeader == "" {
+		return InvalidConfigError("RequestIdHeader", errors.New("required with GenerateRequestId"))
+	}
+	if config.RequestIdResponseHeader != "" {
+		if config.RequestIdHeader == "" {
+			return InvalidConfigError("RequestIdHeader", errors.New("required with RequestIdResponseHeader"))
+		}
+		if !isValidHeaderName(config.RequestIdResponseHeader) {
+			return InvalidConfigError("RequestIdResponseHeader", errors.New("invalid header name "+config.RequestIdResponseHeader))
+		}
+	} else if config.RequestIdOnDeny {
+		return InvalidConfigError("RequestIdOnDeny", errors.New("requires RequestIdResponseHeader"))
+	}
+	if config.AcceptHeader != nil && strings.IndexFunc(*config.AcceptHeader, isControlCharacter) >= 0 {
+		return InvalidConfigError("AcceptHeader", errors.New("must not contain control characters"))
+	}
+	if config.SignatureHeader != "" && !isValidHeaderName(config.SignatureHeader) {
+		return InvalidConfigError("SignatureHeader", errors.New("invalid header name "+config.SignatureHeader))
+	}
+	if err := validateAllowedAuthHosts(config); err != nil {
+		return err
+	}
+	for i, header := range config.RedactedHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("RedactedHeaders[%d]", i), errors.New("invalid header name "+header))
+		}
+	}
+	for requestHeader, responseHeader := range config.EchoedHeaders {
+		if !isValidHeaderName(requestHeader) || !isValidHeaderName(responseHeader) {
+			return InvalidConfigError(fmt.Sprintf("EchoedHeaders[%s]", requestHeader), errors.New("invalid header name"))
+		}
+	}
+	if config.TimeoutHeader != "" && !isValidHeaderName(config.TimeoutHeader) {
+		return InvalidConfigError("TimeoutHeader", errors.New("invalid header name "+config.TimeoutHeader))
+	}
+	if config.BodyHashHeader != "" && !isValidHeaderName(config.BodyHashHeader) {
+		return InvalidConfigError("BodyHashHeader", errors.New("invalid header name "+config.BodyHashHeader))
+	}
+	if _, err := bodyHashFunc(config.BodyHashAlgorithm); err != nil {
+		return InvalidConfigError("BodyHashAlgorithm", err)
+	}
+	if config.BodyHashAlgorithm != "" && config.BodyHashHeader == "" {
+		return InvalidConfigError("BodyHashHeader", errors.New("required with BodyHashAlgorithm"))
+	}
+	for i, contentType := range config.BodyHashContentTypes {
+		if err := validateBodyHashContentType(contentType); err != nil {
+			return InvalidConfigError(fmt.Sprintf("BodyHashContentTypes[%d]", i), err)
+		}
+	}
+	if len(config.BodyHashContentTypes) > 0 && config.BodyHashHeader == "" {
+		return InvalidConfigError("BodyHashHeader", errors.New("required with BodyHashContentTypes"))
+	}
+	if config.DurationHeader != "" && !isValidHeaderName(config.DurationHeader) {
+		return InvalidConfigError("DurationHeader", errors.New("invalid header name "+config.DurationHeader))
+	}
+	if config.BypassHeader != "" && !isValidHeaderName(config.BypassHeader) {
+		return InvalidConfigError("BypassHeader", errors.New("invalid header name "+config.BypassHeader))
+	}
+	if config.BypassHeader != "" && config.BypassValue == "" {
+		return InvalidConfigError("BypassValue", errors.New("required with BypassHeader"))
+	}
+	if config.BypassValue != "" && config.BypassHeader == "" {
+		return InvalidConfigError("BypassHeader", errors.New("required with BypassValue"))
+	}
+	for i, header := range config.RequiredRequestHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("RequiredRequestHeaders[%d]", i), errors.New("invalid header name "+header))
+		}
+	}
+	if config.MissingHeaderReason != "" && len(config.RequiredRequestHeaders) == 0 {
+		return InvalidConfigError("RequiredRequestHeaders", errors.New("required with MissingHeaderReason"))
+	}
+	if config.StrictForwardRequestHeaders && !forwardsRequestContext(config) {
+		return InvalidConfigError("ForwardRequestHeaders", errors.New("must forward something of the request with StrictForwardRequestHeaders"))
+	}
+	if config.TimestampHeader != "" && !isValidHeaderName(config.TimestampHeader) {
+		return InvalidConfigError("TimestampHeader", errors.New("invalid header name "+config.TimestampHeader))
+	}
+	if config.TimestampHeader != "" && config.MaxRequestAge == "" {
+		return InvalidConfigError("MaxRequestAge", errors.New("required with TimestampHeader"))
+	}
+	if (config.MaxRequestAge != "" || config.OnInvalidTimestamp != "") && config.TimestampHeader == "" {
+		return InvalidConfigError("TimestampHeader", errors.New("required with MaxRequestAge and OnInvalidTimestamp"))
+	}
+	switch config.OnInvalidTimestamp {
+	case "", InvalidTimestampDeny, InvalidTimestampAllow:
+	default:
+		return InvalidConfigError("OnInvalidTimestamp", errors.New("must be one of deny, allow"))
+	}
+	if config.TenantHeader != "" && !isValidHeaderName(config.TenantHeader) {
+		return InvalidConfigError("TenantHeader", errors.New("invalid header name "+config.TenantHeader))
+	}
+	if len(config.TenantAuthUrls) > 0 && config.TenantHeader == "" {
+		return InvalidConfigError("TenantHeader", errors.New("required with TenantAuthUrls"))
+	}
+	if config.RouteSelector != "" {
+		if err := validateQuerySource(config.RouteSelector); err != nil {
+			return InvalidConfigError("RouteSelector", err)
+		}
+	}
+	if len(config.RouteAuthUrls) > 0 && config.RouteSelector == "" {
+		return InvalidConfigError("RouteSelector", errors.New("required with RouteAuthUrls"))
+	}
+	if config.ClientAddressHeader != "" && !isValidHeaderName(config.ClientAddressHeader) {
+		return InvalidConfigError("ClientAddressHeader", errors.New("invalid header name "+config.ClientAddressHeader))
+	}
+	if config.AuthorityHeader != "" && !isValidHeaderName(config.AuthorityHeader) {
+		return InvalidConfigError("AuthorityHeader", errors.New("invalid header name "+config.AuthorityHeader))
+	}
+	if config.VirtualHostHeader != "" && !isValidHeaderName(config.VirtualHostHeader) {
+		return InvalidConfigError("VirtualHostHeader", errors.New("invalid header name "+config.VirtualHostHeader))
+	}
+	if config.VirtualHostSource != "" {
+		if config.VirtualHostHeader == "" {
+			return InvalidConfigError("VirtualHostHeader", errors.New("required with VirtualHostSource"))
+		}
+		if err := validateQuerySource(config.VirtualHostSource); err != nil {
+			return InvalidConfigError("VirtualHostSource", err)
+		}
+	}
+	for i, name := range config.ForwardCookies {
+		if name == "" || strings.ContainsAny(name, "=; \t\r\n") {
+			return InvalidConfigError(fmt.Sprintf("ForwardCookies[%d]", i), errors.New("invalid cookie name "+name))
+		}
+	}
+	for header, rewrite := range config.ForwardHeaderRewrites {
+		if err := validateHeaderRewrite(header, rewrite); err != nil {
+			return InvalidConfigError(fmt.Sprintf("ForwardHeaderRewrites[%s]", header), err)
+		}
+	}
+	for i, condition := range config.ForwardConditions {
+		if err := validateForwardCondition(condition); err != nil {
+			return InvalidConfigError(fmt.Sprintf("ForwardConditions[%d]", i), err)
+		}
+	}
+	if err := validateResponseHeaders(config, "ResponseHeaders", config.ResponseHeaders); err != nil {
+		return err
+	}
+	for pattern, responseHeaders := range config.PathResponseHeaders {
+		field := fmt.Sprintf("PathResponseHeaders[%s]", pattern)
+		if err := validatePathPattern(pattern); err != nil {
+			return InvalidConfigError(field, err)
+		}
+		if err := validateResponseHeaders(config, field, responseHeaders); err != nil {
+			return err
+		}
+	}
+	for attribute, prefix := range config.ResponseHeaderPrefixes {
+		field := fmt.Sprintf("ResponseHeaderPrefixes[%s]", attribute)
+		if !isValidHeaderName(prefix) {
+			return InvalidConfigError(field, errors.New("invalid header name prefix "+prefix))
+		}
+		for _, candidate := range strings.Split(attribute, "|") {
+			if candidate = strings.TrimSpace(candidate); candidate == "" || strings.HasPrefix(candidate, SourceHeaderPrefix) || strings.HasPrefix(candidate, SourceDefaultPrefix) || candidate == SourceStatus {
+				return InvalidConfigError(field, errors.New("attribute must be a path of the auth response body"))
+			}
+			if err := validateAttributePath(candidate); err != nil {
+				return InvalidConfigError(field, err)
+			}
+		}
+	}
+	if config.RecursePrefixedObjects && len(config.ResponseHeaderPrefixes) == 0 {
+		return InvalidConfigError("RecursePrefixedObjects", errors.New("requires ResponseHeaderPrefixes"))
+	}
+	for attribute, header := range config.DenyResponseHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("DenyResponseHeaders[%s]", attribute), errors.New("invalid header name "+header))
+		}
+	}
+	for i, header := range config.RequiredResponseHeaders {
+		mapped := false
+		for _, responseHeader := range config.ResponseHeaders {
+			mapped = mapped || responseHeader == header
+		}
+		if !mapped {
+			return InvalidConfigError(fmt.Sprintf("RequiredResponseHeaders[%d]", i), errors.New("header "+header+" is not in ResponseHeaders"))
+		}
+		if _, ok := config.ResponseHeaderDefaults[header]; ok {
+			return InvalidConfigError(fmt.Sprintf("RequiredResponseHeaders[%d]", i), errors.New("required header "+header+" cannot have a default"))
+		}
+	}
+	for i, header := range config.AppendResponseHeaders {
+		mapped := false
+		for _, responseHeader := range config.ResponseHeaders {
+			mapped = mapped || responseHeader == header
+		}
+		if !mapped {
+			return InvalidConfigError(fmt.Sprintf("AppendResponseHeaders[%d]", i), errors.New("header "+header+" is not in ResponseHeaders"))
+		}
+	}
+	for i, header := range config.RepeatedResponseHeaders {
+		mapped := false
+		for _, responseHeader := range config.ResponseHeaders {
+			mapped = mapped || responseHeader == header
+		}
+		if !mapped {
+			return InvalidConfigError(fmt.Sprintf("RepeatedResponseHeaders[%d]", i), errors.New("header "+header+" is not in ResponseHeaders"))
+		}
+	}
+	if err := validateDuplicateHeaders(config.DuplicateHeaders); err != nil {
+		return InvalidConfigError("DuplicateHeaders", err)
+	}
+	if config.ResponseHeaderNullValue != nil {
+		if _, ok := sanitizeHeaderValue(*config.ResponseHeaderNullValue); !ok {
+			return InvalidConfigError("ResponseHeaderNullValue", errors.New("must not contain control characters"))
+		}
+	}
+	for header, attributeType := range config.ResponseHeaderTypes {
+		if err := validateAttributeType(attributeType); err != nil {
+			return InvalidConfigError(fmt.Sprintf("ResponseHeaderTypes[%s]", header), err)
+		}
+	}
+	for header, conditions := range config.ResponseHeaderConditions {
+		for attribute, pattern := range conditions {
+			if err := validateAttributeMatch(attribute, pattern); err != nil {
+				return InvalidConfigError(fmt.Sprintf("ResponseHeaderConditions[%s][%s]", header, attribute), err)
+			}
+		}
+	}
+	for header, transform := range config.ResponseHeaderTransforms {
+		if err := validateTransform(transform); err != nil {
+			return InvalidConfigError(fmt.Sprintf("ResponseHeaderTransforms[%s]", header), err)
+		}
+	}
+	for i, mapping := range config.Mappings {
+		if err := validateMapping(mapping); err != nil {
+			return InvalidConfigError(fmt.Sprintf("Mappings[%d]", i), err)
+		}
+		if mapping.Target.Type != TargetTypeMetadata && !isValidHeaderName(mapping.Target.Name) {
+			return InvalidConfigError(fmt.Sprintf("Mappings[%d]", i), errors.New("invalid header name "+mapping.Target.Name))
+		}
+	}
+
+	for attribute, key := range config.ResponseMetadata {
+		mapping := mappingsFromResponseHeaders(map[string]string{attribute: key})[0]
+		if err := validateMapping(mapping); err != nil {
+			return InvalidConfigError(fmt.Sprintf("ResponseMetadata[%s]", attribute), err)
+		}
+	}
+
+	for claim, header := range config.JwtClaimHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("JwtClaimHeaders[%s]", claim), errors.New("invalid header name "+header))
+		}
+	}
+	if len(config.JwtClaimHeaders) > 0 && config.JwtAttribute == "" {
+		return InvalidConfigError("JwtAttribute", errors.New("required with JwtClaimHeaders"))
+	}
+	if _, err := newJwtVerifier(config.JwtVerificationKey); err != nil {
+		return InvalidConfigError("JwtVerificationKey", err)
+	}
+	if config.RequestJwtHeader != "" && !isValidHeaderName(config.RequestJwtHeader) {
+		return InvalidConfigError("RequestJwtHeader", errors.New("invalid header name "+config.RequestJwtHeader))
+	}
+	if config.RequestJwtHeader != "" && len(config.RequestJwtClaimHeaders) == 0 {
+		return InvalidConfigError("RequestJwtClaimHeaders", errors.New("required with RequestJwtHeader"))
+	}
+	if config.RequestJwtHeader == "" && (len(config.RequestJwtClaimHeaders) > 0 || config.RequestJwtPrefix != "" || config.RequestJwtVerificationKey != "" || config.OnInvalidRequestJwt != "") {
+		return InvalidConfigError("RequestJwtHeader", errors.New("required with the other RequestJwt options"))
+	}
+	for claim, header := range config.RequestJwtClaimHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("RequestJwtClaimHeaders[%s]", claim), errors.New("invalid header name "+header))
+		}
+	}
+	if _, err := newJwtVerifier(config.RequestJwtVerificationKey); err != nil {
+		return InvalidConfigError("RequestJwtVerificationKey", err)
+	}
+	switch config.OnInvalidRequestJwt {
+	case "", InvalidRequestJwtSkip, InvalidRequestJwtDeny:
+	default:
+		return InvalidConfigError("OnInvalidRequestJwt", errors.New("must be one of skip, deny"))
+	}
+	if _, err := newClientAssertion(config, 0); err != nil {
+		return InvalidConfigError("ClientAssertionKey", err)
+	}
+	if config.ClientAssertionKey == "" && (len(config.ClientAssertionClaims) > 0 || config.ClientAssertionTTL != "" || config.ClientAssertionHeader != "") {
+		return InvalidConfigError("ClientAssertionKey", errors.New("required with the other ClientAssertion options"))
+	}
+	if ttl, err := parseDuration("ClientAssertionTTL", config.ClientAssertionTTL, DefaultClientAssertionTTL); err == nil && ttl == 0 {
+		return InvalidConfigError("ClientAssertionTTL", errors.New("must be positive"))
+	}
+	if config.ClientAssertionHeader != "" && !isValidHeaderName(config.ClientAssertionHeader) {
+		return InvalidConfigError("ClientAssertionHeader", errors.New("invalid header name "+config.ClientAssertionHeader))
+	}
+
+	for param, source := range config.QueryParameters {
+		if param == "" {
+			return InvalidConfigError("QueryParameters", errors.New("parameter name must not be empty"))
+		}
+		if err := validateQuerySource(source); err != nil {
+			return InvalidConfigError(fmt.Sprintf("QueryParameters[%s]", param), err)
+		}
+	}
+	for param := range config.StaticQueryParams {
+		if param == "" {
+			return InvalidConfigError("StaticQueryParams", errors.New("parameter name must not be empty"))
+		}
+		if _, ok := config.QueryParameters[param]; ok {
+			return InvalidConfigError(fmt.Sprintf("StaticQueryParams[%s]", param), errors.New("parameter "+param+" is also in QueryParameters"))
+		}
+	}
+	if config.ContextHeader != "" && !isValidHeaderName(config.ContextHeader) {
+		return InvalidConfigError("ContextHeader", errors.New("invalid header name "+config.ContextHeader))
+	}
+	if config.ContextHeader == "" && len(config.ContextAttributes) > 0 {
+		return InvalidConfigError("ContextAttributes", errors.New("requires ContextHeader"))
+	}
+	for name, source := range config.ContextAttributes {
+		if name == "" {
+			return InvalidConfigError("ContextAttributes", errors.New("key must not be empty"))
+		}
+		if err := validateQuerySource(source); err != nil {
+			return InvalidConfigError(fmt.Sprintf("ContextAttributes[%s]", name), err)
+		}
+	}
+	if config.FingerprintHeader != "" && !isValidHeaderName(config.FingerprintHeader) {
+		return InvalidConfigError("FingerprintHeader", errors.New("invalid header name "+config.FingerprintHeader))
+	}
+	if config.FingerprintHeader == "" && (len(config.FingerprintHeaders) > 0 || len(config.FingerprintAttributes) > 0) {
+		return InvalidConfigError("FingerprintHeader", errors.New("required with FingerprintHeaders and FingerprintAttributes"))
+	}
+	for i, header := range config.FingerprintHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("FingerprintHeaders[%d]", i), errors.New("invalid header name "+header))
+		}
+	}
+	for i, source := range config.FingerprintAttributes {
+		if err := validateQuerySource(source); err != nil {
+			return InvalidConfigError(fmt.Sprintf("FingerprintAttributes[%d]", i), err)
+		}
+	}
+	for header, source := range config.RequestAttributeHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("RequestAttributeHeaders[%s]", header), errors.New("invalid header name "+header))
+		}
+		if err := validateQuerySource(source); err != nil {
+			return InvalidConfigError(fmt.Sprintf("RequestAttributeHeaders[%s]", header), err)
+		}
+	}
+
+	for upstream, denied := range config.DenyStatusCodes {
+		if upstream < 100 || upstream > 599 || upstream == http.StatusOK {
+			return InvalidConfigError(fmt.Sprintf("DenyStatusCodes[%d]", upstream), errors.New("upstream status code must be a non-200 HTTP status"))
+		}
+		if denied < 400 || denied > 599 {
+			return InvalidConfigError(fmt.Sprintf("DenyStatusCodes[%d]", upstream), errors.New("denied status code must be a 4xx or 5xx HTTP status"))
+		}
+	}
+
+	switch config.OnRedirect {
+	case "", RedirectDeny, RedirectError, RedirectFollow:
+	default:
+		return InvalidConfigError("OnRedirect", errors.New("must be one of deny, error, follow"))
+	}
+	if config.FollowRedirects && config.OnRedirect != "" && config.OnRedirect != RedirectFollow {
+		return InvalidConfigError("OnRedirect", errors.New("must be follow with FollowRedirects"))
+	}
+
+	if config.DenyNotifyUrl != "" {
+		if err := validateAuthUrl(config.DenyNotifyUrl, "http", "https"); err != nil {
+			return InvalidConfigError("DenyNotifyUrl", err)
+		}
+	} else if config.DenyNotifyTimeout != "" {
+		return InvalidConfigError("DenyNotifyTimeout", errors.New("requires DenyNotifyUrl"))
+	}
+
+	if config.LoginRedirectUrl != "" {
+		if err := validateAuthUrl(config.LoginRedirectUrl, "http", "https"); err != nil {
+			return InvalidConfigError("LoginRedirectUrl", err)
+		}
+	} else if config.LoginRedirectParam != "" {
+		return InvalidConfigError("LoginRedirectParam", errors.New("requires LoginRedirectUrl"))
+	}
+
+	switch config.OnHeaderBudgetExceeded {
+	case "", HeaderBudgetTruncate, HeaderBudgetDeny:
+	default:
+		return InvalidConfigError("OnHeaderBudgetExceeded", errors.New("must be one of truncate, deny"))
+	}
+
+	switch config.OnDecodeFailure {
+	case "", DecodeFailureError, DecodeFailureAllow:
+	default:
+		return InvalidConfigError("OnDecodeFailure", errors.New("must be one of error, allow"))
+	}
+
+	if _, err := compileResponseSchema(config.ResponseSchema); err != nil {
+		return InvalidConfigError("ResponseSchema", err)
+	}
+	if config.OnSchemaViolation != "" && config.ResponseSchema == "" {
+		return InvalidConfigError("OnSchemaViolation", errors.New("requires ResponseSchema"))
+	}
+	switch config.OnSchemaViolation {
+	case "", SchemaViolationDeny, SchemaViolationError:
+	default:
+		return InvalidConfigError("OnSchemaViolation", errors.New("must be one of deny, error"))
+	}
+
+	switch config.FailureMode {
+	case "", FailureModeClosed, FailureModeOpen:
+	default:
+		return InvalidConfigError("FailureMode", errors.New("must be one of open, closed"))
+	}
+
+	if err := validateResponseFormat(config.ResponseFormat); err != nil {
+		return InvalidConfigError("ResponseFormat", err)
+	}
+	if strings.HasPrefix(config.ResponseRoot, SourceHeaderPrefix) {
+		return InvalidConfigError("ResponseRoot", errors.New("must be a path within the auth response body"))
+	}
+	if err := validateAttributePath(config.ResponseRoot); err != nil {
+		return InvalidConfigError("ResponseRoot", err)
+	}
+
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		return err
+	}
+
+	durations := []struct {
+		field string
+		value string
+	}{
+		{"IdleConnTimeout", config.IdleConnTimeout},
+		{"DialTimeout", config.DialTimeout},
+		{"TLSHandshakeTimeout", config.TLSHandshakeTimeout},
+		{"RequestTimeout", config.RequestTimeout},
+		{"RetryBackoff", config.RetryBackoff},
+		{"TotalRetryBudget", config.TotalRetryBudget},
+		{"DrainTimeout", config.DrainTimeout},
+		{"WarmupDuration", config.WarmupDuration},
+		{"CacheTTL", config.CacheTTL},
+		{"NegativeCacheTTL", config.NegativeCacheTTL},
+		{"CacheRefreshAhead", config.CacheRefreshAhead},
+		{"MaxStaleAge", config.MaxStaleAge},
+		{"ClockSkewGrace", config.ClockSkewGrace},
+		{"MaxRequestAge", config.MaxRequestAge},
+		{"ClientAssertionTTL", config.ClientAssertionTTL},
+		{"DenyNotifyTimeout", config.DenyNotifyTimeout},
+		{"HealthCheckInterval", config.HealthCheckInterval},
+	}
+	for _, d := range durations {
+		if _, err := parseDuration(d.field, d.value, 0); err != nil {
+			return err
+		}
+	}
+	if config.TotalRetryBudget != "" && config.MaxRetries == 0 {
+		return InvalidConfigError("TotalRetryBudget", errors.New("requires MaxRetries"))
+	}
+	if config.ExpiryAttribute != "" && config.CacheTTL == "" {
+		return InvalidConfigError("CacheTTL", errors.New("required with ExpiryAttribute"))
+	}
+	if config.ClockSkewGrace != "" && config.ExpiryAttribute == "" {
+		return InvalidConfigError("ClockSkewGrace", errors.New("requires ExpiryAttribute"))
+	}
+	if config.NegativeCacheTTL != "" && config.CacheTTL == "" {
+		return InvalidConfigError("CacheTTL", errors.New("required with NegativeCacheTTL"))
+	}
+	if config.ServeStaleOnError && config.CacheTTL == "" {
+		return InvalidConfigError("CacheTTL", errors.New("required with ServeStaleOnError"))
+	}
+	if len(config.CacheKeyHeaders) > 0 && config.CacheTTL == "" {
+		return InvalidConfigError("CacheTTL", errors.New("required with CacheKeyHeaders"))
+	}
+	for _, header := range config.CacheKeyHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError("CacheKeyHeaders", errors.New("invalid header name "+header))
+		}
+	}
+	if config.MaxStaleAge != "" && !config.ServeStaleOnError {
+		return InvalidConfigError("MaxStaleAge", errors.New("requires ServeStaleOnError"))
+	}
+	if config.CacheRefreshAhead != "" {
+		cacheTTL, _ := parseDuration("CacheTTL", config.CacheTTL, 0)
+		cacheRefreshAhead, _ := parseDuration("CacheRefreshAhead", config.CacheRefreshAhead, 0)
+		if cacheRefreshAhead >= cacheTTL {
+			return InvalidConfigError("CacheRefreshAhead", errors.New("must be shorter than CacheTTL"))
+		}
+	}
+
+	if config.HealthCheckUrl != "" {
+		if config.HealthCheckInterval == "" {
+			return InvalidConfigError("HealthCheckInterval", errors.New("required with HealthCheckUrl"))
+		}
+		if err := validateAuthUrl(config.HealthCheckUrl, "http", "https"); err != nil {
+			return InvalidConfigError("HealthCheckUrl", err)
+		}
+	}
+
+	if config.AdminListenAddr != "" {
+		if _, _, err := net.SplitHostPort(config.AdminListenAddr); err != nil {
+			return InvalidConfigError("AdminListenAddr", err)
+		}
+	}
+
+	if err := validateMinTLSVersion(config.MinTLSVersion); err != nil {
+		return InvalidConfigError("MinTLSVersion", err)
+	}
+	if config.ProxyUrl != "" {
+		if err := validateAuthUrl(config.ProxyUrl, "http", "https", "socks5"); err != nil {
+			return InvalidConfigError("ProxyUrl", err)
+		}
+		if config.UseHTTP2 {
+			return InvalidConfigError("ProxyUrl", errors.New("not supported with UseHTTP2"))
+		}
+	}
+
+	if config.DisableKeepAlives && config.UseHTTP2 {
+		return InvalidConfigError("DisableKeepAlives", errors.New("not supported with UseHTTP2"))
+	}
+
+	if config.RateLimit < 0 {
+		return InvalidConfigError("RateLimit", errors.New("must not be negative"))
+	}
+
+	numbers := []struct {
+		field string
+		value int
+	}{
+		{"MaxIdleConns", config.MaxIdleConns},
+		{"MaxIdleConnsPerHost", config.MaxIdleConnsPerHost},
+		{"RateLimitBurst", config.RateLimitBurst},
+		{"MaxConcurrentRequests", config.MaxConcurrentRequests},
+		{"MaxResponseBytes", config.MaxResponseBytes},
+		{"MaxRetries", config.MaxRetries},
+		{"CacheMaxEntries", config.CacheMaxEntries},
+		{"MaxForwardedHeaderBytes", config.MaxForwardedHeaderBytes},
+		{"MaxForwardedHeaders", config.MaxForwardedHeaders},
+		{"MaxResponseHeaders", config.MaxResponseHeaders},
+		{"MaxResponseHeaderBytes", config.MaxResponseHeaderBytes},
+	}
+	for _, n := range numbers {
+		if n.value < 0 {
+			return InvalidConfigError(n.field, errors.New("must not be negative"))
+		}
+	}
+
+	return nil
+}
+
+func validateAuthUrl(authUrl string, schemes ...string) error {
+	if authUrl == "" {
+		return errors.New("must not be empty")
+	}
+	u, err := url.Parse(authUrl)
+	if err != nil {
+		return err
+	}
+	validScheme := false
+	for _, scheme := range schemes {
+		validScheme = validScheme || u.Scheme == scheme
+	}
+	if !validScheme {
+		return errors.New("scheme must be one of " + strings.Join(schemes, ", "))
+	}
+	if u.Host == "" {
+		return errors.New("host must not be empty")
+	}
+	return nil
+}
+
+// parseDuration parses a duration config field, returning defaultValue when the field is empty.
+func parseDuration(field string, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, InvalidConfigError(field, err)
+	}
+	if d < 0 {
+		return 0, InvalidConfigError(field, errors.New("must not be negative"))
+	}
+	return d, nil
+}
+
+func parseLogLevel(value string) (zapcore.Level, error) {
+	if value == "" {
+		return DefaultLogLevel, nil
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return DefaultLogLevel, InvalidConfigError("LogLevel", err)
+	}
+	return level, nil
+}
+
+// isValidHeaderName reports whether name is a valid HTTP header field name (an RFC 7230 token).
+func isValidHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validateResponseHeaders checks an attribute-to-header map, ResponseHeaders or a
+// PathResponseHeaders profile, reporting errors for its entries under field.
+func validateResponseHeaders(config *Config, field string, responseHeaders map[string]string) error {
+	for attribute, header := range responseHeaders {
+		if !isValidHeaderName(header) {
+			return InvalidConfigError(fmt.Sprintf("%s[%s]", field, attribute), errors.New("invalid header name "+header))
+		}
+		candidates := strings.Split(attribute, "|")
+		for i, candidate := range candidates {
+			if candidate = strings.TrimSpace(candidate); candidate == "" || candidate == SourceHeaderPrefix {
+				return InvalidConfigError(fmt.Sprintf("%s[%s]", field, attribute), errors.New("attribute must not be empty"))
+			}
+			if candidate == SourceStatus {
+				continue
+			}
+			if err := validateAttributePath(candidate); err != nil {
+				return InvalidConfigError(fmt.Sprintf("%s[%s]", field, attribute), err)
+			}
+			if !strings.HasPrefix(candidate, SourceDefaultPrefix) {
+				continue
+			}
+			if i == 0 || i != len(candidates)-1 {
+				return InvalidConfigError(fmt.Sprintf("%s[%s]", field, attribute), errors.New("a default must be the last candidate, after an attribute"))
+			}
+			if _, ok := config.ResponseHeaderDefaults[header]; ok {
+				return InvalidConfigError(fmt.Sprintf("%s[%s]", field, attribute), errors.New("header "+header+" also has a ResponseHeaderDefaults value"))
+			}
+			for _, required := range config.RequiredResponseHeaders {
+				if required == header {
+					return InvalidConfigError(fmt.Sprintf("%s[%s]", field, attribute), errors.New("required header "+header+" cannot have a default"))
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package pkg
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// startWarmup starts the WarmupDuration, if any, when the service is started.
+func (c *RemoteAuthService) startWarmup() {
+	if c.warmupDuration > 0 {
+		atomic.StoreInt64(&c.warmupEnds, time.Now().Add(c.warmupDuration).UnixNano())
+	}
+}
+
+// warmingUp reports whether the service was started less than WarmupDuration ago.
+func (c *RemoteAuthService) warmingUp() bool {
+	ends := atomic.LoadInt64(&c.warmupEnds)
+	return ends != 0 && time.Now().UnixNano() < ends
+}
+
+// failOpenReason returns why failsOpen allows a request, for logging.
+func (c *RemoteAuthService) failOpenReason() string {
+	if c.FailureMode == FailureModeOpen {
+		return "Auth backend unreachable, allowing request as FailureMode is open"
+	}
+	return "Auth backend unreachable during warmup, allowing request"
+}